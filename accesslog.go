@@ -0,0 +1,137 @@
+package javadocr
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type AccessLogFormat int
+
+const (
+	// AccessLogCombined is the Apache/nginx Combined Log Format, followed
+	// by the project, version, cache status and how long we took.
+	AccessLogCombined AccessLogFormat = iota
+	// AccessLogJSON writes one JSON object per request.
+	AccessLogJSON
+)
+
+// requestInfo is filled in by a JavadocHandler as it serves a request, so that
+// the access log can tell what it did.
+type requestInfo struct {
+	Project string
+	Version string
+	Cache   string
+}
+
+type requestInfoKey struct{}
+
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
+
+// AccessLog wraps a handler, writing a line to w for every request it serves.
+type AccessLog struct {
+	next   http.Handler
+	format AccessLogFormat
+
+	w  io.Writer
+	mu sync.Mutex
+}
+
+func NewAccessLog(next http.Handler, w io.Writer, format AccessLogFormat) *AccessLog {
+	return &AccessLog{
+		next:   next,
+		format: format,
+		w:      w,
+	}
+}
+
+type accessLogEntry struct {
+	Time      time.Time `json:"time"`
+	Remote    string    `json:"remote"`
+	Method    string    `json:"method"`
+	Host      string    `json:"host"`
+	URI       string    `json:"uri"`
+	Proto     string    `json:"proto"`
+	Status    int       `json:"status"`
+	Bytes     int64     `json:"bytes"`
+	Referer   string    `json:"referer,omitempty"`
+	UserAgent string    `json:"user_agent,omitempty"`
+	Project   string    `json:"project,omitempty"`
+	Version   string    `json:"version,omitempty"`
+	Cache     string    `json:"cache,omitempty"`
+	Duration  float64   `json:"duration_seconds"`
+}
+
+func (al *AccessLog) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	ri := new(requestInfo)
+	sr := &statusRecorder{ResponseWriter: w}
+	r = r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, ri))
+
+	al.next.ServeHTTP(sr, r)
+
+	remote, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		remote = r.RemoteAddr
+	}
+	e := accessLogEntry{
+		Time:      start,
+		Remote:    remote,
+		Method:    r.Method,
+		Host:      r.Host,
+		URI:       r.RequestURI,
+		Proto:     r.Proto,
+		Status:    sr.status(),
+		Bytes:     sr.bytes,
+		Referer:   r.Referer(),
+		UserAgent: r.UserAgent(),
+		Project:   ri.Project,
+		Version:   ri.Version,
+		Cache:     ri.Cache,
+		Duration:  time.Since(start).Seconds(),
+	}
+
+	al.mu.Lock()
+	defer al.mu.Unlock()
+	if al.format == AccessLogJSON {
+		json.NewEncoder(al.w).Encode(e)
+		return
+	}
+	fmt.Fprintln(al.w, e.combined())
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+func (e accessLogEntry) combined() string {
+	size := "-"
+	if e.Bytes > 0 {
+		size = strconv.FormatInt(e.Bytes, 10)
+	}
+	return fmt.Sprintf(`%s - - [%s] %s %d %s %s %s project=%s version=%s cache=%s duration=%.3f`,
+		e.Remote,
+		e.Time.Format("02/Jan/2006:15:04:05 -0700"),
+		strconv.Quote(e.Method+" "+e.URI+" "+e.Proto),
+		e.Status,
+		size,
+		strconv.Quote(orDash(e.Referer)),
+		strconv.Quote(orDash(e.UserAgent)),
+		orDash(e.Project),
+		orDash(e.Version),
+		orDash(e.Cache),
+		e.Duration,
+	)
+}
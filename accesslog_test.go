@@ -0,0 +1,51 @@
+package javadocr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestAccessLog(t *testing.T) {
+	tr := newTestRepository(t, "2.0")
+	tr.jars["2.0"] = makeJar(t, map[string]string{"overview-summary.html": "<html></html>"})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{Name: "spongeapi", GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var buf bytes.Buffer
+	al := NewAccessLog(h, &buf, AccessLogCombined)
+	req := httptest.NewRequest("GET", "/2.0/overview-summary.html", nil)
+	req.Header.Set("User-Agent", "test \"agent\"")
+	al.ServeHTTP(httptest.NewRecorder(), req)
+	al.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/2.0/overview-summary.html", nil))
+
+	lines := bytes.Split(bytes.TrimSpace(buf.Bytes()), []byte("\n"))
+	if len(lines) != 2 {
+		t.Fatalf("got %d lines, expected 2: %s", len(lines), buf.String())
+	}
+	combined := regexp.MustCompile(`^192\.0\.2\.1 - - \[[^]]+\] "GET /2\.0/overview-summary\.html HTTP/1\.1" 200 13 "-" "test \\"agent\\"" project=spongeapi version=2\.0 cache=miss duration=[0-9.]+$`)
+	if !combined.Match(lines[0]) {
+		t.Errorf("got %s", lines[0])
+	}
+	if !bytes.Contains(lines[1], []byte("cache=hit")) {
+		t.Errorf("second request wasn't a cache hit: %s", lines[1])
+	}
+
+	buf.Reset()
+	al = NewAccessLog(h, &buf, AccessLogJSON)
+	al.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/9.0/", nil))
+	var e accessLogEntry
+	if err := json.Unmarshal(buf.Bytes(), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Status != http.StatusNotFound || e.Project != "spongeapi" || e.Version != "" || e.URI != "/9.0/" {
+		t.Errorf("got %#v", e)
+	}
+}
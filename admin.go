@@ -0,0 +1,350 @@
+package javadocr
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// adminState is what the AdminHandler persists between restarts: for each
+// project, the versions which have been explicitly excluded (true) or
+// included (false) through the API.
+type adminState struct {
+	Projects map[string]map[string]bool `json:"projects"`
+}
+
+// AdminHandler serves a JSON API for inspecting and managing projects. Every
+// request must carry the token as "Authorization: Bearer <token>".
+//
+//	GET    /projects                               list projects
+//	GET    /projects/<project>/versions            list versions
+//	PUT    /projects/<project>/exclusions/<version> exclude a version
+//	DELETE /projects/<project>/exclusions/<version> include it again
+//	POST   /projects/<project>/refresh             check for new versions now
+//	GET    /projects/<project>/cache               list cached artifacts
+//	POST   /projects/<project>/cache/<version>     fetch a version into the cache
+//	DELETE /projects/<project>/cache/<version>     evict a version from the cache
+//
+// Exclusions changed through the API are written to the state file, if
+// there is one, and reapplied by NewAdminHandler on the next start.
+type AdminHandler struct {
+	projects  Projects
+	token     string
+	stateFile string
+
+	state     adminState
+	stateLock sync.Mutex
+}
+
+func NewAdminHandler(projects Projects, token, stateFile string) (*AdminHandler, error) {
+	ah := &AdminHandler{
+		projects:  projects,
+		token:     token,
+		stateFile: stateFile,
+		state:     adminState{Projects: make(map[string]map[string]bool)},
+	}
+	if err := ah.loadState(); err != nil {
+		return nil, err
+	}
+	return ah, nil
+}
+
+func (ah *AdminHandler) loadState() error {
+	if ah.stateFile == "" {
+		return nil
+	}
+
+	data, err := ioutil.ReadFile(ah.stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &ah.state); err != nil {
+		return err
+	}
+	if ah.state.Projects == nil {
+		ah.state.Projects = make(map[string]map[string]bool)
+	}
+
+	for name, overrides := range ah.state.Projects {
+		h, ok := ah.projects[name]
+		if !ok {
+			// keep it around in case the project comes back
+			continue
+		}
+		for v, excluded := range overrides {
+			if excluded {
+				h.ExcludeVersion(v)
+			} else {
+				h.IncludeVersion(v)
+			}
+		}
+	}
+	return nil
+}
+
+// saveState must be called whilst holding stateLock!
+func (ah *AdminHandler) saveState() error {
+	if ah.stateFile == "" {
+		return nil
+	}
+
+	data, err := json.MarshalIndent(ah.state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(ah.stateFile), ".state-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), ah.stateFile)
+}
+
+func (ah *AdminHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || ah.token == "" || subtle.ConstantTimeCompare([]byte(given), []byte(ah.token)) != 1 {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="javadocr"`)
+		writeJSONError(w, http.StatusUnauthorized, "bad token")
+		return
+	}
+
+	pieces := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+	if len(pieces) == 1 && pieces[0] == "projects" {
+		if r.Method != "GET" {
+			writeMethodNotAllowed(w, "GET")
+			return
+		}
+		ah.listProjects(w)
+		return
+	}
+	if len(pieces) < 3 || pieces[0] != "projects" {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	name := pieces[1]
+	h, ok := ah.projects[name]
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown project")
+		return
+	}
+
+	// the route is the rest of the path, with the version (if any) cut off
+	route, version := pieces[2], ""
+	if len(pieces) == 4 {
+		route, version = pieces[2]+"/", pieces[3]
+	} else if len(pieces) > 4 {
+		writeJSONError(w, http.StatusNotFound, "not found")
+		return
+	}
+
+	switch {
+	case route == "versions" && r.Method == "GET":
+		ah.listVersions(w, h)
+	case route == "exclusions/" && r.Method == "PUT":
+		ah.setExcluded(w, name, h, version, true)
+	case route == "exclusions/" && r.Method == "DELETE":
+		ah.setExcluded(w, name, h, version, false)
+	case route == "refresh" && r.Method == "POST":
+		ah.refresh(w, h)
+	case route == "cache" && r.Method == "GET":
+		ah.listCache(w, h)
+	case route == "cache/" && r.Method == "POST":
+		ah.prefetch(w, h, version)
+	case route == "cache/" && r.Method == "DELETE":
+		ah.evict(w, h, version)
+	case route == "versions" || route == "cache":
+		writeMethodNotAllowed(w, "GET")
+	case route == "refresh":
+		writeMethodNotAllowed(w, "POST")
+	case route == "exclusions/":
+		writeMethodNotAllowed(w, "PUT, DELETE")
+	case route == "cache/":
+		writeMethodNotAllowed(w, "POST, DELETE")
+	default:
+		writeJSONError(w, http.StatusNotFound, "not found")
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeJSONError(w http.ResponseWriter, code int, msg string) {
+	writeJSON(w, code, struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+func writeMethodNotAllowed(w http.ResponseWriter, allow string) {
+	w.Header().Set("Allow", allow)
+	writeJSONError(w, http.StatusMethodNotAllowed, "method not allowed")
+}
+
+type adminProject struct {
+	Name          string     `json:"name"`
+	Coordinate    string     `json:"coordinate"`
+	Versions      int        `json:"versions"`
+	Latest        string     `json:"latest,omitempty"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+func (ah *AdminHandler) listProjects(w http.ResponseWriter) {
+	ps := make([]adminProject, 0, len(ah.projects))
+	for _, name := range ah.projects.Names() {
+		h := ah.projects[name]
+		p := adminProject{
+			Name:       name,
+			Coordinate: h.coordinate.String(),
+		}
+
+		h.versionsLock.RLock()
+		p.Versions = len(h.versions)
+		h.versionsLock.RUnlock()
+		// the same as what's redirected to, so not a SNAPSHOT
+		if latest, ok := h.latestVersion(); ok {
+			p.Latest = latest.Version
+		}
+		if degraded, since := h.Degraded(); degraded {
+			p.DegradedSince = &since
+		}
+		ps = append(ps, p)
+	}
+	writeJSON(w, http.StatusOK, ps)
+}
+
+type adminVersion struct {
+	Version  string `json:"version"`
+	Snapshot bool   `json:"snapshot"`
+	Excluded bool   `json:"excluded"`
+	Cached   bool   `json:"cached"`
+}
+
+func (ah *AdminHandler) listVersions(w http.ResponseWriter, h *JavadocHandler) {
+	h.versionsLock.RLock()
+	vs := make([]adminVersion, len(h.versions))
+	for n, c := range h.versions {
+		vs[n] = adminVersion{
+			Version:  c.Version,
+			Snapshot: c.IsSnapshot(),
+			Excluded: h.excludeVersions[c.Version],
+		}
+	}
+	h.versionsLock.RUnlock()
+
+	h.versionCacheLock.RLock()
+	for n := range vs {
+		for c := range h.versionCache {
+			if c.Version == vs[n].Version {
+				vs[n].Cached = true
+			}
+		}
+	}
+	h.versionCacheLock.RUnlock()
+
+	writeJSON(w, http.StatusOK, vs)
+}
+
+func (ah *AdminHandler) setExcluded(w http.ResponseWriter, name string, h *JavadocHandler, v string, excluded bool) {
+	if excluded {
+		h.ExcludeVersion(v)
+	} else {
+		h.IncludeVersion(v)
+	}
+	h.logger.Info("Admin API changed exclusion", "version", v, "excluded", excluded)
+
+	ah.stateLock.Lock()
+	defer ah.stateLock.Unlock()
+	if ah.state.Projects[name] == nil {
+		ah.state.Projects[name] = make(map[string]bool)
+	}
+	ah.state.Projects[name][v] = excluded
+	if err := ah.saveState(); err != nil {
+		h.logger.Error("Admin API failed to save state", "file", ah.stateFile, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, "saving state failed: "+err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *AdminHandler) refresh(w http.ResponseWriter, h *JavadocHandler) {
+	if err := h.populateVersions(); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type adminCacheEntry struct {
+	Version    string    `json:"version"`
+	URL        string    `json:"url,omitempty"`
+	Size       int64     `json:"size"`
+	CachedAt   time.Time `json:"cached_at"`
+	AgeSeconds int64     `json:"age_seconds"`
+	ValidUntil time.Time `json:"valid_until"`
+}
+
+func (ah *AdminHandler) listCache(w http.ResponseWriter, h *JavadocHandler) {
+	h.versionCacheLock.RLock()
+	entries := make([]adminCacheEntry, 0, len(h.versionCache))
+	for c, jc := range h.versionCache {
+		e := adminCacheEntry{
+			Version:    c.Version,
+			Size:       jc.size,
+			CachedAt:   jc.cached,
+			AgeSeconds: int64(time.Since(jc.cached).Seconds()),
+			ValidUntil: h.calculateValidUntil(c, jc.cached),
+		}
+		if jc.artifact.URL != nil {
+			e.URL = jc.artifact.URL.String()
+		}
+		entries = append(entries, e)
+	}
+	h.versionCacheLock.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].Version < entries[j].Version
+	})
+	writeJSON(w, http.StatusOK, entries)
+}
+
+func (ah *AdminHandler) prefetch(w http.ResponseWriter, h *JavadocHandler, v string) {
+	c, ok := h.coordinateForVersion(v)
+	if !ok {
+		writeJSONError(w, http.StatusNotFound, "unknown version")
+		return
+	}
+	if _, _, _, err := h.fetchForCoordinate(c); err != nil {
+		writeJSONError(w, http.StatusBadGateway, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (ah *AdminHandler) evict(w http.ResponseWriter, h *JavadocHandler, v string) {
+	if !h.Invalidate(v) {
+		writeJSONError(w, http.StatusNotFound, "not cached")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
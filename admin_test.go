@@ -0,0 +1,133 @@
+package javadocr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, ah *AdminHandler, method, path, token string, into interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	ah.ServeHTTP(rec, req)
+	if into != nil && rec.Code == http.StatusOK {
+		if err := json.Unmarshal(rec.Body.Bytes(), into); err != nil {
+			t.Fatalf("%s %s: %v", method, path, err)
+		}
+	}
+	return rec.Code
+}
+
+func TestAdminHandler(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	tr.jars["2.0"] = makeJar(t, map[string]string{"index.html": "<html></html>"})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	stateFile := filepath.Join(t.TempDir(), "state.json")
+	ah, err := NewAdminHandler(Projects{"spongeapi": h}, "t0ken", stateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if code := adminRequest(t, ah, "GET", "/projects", "", nil); code != http.StatusUnauthorized {
+		t.Errorf("no token: got %d", code)
+	}
+	if code := adminRequest(t, ah, "GET", "/projects", "wrong", nil); code != http.StatusUnauthorized {
+		t.Errorf("wrong token: got %d", code)
+	}
+	req := httptest.NewRequest("GET", "/projects", nil)
+	req.Header.Set("Authorization", "t0ken")
+	rec := httptest.NewRecorder()
+	ah.ServeHTTP(rec, req)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("token without Bearer: got %d", rec.Code)
+	}
+
+	var projects []adminProject
+	if code := adminRequest(t, ah, "GET", "/projects", "t0ken", &projects); code != http.StatusOK {
+		t.Fatalf("listing projects: got %d", code)
+	}
+	if len(projects) != 1 || projects[0].Name != "spongeapi" || projects[0].Versions != 2 || projects[0].Latest != "2.0" {
+		t.Errorf("got projects %#v", projects)
+	}
+	if code := adminRequest(t, ah, "GET", "/projects/unknown/versions", "t0ken", nil); code != http.StatusNotFound {
+		t.Errorf("unknown project: got %d", code)
+	}
+
+	if code := adminRequest(t, ah, "PUT", "/projects/spongeapi/exclusions/2.0", "t0ken", nil); code != http.StatusNoContent {
+		t.Fatalf("excluding: got %d", code)
+	}
+	if latest := h.latestVersions(1); latest[0].Version != "1.0" {
+		t.Errorf("after excluding 2.0, latest is %v", latest[0].Version)
+	}
+
+	if code := adminRequest(t, ah, "POST", "/projects/spongeapi/cache/2.0", "t0ken", nil); code != http.StatusNoContent {
+		t.Fatalf("prefetching: got %d", code)
+	}
+	var entries []adminCacheEntry
+	if code := adminRequest(t, ah, "GET", "/projects/spongeapi/cache", "t0ken", &entries); code != http.StatusOK {
+		t.Fatalf("listing cache: got %d", code)
+	}
+	if len(entries) != 1 || entries[0].Version != "2.0" || entries[0].Size != int64(len(tr.jars["2.0"])) {
+		t.Errorf("got cache entries %#v", entries)
+	}
+
+	var versions []adminVersion
+	adminRequest(t, ah, "GET", "/projects/spongeapi/versions", "t0ken", &versions)
+	expected := []adminVersion{{"1.0", false, false, false}, {"2.0", false, true, true}}
+	if len(versions) != 2 || versions[0] != expected[0] || versions[1] != expected[1] {
+		t.Errorf("got versions %#v, expected %#v", versions, expected)
+	}
+
+	if code := adminRequest(t, ah, "DELETE", "/projects/spongeapi/cache/2.0", "t0ken", nil); code != http.StatusNoContent {
+		t.Errorf("evicting: got %d", code)
+	}
+	if code := adminRequest(t, ah, "DELETE", "/projects/spongeapi/cache/2.0", "t0ken", nil); code != http.StatusNotFound {
+		t.Errorf("evicting again: got %d", code)
+	}
+
+	// a new handler picks up the persisted exclusion
+	h2, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	if _, err := NewAdminHandler(Projects{"spongeapi": h2}, "t0ken", stateFile); err != nil {
+		t.Fatal(err)
+	}
+	if latest := h2.latestVersions(1); latest[0].Version != "1.0" {
+		t.Errorf("exclusion wasn't persisted, latest is %v", latest[0].Version)
+	}
+}
+
+func TestAdminHandlerLatestIsntSnapshot(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0-SNAPSHOT")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	ah, err := NewAdminHandler(Projects{"spongeapi": h}, "t0ken", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// it's what unversioned URLs are redirected to
+	var projects []adminProject
+	if code := adminRequest(t, ah, "GET", "/projects", "t0ken", &projects); code != http.StatusOK {
+		t.Fatalf("listing projects: got %d", code)
+	}
+	if len(projects) != 1 || projects[0].Latest != "2.0" {
+		t.Errorf("got projects %#v, expected 2.0 to be the latest", projects)
+	}
+}
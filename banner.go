@@ -0,0 +1,241 @@
+package javadocr
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"hash/crc32"
+	"html/template"
+	"io"
+	"io/fs"
+	"strings"
+)
+
+// bannerCacheSize is how many rendered banners are kept until they go out of
+// date.
+const bannerCacheSize = 4096
+
+// VersionBanner is what a Config's VersionBanner is executed with.
+type VersionBanner struct {
+	Project string
+	// Version is the version being viewed, and Path the page within it.
+	Version    string
+	Path       string
+	IsSnapshot bool
+	IsLatest   bool
+
+	// Latest is the latest version, and LatestURL the page in it, or the
+	// top of its docs if it doesn't have the page.
+	Latest    string
+	LatestURL string
+
+	// Versions are all the versions which aren't excluded, newest first,
+	// linking to the page in each of them.
+	Versions []VersionLink
+}
+
+// DefaultVersionBanner says which version is being viewed, and lets the
+// reader switch to another.
+var DefaultVersionBanner = template.Must(template.New("banner").Parse(`<div class="javadocr-version" style="background: #eef3f8; border: 1px solid #c9d6e3; color: #333; padding: 0.5em 1em; margin: 0 0 1em 0; font-family: sans-serif;">` +
+	`{{if .IsLatest}}You are viewing {{.Version}}, the latest version.` +
+	`{{else if .IsSnapshot}}You are viewing {{.Version}}, a development build; the latest release is <a href="{{.LatestURL}}">{{.Latest}}</a>.` +
+	`{{else}}You are viewing {{.Version}}; the latest is <a href="{{.LatestURL}}">{{.Latest}}</a>.{{end}}` +
+	` <select style="margin-left: 1em;" onchange="window.location.href = this.value" aria-label="Version">` +
+	`{{range .Versions}}<option value="{{.URL}}"{{if eq .Version $.Version}} selected{{end}}>{{.Version}}</option>{{end}}` +
+	`</select></div>`))
+
+// wantsBanner reports whether the page at pth should get a banner: it must be
+// HTML, or a folder, but not one of javadoc's navigation frames, which are
+// too small for one.
+func wantsBanner(pth string) bool {
+	if strings.HasSuffix(pth, "-frame.html") {
+		return false
+	}
+	return strings.HasSuffix(pth, ".html") || strings.HasSuffix(pth, "/")
+}
+
+// versionBanner renders the banner for the page pth in version, and a
+// canonical link to the page in the latest version if it has it, as things
+// stood when bs was worked out. The banner is empty if the Config doesn't
+// have a VersionBanner, or the page doesn't want one.
+func (h *JavadocHandler) versionBanner(bs *bannerState, version, pth string) (banner, head string, err error) {
+	if h.config.VersionBanner == nil || !wantsBanner(pth) || bs == nil {
+		return "", "", nil
+	}
+
+	vb := &VersionBanner{
+		Project:    h.config.Name,
+		Version:    version,
+		Path:       pth,
+		IsSnapshot: maven.Coordinate{Version: version}.IsSnapshot(),
+		IsLatest:   version == bs.latest.Version,
+		Latest:     bs.latest.Version,
+		LatestURL:  versionLink(bs.latest.Version).URL,
+	}
+	// only if it's cached, so that rendering a page never downloads one
+	if bs.latestServer != nil {
+		if _, err := fs.Stat(bs.latestServer, fsPath(pth)); err == nil {
+			vb.LatestURL = pageURL(bs.latest.Version, pth, nil)
+			head = fmt.Sprintf(`<link rel="canonical" href="%s">`, template.HTMLEscapeString(vb.LatestURL))
+		}
+	}
+
+	for n := len(bs.versions.versions) - 1; n >= 0; n-- {
+		v := bs.versions.versions[n]
+		if bs.versions.excluded[v] && v != version {
+			continue
+		}
+		vb.Versions = append(vb.Versions, VersionLink{Version: v, URL: pageURL(v, pth, nil)})
+	}
+
+	var buf bytes.Buffer
+	if err := h.config.VersionBanner.Execute(&buf, vb); err != nil {
+		return "", "", err
+	}
+	return buf.String(), head, nil
+}
+
+// bannerVersions sums up the versions which can be switched to, for the
+// generation of the list of versions it was worked out from.
+type bannerVersions struct {
+	generation uint64
+	sum        uint32
+	// versions are all of them, oldest first, and excluded those which
+	// can't be switched to
+	versions []string
+	excluded map[string]bool
+}
+
+// bannerState is everything banners depend on, apart from the page they're
+// on, as it was when key was worked out from it.
+type bannerState struct {
+	key          string
+	latest       maven.Coordinate
+	latestServer *ZipFileSystem
+	versions     *bannerVersions
+}
+
+type bannerCacheKey struct {
+	version, path string
+}
+
+type renderedBanner struct {
+	banner, head string
+}
+
+// bannerState works out everything banners depend on, apart from the page
+// they're on: the versions which can be switched to, which settle which is
+// the latest, and the artifact the latest version's canonical links are
+// found in. It is nil if there aren't any versions.
+//
+// The versions are summed up once per generation of the list, rather than on
+// every request, and by what's in the list rather than by the generation, so
+// that ETags don't depend on how many changes an instance has seen.
+func (h *JavadocHandler) bannerState() *bannerState {
+	latest, ok := h.latestVersion()
+	if !ok {
+		return nil
+	}
+	bs := &bannerState{latest: latest, latestServer: h.cachedServer(latest)}
+	var checksum string
+	if bs.latestServer != nil {
+		checksum = bs.latestServer.Checksum
+	}
+
+	generation := h.versionsGeneration()
+	h.bannerLock.Lock()
+	defer h.bannerLock.Unlock()
+	if h.bannerVersions == nil || h.bannerVersions.generation != generation {
+		bv := &bannerVersions{generation: generation, excluded: make(map[string]bool)}
+		sum := crc32.NewIEEE()
+		versions := h.sortedVersions()
+		h.versionsLock.RLock()
+		for _, c := range versions {
+			bv.versions = append(bv.versions, c.Version)
+			if h.excludeVersions[c.Version] {
+				bv.excluded[c.Version] = true
+				continue
+			}
+			io.WriteString(sum, c.Version+"\x00")
+		}
+		h.versionsLock.RUnlock()
+		bv.sum = sum.Sum32()
+		h.bannerVersions = bv
+	}
+	bs.versions = h.bannerVersions
+	bs.key = fmt.Sprintf("%s-%08x-%s", latest.Version, bs.versions.sum, checksum)
+	return bs
+}
+
+// cachedVersionBanner is versionBanner, rendered only the first time it's
+// asked for with the same bannerState key.
+func (h *JavadocHandler) cachedVersionBanner(bs *bannerState, version, pth string) (banner, head string, err error) {
+	if bs == nil {
+		return "", "", nil
+	}
+	ck := bannerCacheKey{version, pth}
+	h.bannerLock.Lock()
+	rb, ok := h.banners[ck]
+	ok = ok && h.bannersKey == bs.key
+	h.bannerLock.Unlock()
+	if ok {
+		return rb.banner, rb.head, nil
+	}
+
+	banner, head, err = h.versionBanner(bs, version, pth)
+	if err != nil {
+		return "", "", err
+	}
+	h.bannerLock.Lock()
+	if h.bannersKey != bs.key {
+		// banners for an older key won't be asked for again, unless
+		// bs is the one which is out of date
+		h.banners, h.bannersKey = nil, bs.key
+	}
+	if h.bannersKey == bs.key {
+		if h.banners == nil || len(h.banners) >= bannerCacheSize {
+			h.banners = make(map[bannerCacheKey]renderedBanner)
+		}
+		h.banners[ck] = renderedBanner{banner, head}
+	}
+	h.bannerLock.Unlock()
+	return banner, head, nil
+}
+
+// versionBannerInjector puts the version banner on pages. It is keyed by
+// its bannerState, rather than by the banner itself like other
+// HTMLInjectors, so that the banner needn't be rendered just to find out
+// whether a page has to be transformed again.
+type versionBannerInjector struct {
+	*HTMLInjector
+	h *JavadocHandler
+}
+
+func newVersionBannerInjector(h *JavadocHandler) *versionBannerInjector {
+	return &versionBannerInjector{
+		HTMLInjector: &HTMLInjector{
+			Fragments: func(tc *TransformContext) (string, string, error) {
+				// the banner must be the one the page is kept under
+				bs := tc.banner
+				if bs == nil {
+					bs = h.bannerState()
+				}
+				banner, head, err := h.cachedVersionBanner(bs, tc.Coordinate.Version, tc.Path)
+				return head, banner, err
+			},
+			NeedsBody: true,
+		},
+		h: h,
+	}
+}
+
+func (vbi *versionBannerInjector) Key(tc *TransformContext) (string, error) {
+	if !wantsBanner(tc.Path) {
+		return "", nil
+	}
+	tc.banner = vbi.h.bannerState()
+	if tc.banner == nil {
+		return "", nil
+	}
+	return tc.banner.key, nil
+}
@@ -0,0 +1,203 @@
+package javadocr
+
+import (
+	"bytes"
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJavadocHandlerVersionBanner(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0-SNAPSHOT")
+	for _, v := range tr.versions {
+		files := map[string]string{
+			"org/Foo.html":        "<html><head><title>Foo</title></head><body>foo</body></html>",
+			"overview-frame.html": "<html><head></head><body>frame</body></html>",
+			"index.html":          "<html><head></head><frameset></frameset></html>",
+			"stylesheet.css":      "body { color: red; }",
+		}
+		if v == "1.0" {
+			files["org/Old.html"] = "<html><head></head><body>old</body></html>"
+		}
+		tr.jars[v] = makeJar(t, files)
+	}
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, VersionBanner: DefaultVersionBanner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// canonical links only point at the latest version once it's cached
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/2.0/", nil))
+
+	testPlan := map[string][]string{
+		"/1.0/org/Foo.html": {
+			`<head><title>Foo</title><link rel="canonical" href="/2.0/org/Foo.html"></head>`,
+			`You are viewing 1.0; the latest is <a href="/2.0/org/Foo.html">2.0</a>.`,
+			`<option value="/3.0-SNAPSHOT/org/Foo.html">3.0-SNAPSHOT</option><option value="/2.0/org/Foo.html">2.0</option><option value="/1.0/org/Foo.html" selected>1.0</option>`,
+			`</select></div>foo</body>`,
+		},
+		"/1.0/org/Old.html": {
+			`<html><head></head><body><div`,
+			`You are viewing 1.0; the latest is <a href="/2.0/">2.0</a>.`,
+		},
+		"/2.0/org/Foo.html": {
+			`<link rel="canonical" href="/2.0/org/Foo.html">`,
+			"You are viewing 2.0, the latest version.",
+		},
+		"/3.0-SNAPSHOT/org/Foo.html": {
+			`You are viewing 3.0-SNAPSHOT, a development build; the latest release is <a href="/2.0/org/Foo.html">2.0</a>.`,
+		},
+		"/1.0/org/": {
+			`You are viewing 1.0; the latest is <a href="/2.0/org/">2.0</a>.`,
+		},
+	}
+	for pth, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, http.StatusOK)
+			continue
+		}
+		for _, s := range expected {
+			if !strings.Contains(rec.Body.String(), s) {
+				t.Errorf("Got: %s for %s, expected it to contain %s", rec.Body.String(), pth, s)
+			}
+		}
+		if !strings.Contains(rec.Header().Get("ETag"), "-t") {
+			t.Errorf("Got ETag: %s for %s, expected it to cover the banner", rec.Header().Get("ETag"), pth)
+		}
+	}
+	// frames and other files are left alone, and framesets just get the
+	// canonical link
+	untouched := map[string]string{
+		"/1.0/overview-frame.html": "<html><head></head><body>frame</body></html>",
+		"/1.0/":                    `<html><head><link rel="canonical" href="/2.0/"></head><frameset></frameset></html>`,
+		"/1.0/stylesheet.css":      "body { color: red; }",
+	}
+	for pth, expected := range untouched {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Got: %s for %s, expected: %s", got, pth, expected)
+		}
+	}
+}
+
+func TestJavadocHandlerRendersBannerOncePerGeneration(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	var renders int32
+	banner := template.Must(template.New("banner").Funcs(template.FuncMap{
+		"count": func() string {
+			atomic.AddInt32(&renders, 1)
+			return ""
+		},
+	}).Parse("{{count}}{{range .Versions}}{{.Version}} {{end}}"))
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, VersionBanner: banner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	c, _ := h.coordinateForVersion("1.0")
+	tc := &TransformContext{Coordinate: c, Path: "/org/Foo.html", ContentType: "text/html"}
+	render := func() string {
+		ts, _ := h.transformersFor(tc)
+		var buf bytes.Buffer
+		if err := transform(&buf, strings.NewReader("<html><body>foo</body></html>"), ts, tc); err != nil {
+			t.Fatal(err)
+		}
+		return buf.String()
+	}
+
+	// finding out whether a page needs transforming doesn't render it
+	_, key := h.transformersFor(tc)
+	for n := 0; n < 3; n++ {
+		h.transformersFor(tc)
+	}
+	if n := atomic.LoadInt32(&renders); n != 0 {
+		t.Errorf("Got: %d renders, expected none", n)
+	}
+
+	// and it's only rendered the once until the versions change
+	for n := 0; n < 3; n++ {
+		if got, expected := render(), "<html><body>2.0 1.0 foo</body></html>"; got != expected {
+			t.Errorf("Got: %s, expected: %s", got, expected)
+		}
+	}
+	if n := atomic.LoadInt32(&renders); n != 1 {
+		t.Errorf("Got: %d renders, expected: 1", n)
+	}
+
+	h.ExcludeVersion("2.0")
+	if _, nkey := h.transformersFor(tc); nkey == key {
+		t.Errorf("Got the same key %q once 2.0 was excluded", key)
+	}
+	if got, expected := render(), "<html><body>1.0 foo</body></html>"; got != expected {
+		t.Errorf("Got: %s, expected: %s", got, expected)
+	}
+	if n := atomic.LoadInt32(&renders); n != 2 {
+		t.Errorf("Got: %d renders, expected: 2", n)
+	}
+
+	// putting things back the way they were gets the same key back
+	h.IncludeVersion("2.0")
+	if _, nkey := h.transformersFor(tc); nkey != key {
+		t.Errorf("Got: %q, expected: %q", nkey, key)
+	}
+}
+
+func TestJavadocHandlerBannerDoesntFetchLatest(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	for _, v := range tr.versions {
+		tr.jars[v] = makeJar(t, map[string]string{"org/Foo.html": "<html><head></head><body>foo</body></html>"})
+	}
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, VersionBanner: DefaultVersionBanner, FallbackFetches: 3, FallbackFetchInterval: time.Nanosecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.background.Wait()
+	h.Invalidate("2.0")
+	atomic.StoreInt32(&tr.jarFetch, 0)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/org/Foo.html", nil))
+	if n := atomic.LoadInt32(&tr.jarFetch); n != 1 {
+		t.Errorf("Got: %d jar fetches, expected only 1.0 to be fetched", n)
+	}
+	if got := rec.Body.String(); strings.Contains(got, "canonical") || !strings.Contains(got, `the latest is <a href="/2.0/">2.0</a>.`) {
+		t.Errorf("Got: %s, expected no canonical link and a link to the top of 2.0", got)
+	}
+}
+
+func TestJavadocHandlerBannerMatchesKey(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, VersionBanner: DefaultVersionBanner})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	c, _ := h.coordinateForVersion("1.0")
+	tc := &TransformContext{Coordinate: c, Path: "/org/Foo.html", ContentType: "text/html"}
+	ts, key := h.transformersFor(tc)
+
+	// the versions change between the page being keyed and transformed
+	h.ExcludeVersion("2.0")
+	if _, nkey := h.transformersFor(&TransformContext{Coordinate: c, Path: tc.Path, ContentType: tc.ContentType}); nkey == key {
+		t.Fatalf("Got the same key %q once 2.0 was excluded", key)
+	}
+
+	var buf bytes.Buffer
+	if err := transform(&buf, strings.NewReader("<html><body>foo</body></html>"), ts, tc); err != nil {
+		t.Fatal(err)
+	}
+	if got := buf.String(); !strings.Contains(got, `the latest is <a href="/2.0/">2.0</a>.`) || !strings.Contains(got, `<option value="/2.0/org/Foo.html">2.0</option>`) {
+		t.Errorf("Got: %s, expected the banner from before 2.0 was excluded", got)
+	}
+}
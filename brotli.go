@@ -0,0 +1,609 @@
+package javadocr
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"sort"
+)
+
+// This is a deliberately simple brotli (RFC 7932) compressor, which sticks to
+// the standard library. It finds matches greedily with hash chains, and
+// writes one set of prefix codes per meta-block, without block switching,
+// context modelling or the static dictionary. That gets most of the way to
+// what the reference encoder does for javadoc's HTML, and since a variant is
+// only built once, that's as far as it needs to go.
+
+const (
+	// brotliWindowBits is the WBITS the stream says it needs, so matches
+	// go back at most 4MiB.
+	brotliWindowBits  = 22
+	brotliMaxDistance = 1<<brotliWindowBits - 16
+	// brotliBlockSize is how much goes in each meta-block, each of which
+	// gets its own prefix codes.
+	brotliBlockSize = 1 << 20
+	brotliMinMatch  = 4
+	brotliHashBits  = 16
+	// brotliMaxChain is how many earlier occurrences of a hash are tried.
+	brotliMaxChain    = 128
+	brotliMaxCodeBits = 15
+
+	brotliLiteralAlphabet  = 256
+	brotliCommandAlphabet  = 704
+	brotliDistanceAlphabet = 64
+)
+
+var (
+	brotliInsertBase  = [...]uint32{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090, 2114, 6210, 22594}
+	brotliInsertExtra = [...]uint8{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+	brotliCopyBase    = [...]uint32{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582, 1094, 2118}
+	brotliCopyExtra   = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+	// the order in which code length code lengths are given
+	brotliCodeLengthOrder = [...]uint8{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+	// the fixed code the code length code lengths are given in, already
+	// reversed to be written least significant bit first
+	brotliCodeLengthCodes = [...]uint8{0, 7, 3, 2, 1, 15}
+	brotliCodeLengthBits  = [...]uint8{2, 4, 3, 2, 2, 4}
+)
+
+var errBrotliClosed = errors.New("javadocr: write to closed brotli writer")
+
+// BrotliEncoder builds brotli variants, which tend to be a little smaller
+// than gzip ones.
+var BrotliEncoder = Encoder{
+	Name: "br",
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return &brotliWriter{w: w}, nil
+	},
+}
+
+// brotliWriter holds on to everything written to it, and compresses it all
+// when it's closed. Variants are built in memory anyway.
+type brotliWriter struct {
+	w      io.Writer
+	buf    []byte
+	closed bool
+}
+
+func (bw *brotliWriter) Write(b []byte) (int, error) {
+	if bw.closed {
+		return 0, errBrotliClosed
+	}
+	bw.buf = append(bw.buf, b...)
+	return len(b), nil
+}
+
+func (bw *brotliWriter) Close() error {
+	if bw.closed {
+		return nil
+	}
+	bw.closed = true
+
+	var out bitWriter
+	// WBITS: a 1, then WBITS-17 in three bits
+	out.writeBits(4, 1|(brotliWindowBits-17)<<1)
+	m := newBrotliMatcher(bw.buf)
+	for start := 0; start < len(bw.buf); start += brotliBlockSize {
+		end := min(start+brotliBlockSize, len(bw.buf))
+		writeBrotliMetaBlock(&out, bw.buf, start, end, m.commands(start, end))
+	}
+	// ISLAST and ISLASTEMPTY
+	out.writeBits(2, 3)
+	_, err := bw.w.Write(out.bytes())
+	return err
+}
+
+// bitWriter packs bits into bytes, least significant first.
+type bitWriter struct {
+	out  []byte
+	acc  uint64
+	nacc uint
+}
+
+// writeBits writes the bottom n bits of v, where n is at most 32.
+func (bw *bitWriter) writeBits(n uint, v uint64) {
+	bw.acc |= v << bw.nacc
+	bw.nacc += n
+	for bw.nacc >= 8 {
+		bw.out = append(bw.out, byte(bw.acc))
+		bw.acc >>= 8
+		bw.nacc -= 8
+	}
+}
+
+// bytes returns everything written, padded with zeros to a whole byte.
+func (bw *bitWriter) bytes() []byte {
+	if bw.nacc > 0 {
+		bw.writeBits(8-bw.nacc, 0)
+	}
+	return bw.out
+}
+
+// brotliCommand is a run of literals, then a copy of earlier output, which
+// is left off the end of a meta-block.
+type brotliCommand struct {
+	literals       int // where the literals start
+	insert         int
+	copy, distance int
+	// recent is which of the last four distances distance is, or -1
+	recent int
+}
+
+// brotliMatcher finds earlier occurrences of the data at a position, through
+// chains of positions with the same hash.
+type brotliMatcher struct {
+	data []byte
+	head []int32 // the latest position+1 with each hash
+	prev []int32 // the position+1 before each position with the same hash
+	mask int
+	// recent are the last four distances, most recent first, as the
+	// decoder will have them
+	recent [4]int
+}
+
+func newBrotliMatcher(data []byte) *brotliMatcher {
+	size := 1
+	for size < len(data) && size < 1<<brotliWindowBits {
+		size <<= 1
+	}
+	return &brotliMatcher{
+		data:   data,
+		head:   make([]int32, 1<<brotliHashBits),
+		prev:   make([]int32, size),
+		mask:   size - 1,
+		recent: [4]int{4, 11, 15, 16},
+	}
+}
+
+func (m *brotliMatcher) hash(i int) uint32 {
+	return binary.LittleEndian.Uint32(m.data[i:]) * 0x1e35a7bd >> (32 - brotliHashBits)
+}
+
+// insert adds position i to its chain.
+func (m *brotliMatcher) insert(i int) {
+	if i+brotliMinMatch > len(m.data) {
+		return
+	}
+	h := m.hash(i)
+	m.prev[i&m.mask] = m.head[h]
+	m.head[h] = int32(i + 1)
+}
+
+// longestMatch finds the longest earlier occurrence of the data at i, which
+// doesn't go past end, returning its length and how far back it is.
+func (m *brotliMatcher) longestMatch(i, end int) (int, int) {
+	if i+brotliMinMatch > end {
+		return 0, 0
+	}
+	// the last distance is cheap to use again, so anything else has to
+	// do better than it by more than a byte
+	lastLen := m.matchLength(i-m.recent[0], i, end)
+	bestLen, bestDist := lastLen+1, 0
+	cand := int(m.head[m.hash(i)]) - 1
+	for chain := 0; cand >= 0 && chain < brotliMaxChain; chain++ {
+		dist := i - cand
+		if dist > m.mask || dist > brotliMaxDistance {
+			break
+		}
+		if n := m.matchLength(cand, i, end); n > bestLen {
+			bestLen, bestDist = n, dist
+			if i+n == end {
+				break
+			}
+		}
+		next := int(m.prev[cand&m.mask]) - 1
+		if next >= cand {
+			// the chain has wrapped around the window
+			break
+		}
+		cand = next
+	}
+	if bestDist == 0 {
+		bestLen, bestDist = lastLen, m.recent[0]
+	}
+	if bestLen < brotliMinMatch {
+		return 0, 0
+	}
+	return bestLen, bestDist
+}
+
+// matchLength is how many bytes from cand on are the same as those from i
+// on, going no further than end.
+func (m *brotliMatcher) matchLength(cand, i, end int) int {
+	if cand < 0 {
+		return 0
+	}
+	n := 0
+	for i+n < end && m.data[cand+n] == m.data[i+n] {
+		n++
+	}
+	return n
+}
+
+// use records that a copy from dist back is going to be made, returning
+// which of the recent distances it is, or -1 if it isn't one.
+func (m *brotliMatcher) use(dist int) int {
+	for n, recent := range m.recent {
+		if recent == dist {
+			if n != 0 {
+				m.recent = [4]int{dist, m.recent[0], m.recent[1], m.recent[2]}
+			}
+			return n
+		}
+	}
+	m.recent = [4]int{dist, m.recent[0], m.recent[1], m.recent[2]}
+	return -1
+}
+
+// commands splits the data from start to end into commands. Everything
+// before start must already have been through commands.
+func (m *brotliMatcher) commands(start, end int) []brotliCommand {
+	var cmds []brotliCommand
+	lit := start
+	for i := start; i < end; {
+		n, dist := m.longestMatch(i, end)
+		m.insert(i)
+		if n == 0 {
+			i++
+			continue
+		}
+		if next, _ := m.longestMatch(i+1, end); next > n {
+			// it's worth a literal to get the longer match
+			i++
+			continue
+		}
+		cmds = append(cmds, brotliCommand{literals: lit, insert: i - lit, copy: n, distance: dist, recent: m.use(dist)})
+		for j := i + 1; j < i+n; j++ {
+			m.insert(j)
+		}
+		i += n
+		lit = i
+	}
+	if lit < end {
+		cmds = append(cmds, brotliCommand{literals: lit, insert: end - lit})
+	}
+	return cmds
+}
+
+// brotliLengthCode finds the code for n in a table of bases.
+func brotliLengthCode(base []uint32, n int) int {
+	code := len(base) - 1
+	for uint32(n) < base[code] {
+		code--
+	}
+	return code
+}
+
+// brotliCommandCode combines an insert length code and a copy length code,
+// always with an explicit distance.
+func brotliCommandCode(insCode, copyCode int) int {
+	var base int
+	switch {
+	case insCode < 8 && copyCode < 8:
+		base = 128
+	case insCode < 8 && copyCode < 16:
+		base = 192
+	case insCode < 8:
+		base = 384
+	case insCode < 16 && copyCode < 8:
+		base = 256
+	case insCode < 16 && copyCode < 16:
+		base = 320
+	case insCode < 16:
+		base = 512
+	case copyCode < 8:
+		base = 448
+	case copyCode < 16:
+		base = 576
+	default:
+		base = 640
+	}
+	return base + (insCode&7)<<3 + copyCode&7
+}
+
+// brotliDistanceCode returns the distance code for dist, with no direct codes
+// and no postfix bits, and its extra bits.
+func brotliDistanceCode(dist int) (code int, nbits uint, extra uint64) {
+	x := dist + 3
+	nbits = 0
+	for x>>(nbits+2) != 0 {
+		nbits++
+	}
+	odd := x >> nbits & 1
+	extra = uint64(x - (2+odd)<<nbits)
+	return 16 + 2*(int(nbits)-1) + odd, nbits, extra
+}
+
+// brotliPrefixCode is a prefix code as written out: each symbol's code,
+// already reversed, and its length.
+type brotliPrefixCode struct {
+	codes   []uint16
+	lengths []uint8
+}
+
+func (pc *brotliPrefixCode) write(bw *bitWriter, sym int) {
+	bw.writeBits(uint(pc.lengths[sym]), uint64(pc.codes[sym]))
+}
+
+// writeBrotliMetaBlock writes the data from start to end as a compressed
+// meta-block, which isn't the last one, made up of cmds.
+func writeBrotliMetaBlock(bw *bitWriter, data []byte, start, end int, cmds []brotliCommand) {
+	// ISLAST is unset; MLEN-1 takes as few nibbles as it can, but at
+	// least four
+	bw.writeBits(1, 0)
+	mlen := uint64(end - start - 1)
+	nibbles := uint(4)
+	for mlen>>(4*nibbles) != 0 {
+		nibbles++
+	}
+	bw.writeBits(2, uint64(nibbles-4))
+	bw.writeBits(4*nibbles, mlen)
+	// ISUNCOMPRESSED
+	bw.writeBits(1, 0)
+	// a single block type for literals, commands and distances
+	bw.writeBits(3, 0)
+	// NPOSTFIX and NDIRECT
+	bw.writeBits(6, 0)
+	// the literal context mode, which doesn't matter with only one tree
+	bw.writeBits(2, 0)
+	// a single literal tree, and a single distance tree
+	bw.writeBits(2, 0)
+
+	type symbols struct {
+		cmd, insCode, copyCode int
+		dist                   int // -1 if there isn't a distance to write
+		distBits               uint
+		distExtra              uint64
+	}
+	syms := make([]symbols, len(cmds))
+	literals := make([]uint32, brotliLiteralAlphabet)
+	commands := make([]uint32, brotliCommandAlphabet)
+	distances := make([]uint32, brotliDistanceAlphabet)
+	for n, cmd := range cmds {
+		for _, b := range data[cmd.literals : cmd.literals+cmd.insert] {
+			literals[b]++
+		}
+		// the last command might have no copy, in which case the
+		// meta-block ends before the copy length is needed
+		sym := symbols{
+			insCode:  brotliLengthCode(brotliInsertBase[:], cmd.insert),
+			copyCode: brotliLengthCode(brotliCopyBase[:], max(cmd.copy, 2)),
+			dist:     -1,
+		}
+		switch {
+		case cmd.copy == 0:
+			sym.cmd = brotliCommandCode(sym.insCode, sym.copyCode)
+		case cmd.recent == 0 && sym.insCode < 8 && sym.copyCode < 16:
+			// the last distance again can go without saying
+			sym.cmd = brotliCommandCode(sym.insCode, sym.copyCode) - 128
+		case cmd.recent != -1:
+			sym.cmd = brotliCommandCode(sym.insCode, sym.copyCode)
+			sym.dist = cmd.recent
+		default:
+			sym.cmd = brotliCommandCode(sym.insCode, sym.copyCode)
+			sym.dist, sym.distBits, sym.distExtra = brotliDistanceCode(cmd.distance)
+		}
+		commands[sym.cmd]++
+		if sym.dist != -1 {
+			distances[sym.dist]++
+		}
+		syms[n] = sym
+	}
+	litCode := writeBrotliPrefixCode(bw, literals, 8)
+	cmdCode := writeBrotliPrefixCode(bw, commands, 10)
+	distCode := writeBrotliPrefixCode(bw, distances, 6)
+
+	for n, cmd := range cmds {
+		sym := syms[n]
+		cmdCode.write(bw, sym.cmd)
+		bw.writeBits(uint(brotliInsertExtra[sym.insCode]), uint64(uint32(cmd.insert)-brotliInsertBase[sym.insCode]))
+		bw.writeBits(uint(brotliCopyExtra[sym.copyCode]), uint64(uint32(max(cmd.copy, 2))-brotliCopyBase[sym.copyCode]))
+		for _, b := range data[cmd.literals : cmd.literals+cmd.insert] {
+			litCode.write(bw, int(b))
+		}
+		if sym.dist != -1 {
+			distCode.write(bw, sym.dist)
+			bw.writeBits(sym.distBits, sym.distExtra)
+		}
+	}
+}
+
+// writeBrotliPrefixCode works out a prefix code for symbols which turn up
+// counts times, and writes it out. alphabetBits is how many bits it takes
+// to write any symbol of the alphabet.
+func writeBrotliPrefixCode(bw *bitWriter, counts []uint32, alphabetBits uint) *brotliPrefixCode {
+	pc := &brotliPrefixCode{
+		codes:   make([]uint16, len(counts)),
+		lengths: make([]uint8, len(counts)),
+	}
+	used, last := 0, 0
+	for sym, c := range counts {
+		if c != 0 {
+			used++
+			last = sym
+		}
+	}
+	if used < 2 {
+		// a simple prefix code with one symbol, which takes no bits at
+		// all to write
+		bw.writeBits(2, 1)
+		bw.writeBits(2, 0)
+		bw.writeBits(alphabetBits, uint64(last))
+		return pc
+	}
+
+	pc.lengths = brotliCodeLengths(counts, brotliMaxCodeBits)
+	pc.codes = brotliCanonicalCodes(pc.lengths)
+
+	// the code lengths are themselves written with a prefix code, with
+	// 17 standing for a run of zeros
+	type token struct {
+		sym   uint8
+		extra uint64
+	}
+	var tokens []token
+	clCounts := make([]uint32, len(brotliCodeLengthOrder))
+	for sym := 0; sym <= last; {
+		if pc.lengths[sym] != 0 {
+			tokens = append(tokens, token{sym: pc.lengths[sym]})
+			sym++
+			continue
+		}
+		run := 0
+		for pc.lengths[sym+run] == 0 {
+			run++
+		}
+		sym += run
+		for run > 0 {
+			if run < 3 {
+				tokens = append(tokens, token{sym: 0})
+				run--
+				continue
+			}
+			// repeats straight after one another would multiply,
+			// so they're kept apart with a single zero
+			n := min(run, 10)
+			tokens = append(tokens, token{sym: 17, extra: uint64(n - 3)})
+			run -= n
+			if run > 0 {
+				tokens = append(tokens, token{sym: 0})
+				run--
+			}
+		}
+	}
+	for _, t := range tokens {
+		clCounts[t.sym]++
+	}
+
+	clUsed := 0
+	for _, c := range clCounts {
+		if c != 0 {
+			clUsed++
+		}
+	}
+	var clLengths []uint8
+	var clCodes []uint16
+	stored := len(brotliCodeLengthOrder)
+	if clUsed == 1 {
+		// a code with a single code length takes no bits to write, but
+		// then every code length code length has to be given
+		clLengths = make([]uint8, len(clCounts))
+		clCodes = make([]uint16, len(clCounts))
+		for sym, c := range clCounts {
+			if c != 0 {
+				clLengths[sym] = 1
+			}
+		}
+	} else {
+		clLengths = brotliCodeLengths(clCounts, 5)
+		clCodes = brotliCanonicalCodes(clLengths)
+		for clLengths[brotliCodeLengthOrder[stored-1]] == 0 {
+			stored--
+		}
+	}
+
+	// HSKIP
+	bw.writeBits(2, 0)
+	for _, sym := range brotliCodeLengthOrder[:stored] {
+		l := clLengths[sym]
+		bw.writeBits(uint(brotliCodeLengthBits[l]), uint64(brotliCodeLengthCodes[l]))
+	}
+	for _, t := range tokens {
+		if clUsed > 1 {
+			bw.writeBits(uint(clLengths[t.sym]), uint64(clCodes[t.sym]))
+		}
+		if t.sym == 17 {
+			bw.writeBits(3, t.extra)
+		}
+	}
+	return pc
+}
+
+// brotliCodeLengths returns the code lengths of a Huffman code, none longer
+// than maxBits, for symbols which turn up counts times. Symbols which don't
+// turn up get no code; at least two have to.
+func brotliCodeLengths(counts []uint32, maxBits uint8) []uint8 {
+	type node struct {
+		count       uint32
+		left, right int // for leaves, -1 and the symbol
+	}
+	lengths := make([]uint8, len(counts))
+	// if the code comes out too long, the rarest symbols are made to look
+	// more common until it doesn't
+	for floor := uint32(1); ; floor *= 2 {
+		var nodes []node
+		for sym, c := range counts {
+			if c != 0 {
+				nodes = append(nodes, node{count: max(c, floor), left: -1, right: sym})
+			}
+		}
+		sort.SliceStable(nodes, func(i, j int) bool {
+			return nodes[i].count < nodes[j].count
+		})
+
+		// leaves and the nodes made from them are both in order, so
+		// the two smallest are at the front of one or the other
+		leaves := len(nodes)
+		nextLeaf, nextNode := 0, leaves
+		smallest := func() int {
+			if nextLeaf < leaves && (nextNode == len(nodes) || nodes[nextLeaf].count <= nodes[nextNode].count) {
+				nextLeaf++
+				return nextLeaf - 1
+			}
+			nextNode++
+			return nextNode - 1
+		}
+		for len(nodes) < 2*leaves-1 {
+			a, b := smallest(), smallest()
+			nodes = append(nodes, node{count: nodes[a].count + nodes[b].count, left: a, right: b})
+		}
+
+		depths := make([]uint8, len(nodes))
+		fits := true
+		for n := len(nodes) - 1; n >= 0; n-- {
+			if nodes[n].left == -1 {
+				lengths[nodes[n].right] = depths[n]
+				fits = fits && depths[n] <= maxBits
+				continue
+			}
+			depths[nodes[n].left] = depths[n] + 1
+			depths[nodes[n].right] = depths[n] + 1
+		}
+		if fits {
+			return lengths
+		}
+	}
+}
+
+// brotliCanonicalCodes assigns codes to symbols with the given lengths, in
+// the same way as DEFLATE, reversed so that they can be written least
+// significant bit first.
+func brotliCanonicalCodes(lengths []uint8) []uint16 {
+	var count [brotliMaxCodeBits + 1]uint16
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [brotliMaxCodeBits + 1]uint16
+	code := uint16(0)
+	for l := 1; l <= brotliMaxCodeBits; l++ {
+		code = (code + count[l-1]) << 1
+		next[l] = code
+	}
+
+	codes := make([]uint16, len(lengths))
+	for sym, l := range lengths {
+		if l == 0 {
+			continue
+		}
+		c := next[l]
+		next[l]++
+		var rev uint16
+		for n := uint8(0); n < l; n++ {
+			rev = rev<<1 | c&1
+			c >>= 1
+		}
+		codes[sym] = rev
+	}
+	return codes
+}
@@ -0,0 +1,329 @@
+package javadocr
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+var errBrotliUnsupported = errors.New("brotli stream uses something decodeBrotli doesn't support")
+
+// brotliReader reads bits least significant first, remembering if it ever
+// runs out.
+type brotliReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (br *brotliReader) bits(n uint) int {
+	v := 0
+	for i := uint(0); i < n; i++ {
+		if br.pos>>3 >= len(br.b) {
+			br.err = io.ErrUnexpectedEOF
+			return 0
+		}
+		v |= int(br.b[br.pos>>3]>>(br.pos&7)&1) << i
+		br.pos++
+	}
+	return v
+}
+
+// brotliTestCode is a canonical prefix code, looked up by length and code.
+type brotliTestCode struct {
+	single  int // the only symbol, if there's just the one
+	symbols map[[2]int]int
+}
+
+func newBrotliTestCode(lengths []int) *brotliTestCode {
+	pc := &brotliTestCode{single: -1, symbols: make(map[[2]int]int)}
+	code := 0
+	for l := 1; l <= brotliMaxCodeBits; l++ {
+		for sym, sl := range lengths {
+			if sl == l {
+				pc.symbols[[2]int{l, code}] = sym
+				code++
+			}
+		}
+		code <<= 1
+	}
+	return pc
+}
+
+func (pc *brotliTestCode) decode(br *brotliReader) int {
+	if pc.single != -1 {
+		return pc.single
+	}
+	code := 0
+	for l := 1; l <= brotliMaxCodeBits && br.err == nil; l++ {
+		code = code<<1 | br.bits(1)
+		if sym, ok := pc.symbols[[2]int{l, code}]; ok {
+			return sym
+		}
+	}
+	br.err = errors.New("bad prefix code")
+	return 0
+}
+
+func readBrotliTestCode(br *brotliReader, alphabet int, alphabetBits uint) *brotliTestCode {
+	hskip := br.bits(2)
+	if hskip == 1 {
+		nsym := br.bits(2) + 1
+		syms := make([]int, nsym)
+		for n := range syms {
+			syms[n] = br.bits(alphabetBits)
+		}
+		if nsym == 1 {
+			return &brotliTestCode{single: syms[0]}
+		}
+		lengths := make([]int, alphabet)
+		for n, l := range map[int][]int{2: {1, 1}, 3: {1, 2, 2}, 4: {2, 2, 2, 2}}[nsym] {
+			lengths[syms[n]] = l
+		}
+		if nsym == 4 && br.bits(1) == 1 {
+			for n, l := range []int{1, 2, 3, 3} {
+				lengths[syms[n]] = l
+			}
+		}
+		return newBrotliTestCode(lengths)
+	}
+
+	clLengths := make([]int, len(brotliCodeLengthOrder))
+	space, codes := 32, 0
+	for _, sym := range brotliCodeLengthOrder[hskip:] {
+		l := -1
+		for v, n := 0, uint(0); l == -1 && n < 4; n++ {
+			v |= br.bits(1) << n
+			for cl := range brotliCodeLengthCodes {
+				if uint(brotliCodeLengthBits[cl]) == n+1 && int(brotliCodeLengthCodes[cl]) == v {
+					l = cl
+				}
+			}
+		}
+		clLengths[sym] = l
+		if l > 0 {
+			space -= 32 >> l
+			codes++
+			if space <= 0 {
+				break
+			}
+		}
+	}
+	clCode := newBrotliTestCode(clLengths)
+	if codes == 1 {
+		for sym, l := range clLengths {
+			if l != 0 {
+				clCode.single = sym
+			}
+		}
+	} else if space != 0 {
+		br.err = errors.New("bad code length code")
+	}
+
+	lengths := make([]int, alphabet)
+	space = 1 << 15
+	prev, repeat, repeatLen := 8, 0, 0
+	for sym := 0; sym < alphabet && space > 0 && br.err == nil; {
+		cl := clCode.decode(br)
+		if cl < 16 {
+			repeat = 0
+			lengths[sym] = cl
+			if cl != 0 {
+				prev = cl
+				space -= 1 << 15 >> cl
+			}
+			sym++
+			continue
+		}
+		extraBits, newLen := uint(2), prev
+		if cl == 17 {
+			extraBits, newLen = 3, 0
+		}
+		if newLen != repeatLen {
+			repeat, repeatLen = 0, newLen
+		}
+		old := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		repeat += br.bits(extraBits) + 3
+		for n := old; n < repeat && sym < alphabet; n++ {
+			lengths[sym] = newLen
+			if newLen != 0 {
+				space -= 1 << 15 >> newLen
+			}
+			sym++
+		}
+	}
+	if space != 0 {
+		br.err = errors.New("bad code lengths")
+	}
+	return newBrotliTestCode(lengths)
+}
+
+// decodeBrotli decodes just as much brotli as BrotliEncoder writes: no
+// block switching, context modelling, postfix bits, direct distance codes
+// or dictionary references.
+func decodeBrotli(b []byte) ([]byte, error) {
+	br := &brotliReader{b: b}
+	if br.bits(1) == 1 && br.bits(3) == 0 {
+		return nil, errBrotliUnsupported
+	}
+	recent := []int{4, 11, 15, 16}
+	var out []byte
+	for br.err == nil {
+		last := br.bits(1) == 1
+		if last && br.bits(1) == 1 {
+			break
+		}
+		nibbles := br.bits(2) + 4
+		if nibbles == 7 {
+			return nil, errBrotliUnsupported
+		}
+		mlen := br.bits(uint(4*nibbles)) + 1
+		if !last && br.bits(1) == 1 {
+			return nil, errBrotliUnsupported
+		}
+		// block types, postfix and direct codes, context mode, trees
+		if br.bits(3) != 0 || br.bits(6) != 0 {
+			return nil, errBrotliUnsupported
+		}
+		br.bits(2)
+		if br.bits(2) != 0 {
+			return nil, errBrotliUnsupported
+		}
+		litCode := readBrotliTestCode(br, brotliLiteralAlphabet, 8)
+		cmdCode := readBrotliTestCode(br, brotliCommandAlphabet, 10)
+		distCode := readBrotliTestCode(br, brotliDistanceAlphabet, 6)
+
+		for end := len(out) + mlen; len(out) < end && br.err == nil; {
+			cmd := cmdCode.decode(br)
+			cell := cmd >> 6
+			insCode := []int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}[cell] + cmd>>3&7
+			copyCode := []int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}[cell] + cmd&7
+			insert := int(brotliInsertBase[insCode]) + br.bits(uint(brotliInsertExtra[insCode]))
+			length := int(brotliCopyBase[copyCode]) + br.bits(uint(brotliCopyExtra[copyCode]))
+			for n := 0; n < insert; n++ {
+				out = append(out, byte(litCode.decode(br)))
+			}
+			if len(out) >= end {
+				break
+			}
+
+			dc, dist := 0, 0
+			if cell >= 2 {
+				dc = distCode.decode(br)
+			}
+			switch {
+			case dc < 4:
+				dist = recent[dc]
+			case dc < 16:
+				return nil, errBrotliUnsupported
+			default:
+				nbits := uint(1 + (dc-16)>>1)
+				dist = (2+(dc-16)&1)<<nbits - 4 + br.bits(nbits) + 1
+			}
+			if dc != 0 {
+				recent = []int{dist, recent[0], recent[1], recent[2]}
+			}
+			if dist > len(out) {
+				return nil, errBrotliUnsupported
+			}
+			for n := 0; n < length; n++ {
+				out = append(out, out[len(out)-dist])
+			}
+		}
+		if last {
+			break
+		}
+	}
+	return out, br.err
+}
+
+func brotliCompress(t *testing.T, in []byte) []byte {
+	var buf bytes.Buffer
+	w, err := BrotliEncoder.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write(in)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// brotliTestInputs are what the encoder is tested with.
+func brotliTestInputs() map[string][]byte {
+	page := "<html><body>" + strings.Repeat("<p>javadoc</p>\n", 1000) + "</body></html>"
+	random := make([]byte, 10000)
+	r := rand.New(rand.NewSource(1))
+	for n := range random {
+		random[n] = byte(r.Intn(16))
+	}
+	// more than one meta-block, with matches which go back into the one
+	// before
+	big := bytes.Repeat(append([]byte(page), random[:100]...), brotliBlockSize/len(page)*3/2)
+	return map[string][]byte{
+		"empty":  nil,
+		"a byte": []byte("a"),
+		"page":   []byte(page),
+		"random": random,
+		"big":    big,
+	}
+}
+
+func TestBrotliEncoder(t *testing.T) {
+	page := brotliTestInputs()["page"]
+	for name, in := range brotliTestInputs() {
+		compressed := brotliCompress(t, in)
+		out, err := decodeBrotli(compressed)
+		if err != nil {
+			t.Errorf("%s: Got: %v, expected it to decode", name, err)
+			continue
+		}
+		if !bytes.Equal(out, in) {
+			t.Errorf("%s: Got %d bytes back, which didn't match the %d put in", name, len(out), len(in))
+		}
+	}
+	if n := len(brotliCompress(t, page)); n > len(page)/20 {
+		t.Errorf("Got: %d bytes for a %d byte page, expected it to be compressed", n, len(page))
+	}
+}
+
+func TestBrotliEncoderOutput(t *testing.T) {
+	// these were checked against the reference decoder
+	testPlan := map[string][]byte{
+		"":                        {0x3b},
+		"javadoc javadoc javadoc": {0x0b, 0x0b, 0x00, 0x00, 0x00, 0x94, 0x71, 0x9e, 0xe7, 0xf7, 0x3c, 0xcf, 0xf3, 0x78, 0xfd, 0x74, 0xb9, 0x3d, 0xf4, 0x09, 0x49, 0xe5, 0x64, 0xd6, 0x03},
+	}
+	for in, expected := range testPlan {
+		if got := brotliCompress(t, []byte(in)); !bytes.Equal(got, expected) {
+			t.Errorf("Got: %x, expected: %x", got, expected)
+		}
+	}
+}
+
+func TestBrotliEncoderOutputChecksums(t *testing.T) {
+	// decodeBrotli only tells us the encoder agrees with itself, so these
+	// pin down output which was checked against an independent decoder
+	// (github.com/andybalholm/brotli), which we'd rather not depend on just
+	// for tests
+	testPlan := map[string]string{
+		"page":   "7bdc814cf0067f7b054581d8ef9a0aceff35cc30fa4aee3a93bc6120b70892d7",
+		"random": "d78ba694fa39719ba1962cbb4cdf0b782b3d515f5ba2df71a5781a4c53380d3f",
+		"big":    "84d5661f19edeab0a179c1d5fb0a04a080ba26069352057ae76a300320a6dba8",
+	}
+	inputs := brotliTestInputs()
+	for name, expected := range testPlan {
+		sum := sha256.Sum256(brotliCompress(t, inputs[name]))
+		if got := hex.EncodeToString(sum[:]); got != expected {
+			t.Errorf("%s: Got: %s, expected: %s", name, got, expected)
+		}
+	}
+}
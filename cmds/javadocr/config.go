@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lukegb/javadocr"
+	"github.com/lukegb/javadocr/maven"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+)
+
+// duration is a time.Duration which is written as "1m30s" in the config file.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	pd, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(pd)
+	return nil
+}
+
+type projectConfig struct {
+	// Name identifies the project in logs and health checks.
+	Name string `json:"name"`
+	// Host, if set, is the hostname this project is served on. A project
+	// without a Host is served for any hostname not claimed by another.
+	Host string `json:"host"`
+
+	Repository          string `json:"repository"`
+	MayResolveSnapshots bool   `json:"snapshots"`
+	GroupId             string `json:"group_id"`
+	ArtifactId          string `json:"artifact_id"`
+
+	// Compat are added to the names at the top of the latest version's
+	// docs, which are redirected to it.
+	Compat          []string `json:"compat"`
+	ExcludeVersions []string `json:"exclude_versions"`
+	CacheDir        string   `json:"cache_dir"`
+	WarmLatest      int      `json:"warm_latest"`
+	WarmNewVersions bool     `json:"warm_new_versions"`
+	WebhookSecret   string   `json:"webhook_secret"`
+	CacheSize       int64    `json:"cache_size"`
+
+	// Listings is "styled" (the default) or "off", in which case folders
+	// without an index.html are a 404.
+	Listings string `json:"listings"`
+	// ListingTemplate, if set, is an html/template file to render listings
+	// with instead of javadocr.DefaultListingTemplate.
+	ListingTemplate string `json:"listing_template"`
+	// HiddenFolders are never listed. If unset, only META-INF is hidden.
+	HiddenFolders []string `json:"hidden_folders"`
+	// ErrorTemplates are html/template files, keyed by status code, to
+	// render error pages with instead of javadocr.DefaultErrorTemplate.
+	ErrorTemplates map[int]string `json:"error_templates"`
+	// VersionBanner turns on javadocr.DefaultVersionBanner, or the
+	// html/template in VersionBannerTemplate if that is set.
+	VersionBanner         bool   `json:"version_banner"`
+	VersionBannerTemplate string `json:"version_banner_template"`
+	// InjectHead and InjectBody are HTML put into every page, just before
+	// the closing head tag and at the top of the body respectively.
+	InjectHead string `json:"inject_head"`
+	InjectBody string `json:"inject_body"`
+	// Fallbacks is "offer" (the default), "redirect" or "off", and decides
+	// what 404s do about pages which are in other versions.
+	Fallbacks             string   `json:"fallbacks"`
+	FallbackFetches       int      `json:"fallback_fetches"`
+	FallbackFetchInterval duration `json:"fallback_fetch_interval"`
+
+	// These bound what we'll accept in a javadoc artifact; see
+	// javadocr.Limits.
+	MaxEntries          int   `json:"max_entries"`
+	MaxUncompressedSize int64 `json:"max_uncompressed_size"`
+	MaxEntrySize        int64 `json:"max_entry_size"`
+	MaxCompressionRatio int64 `json:"max_compression_ratio"`
+
+	SnapshotExpiry  duration `json:"snapshot_expiry"`
+	SnapshotStale   duration `json:"snapshot_stale"`
+	ReleaseExpiry   duration `json:"release_expiry"`
+	GCInterval      duration `json:"gc_interval"`
+	RefreshJitter   duration `json:"refresh_jitter"`
+	RefreshBackoff  duration `json:"refresh_max_backoff"`
+	BrowserMaxAge   duration `json:"browser_max_age"`
+	StaleIfError    duration `json:"stale_if_error"`
+	ReadinessWindow duration `json:"readiness_window"`
+}
+
+type config struct {
+	Listen   string          `json:"listen"`
+	Projects []projectConfig `json:"projects"`
+
+	// AdminListen, if set, is where the admin API is served. Otherwise it
+	// is served under /_javadocr/admin/ alongside the docs.
+	AdminListen string `json:"admin_listen"`
+	// AdminToken must be given as a bearer token to use the admin API. If
+	// it is empty the admin API is disabled.
+	AdminToken string `json:"admin_token"`
+	// StateFile is where changes made through the admin API are kept.
+	StateFile string `json:"state_file"`
+
+	// TLSListen, if set, is where HTTPS is served, using the certificate
+	// and key in TLSCertFile and TLSKeyFile. They are reloaded when they
+	// change, or on SIGHUP.
+	TLSListen   string `json:"tls_listen"`
+	TLSCertFile string `json:"tls_cert_file"`
+	TLSKeyFile  string `json:"tls_key_file"`
+	// RedirectHTTP, if set, makes Listen redirect everything to HTTPS
+	// instead of serving docs.
+	RedirectHTTP bool `json:"redirect_http"`
+	// HSTSMaxAge, if set, is sent in a Strict-Transport-Security header
+	// with every HTTPS response.
+	HSTSMaxAge            duration `json:"hsts_max_age"`
+	HSTSIncludeSubdomains bool     `json:"hsts_include_subdomains"`
+
+	// ShutdownTimeout is how long we wait for requests in flight to
+	// finish when asked to stop.
+	ShutdownTimeout duration `json:"shutdown_timeout"`
+
+	// LogLevel is one of "debug", "info", "warn" or "error".
+	LogLevel string `json:"log_level"`
+	// LogFormat is "text" or "json".
+	LogFormat string `json:"log_format"`
+	// AccessLog, if set, is "combined" or "json".
+	AccessLog string `json:"access_log"`
+	// AccessLogFile is where the access log is written. If empty, it goes
+	// to stdout.
+	AccessLogFile string `json:"access_log_file"`
+}
+
+// defaultConfig is what we serve if no config file is given.
+var defaultConfig = config{
+	Listen:          ":16080",
+	ShutdownTimeout: duration(30 * time.Second),
+	Projects: []projectConfig{{
+		Name:                "spongeapi",
+		Repository:          "http://repo.spongepowered.org/maven/",
+		MayResolveSnapshots: true,
+		GroupId:             "org.spongepowered",
+		ArtifactId:          "spongeapi",
+		ExcludeVersions:     []string{"3.0.1-indev"},
+		WarmLatest:          2,
+		WarmNewVersions:     true,
+	}},
+}
+
+func loadConfig(path string) (config, error) {
+	if path == "" {
+		return defaultConfig, nil
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return config{}, err
+	}
+	defer f.Close()
+
+	var cfg config
+	d := json.NewDecoder(f)
+	d.DisallowUnknownFields()
+	if err := d.Decode(&cfg); err != nil {
+		return config{}, err
+	}
+	if len(cfg.Projects) == 0 {
+		return config{}, errors.New("no projects configured")
+	}
+	if cfg.TLSListen != "" && (cfg.TLSCertFile == "" || cfg.TLSKeyFile == "") {
+		return config{}, errors.New("tls_listen needs tls_cert_file and tls_key_file")
+	}
+	if cfg.ShutdownTimeout == 0 {
+		cfg.ShutdownTimeout = defaultConfig.ShutdownTimeout
+	}
+
+	names := make(map[string]bool)
+	hosts := make(map[string]bool)
+	for _, pc := range cfg.Projects {
+		if pc.Name == "" {
+			return config{}, errors.New("a project has no name")
+		}
+		if names[pc.Name] {
+			return config{}, fmt.Errorf("project %q is configured twice", pc.Name)
+		}
+		if hosts[pc.Host] {
+			return config{}, fmt.Errorf("more than one project is served on host %q", pc.Host)
+		}
+		names[pc.Name] = true
+		hosts[pc.Host] = true
+	}
+	return cfg, nil
+}
+
+func (pc projectConfig) handler() (*javadocr.JavadocHandler, error) {
+	u, err := url.Parse(pc.Repository)
+	if err != nil {
+		return nil, err
+	}
+
+	var listings javadocr.ListingPolicy
+	switch pc.Listings {
+	case "", "styled":
+		listings = javadocr.ListingsStyled
+	case "off":
+		listings = javadocr.ListingsOff
+	default:
+		return nil, fmt.Errorf("unknown listings %q", pc.Listings)
+	}
+	var fallbacks javadocr.FallbackPolicy
+	switch pc.Fallbacks {
+	case "", "offer":
+		fallbacks = javadocr.FallbackOffer
+	case "redirect":
+		fallbacks = javadocr.FallbackRedirect
+	case "off":
+		fallbacks = javadocr.FallbackOff
+	default:
+		return nil, fmt.Errorf("unknown fallbacks %q", pc.Fallbacks)
+	}
+	var listingTemplate *template.Template
+	if pc.ListingTemplate != "" {
+		listingTemplate, err = template.ParseFiles(pc.ListingTemplate)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	errorTemplates := make(map[int]*template.Template)
+	for status, file := range pc.ErrorTemplates {
+		errorTemplates[status], err = template.ParseFiles(file)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var versionBanner *template.Template
+	if pc.VersionBannerTemplate != "" {
+		versionBanner, err = template.ParseFiles(pc.VersionBannerTemplate)
+		if err != nil {
+			return nil, err
+		}
+	} else if pc.VersionBanner {
+		versionBanner = javadocr.DefaultVersionBanner
+	}
+
+	var transformers []javadocr.Transformer
+	if pc.InjectHead != "" || pc.InjectBody != "" {
+		transformers = append(transformers, javadocr.NewHTMLInjector(pc.InjectHead, pc.InjectBody))
+	}
+
+	r := maven.RemoteRepository{URL: u, MayResolveSnapshots: pc.MayResolveSnapshots}
+	c := maven.Coordinate{GroupId: pc.GroupId, ArtifactId: pc.ArtifactId}
+	h, err := javadocr.NewJavadocHandlerWithConfig(r, c, javadocr.Config{
+		Name:                  pc.Name,
+		CacheDir:              pc.CacheDir,
+		DegradedBanner:        javadocr.DefaultDegradedBanner,
+		ExcludeVersions:       pc.ExcludeVersions,
+		WarmLatest:            pc.WarmLatest,
+		WarmNewVersions:       pc.WarmNewVersions,
+		WebhookSecret:         pc.WebhookSecret,
+		CacheSize:             pc.CacheSize,
+		SnapshotExpiry:        time.Duration(pc.SnapshotExpiry),
+		SnapshotStale:         time.Duration(pc.SnapshotStale),
+		ReleaseExpiry:         time.Duration(pc.ReleaseExpiry),
+		GCInterval:            time.Duration(pc.GCInterval),
+		RefreshJitter:         time.Duration(pc.RefreshJitter),
+		RefreshMaxBackoff:     time.Duration(pc.RefreshBackoff),
+		BrowserMaxAge:         time.Duration(pc.BrowserMaxAge),
+		StaleIfError:          time.Duration(pc.StaleIfError),
+		ReadinessWindow:       time.Duration(pc.ReadinessWindow),
+		Listings:              listings,
+		ListingTemplate:       listingTemplate,
+		HiddenFolders:         pc.HiddenFolders,
+		ErrorTemplates:        errorTemplates,
+		VersionBanner:         versionBanner,
+		Transformers:          transformers,
+		Fallbacks:             fallbacks,
+		FallbackFetches:       pc.FallbackFetches,
+		FallbackFetchInterval: time.Duration(pc.FallbackFetchInterval),
+		ArchiveLimits: javadocr.Limits{
+			MaxEntries:          pc.MaxEntries,
+			MaxUncompressedSize: pc.MaxUncompressedSize,
+			MaxEntrySize:        pc.MaxEntrySize,
+			MaxCompressionRatio: pc.MaxCompressionRatio,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, thing := range pc.Compat {
+		h.AddCompatFor(thing)
+	}
+	return h, nil
+}
+
+func (cfg config) logger() (*slog.Logger, error) {
+	var level slog.Level
+	if cfg.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return nil, err
+		}
+	}
+
+	opts := &slog.HandlerOptions{Level: level}
+	switch cfg.LogFormat {
+	case "", "text":
+		return slog.New(slog.NewTextHandler(os.Stderr, opts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts)), nil
+	}
+	return nil, fmt.Errorf("unknown log format %q", cfg.LogFormat)
+}
+
+// accessLog returns a function which wraps handlers with the configured
+// access log, if any. Everything it wraps logs to the same place.
+func (cfg config) accessLog() (func(http.Handler) http.Handler, error) {
+	var format javadocr.AccessLogFormat
+	switch cfg.AccessLog {
+	case "":
+		return func(h http.Handler) http.Handler { return h }, nil
+	case "combined":
+		format = javadocr.AccessLogCombined
+	case "json":
+		format = javadocr.AccessLogJSON
+	default:
+		return nil, fmt.Errorf("unknown access log format %q", cfg.AccessLog)
+	}
+
+	w := io.Writer(os.Stdout)
+	if cfg.AccessLogFile != "" {
+		f, err := os.OpenFile(cfg.AccessLogFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		w = f
+	}
+	return func(h http.Handler) http.Handler {
+		return javadocr.NewAccessLog(h, w, format)
+	}, nil
+}
@@ -1,51 +1,233 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"github.com/lukegb/javadocr"
-	"github.com/lukegb/javadocr/maven"
+	"github.com/lukegb/javadocr/systemd"
 	"log"
+	"log/slog"
+	"net"
 	"net/http"
-	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	u, err := url.Parse("http://repo.spongepowered.org/maven/")
+	cfg, err := loadConfig(os.Getenv("JAVADOCR_CONFIG"))
 	if err != nil {
-		panic(err)
+		log.Fatalln("loading config:", err)
 	}
+	if v := os.Getenv("JAVADOCR_LOG_LEVEL"); v != "" {
+		cfg.LogLevel = v
+	}
+	if v := os.Getenv("JAVADOCR_LOG_FORMAT"); v != "" {
+		cfg.LogFormat = v
+	}
+	logger, err := cfg.logger()
+	if err != nil {
+		log.Fatalln("setting up logging:", err)
+	}
+	slog.SetDefault(logger)
+
+	mux := http.NewServeMux()
+	projects := make(javadocr.Projects)
+	hosts := []string{""}
+	for _, pc := range cfg.Projects {
+		if pc.CacheDir == "" {
+			pc.CacheDir = os.Getenv("JAVADOCR_CACHE_DIR")
+		}
+
+		h, err := pc.handler()
+		if err != nil {
+			log.Fatalf("setting up %s: %v", pc.Name, err)
+		}
+		projects[pc.Name] = h
+		mux.Handle(pc.Host+"/", h)
+		if pc.Host != "" {
+			hosts = append(hosts, pc.Host)
+		}
+	}
+
+	// our own endpoints take priority over versions on every host
+	handleEverywhere := func(pattern string, h http.Handler) {
+		for _, host := range hosts {
+			mux.Handle(host+pattern, h)
+		}
+	}
+	handleEverywhere("/_javadocr/hooks/", http.StripPrefix("/_javadocr/hooks", javadocr.WebhookHandler{Projects: projects}))
+	handleEverywhere("/metrics", javadocr.MetricsHandler{Projects: projects})
+	handleEverywhere("/healthz", javadocr.HealthHandler{})
+	handleEverywhere("/readyz", javadocr.ReadinessHandler{Projects: projects})
+
+	sockets, err := systemd.Listeners()
+	if err != nil {
+		log.Fatalln("getting sockets from systemd:", err)
+	}
+	var docsListener, tlsListener, adminListener net.Listener
+	for _, l := range sockets {
+		if l.Name == "admin" && adminListener == nil {
+			adminListener = l
+		} else if l.Name == "https" && tlsListener == nil {
+			tlsListener = l
+		} else if docsListener == nil {
+			docsListener = l
+		} else {
+			slog.Warn("Ignoring extra socket from systemd", "name", l.Name, "addr", l.Addr())
+			l.Close()
+		}
+	}
+
+	var servers []*http.Server
+	serveErrs := make(chan error, 3)
+	serve := func(l net.Listener, h http.Handler, tlsConfig *tls.Config) {
+		srv := &http.Server{Handler: h, TLSConfig: tlsConfig}
+		servers = append(servers, srv)
+		go func() {
+			var err error
+			if tlsConfig != nil {
+				err = srv.ServeTLS(l, "", "")
+			} else {
+				err = srv.Serve(l)
+			}
+			if err != http.ErrServerClosed {
+				serveErrs <- err
+			}
+		}()
+	}
+
+	adminToken := os.Getenv("JAVADOCR_ADMIN_TOKEN")
+	if adminToken == "" {
+		adminToken = cfg.AdminToken
+	}
+	if adminToken != "" {
+		ah, err := javadocr.NewAdminHandler(projects, adminToken, cfg.StateFile)
+		if err != nil {
+			log.Fatalln("setting up admin API:", err)
+		}
+		if adminListener == nil && cfg.AdminListen != "" {
+			adminListener, err = net.Listen("tcp", cfg.AdminListen)
+			if err != nil {
+				log.Fatalln("listening for admin API:", err)
+			}
+		}
+		if adminListener != nil {
+			slog.Info("Admin API listening", "addr", adminListener.Addr())
+			serve(adminListener, ah, nil)
+		} else {
+			handleEverywhere("/_javadocr/admin/", http.StripPrefix("/_javadocr/admin", ah))
+		}
+	} else if adminListener != nil {
+		slog.Warn("No admin token configured, closing admin socket from systemd")
+		adminListener.Close()
+	}
+
+	if docsListener == nil {
+		listenOn := os.Getenv("JAVADOCR_LISTEN")
+		if listenOn == "" {
+			listenOn = cfg.Listen
+		}
+		if listenOn == "" {
+			listenOn = ":16080"
+		}
+		docsListener, err = net.Listen("tcp", listenOn)
+		if err != nil {
+			log.Fatalln("listening:", err)
+		}
+	}
+	accessLog, err := cfg.accessLog()
+	if err != nil {
+		log.Fatalln("setting up access log:", err)
+	}
+	handler := accessLog(mux)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if v := os.Getenv("JAVADOCR_TLS_LISTEN"); v != "" {
+		cfg.TLSListen = v
+	}
+	if tlsListener == nil && cfg.TLSListen != "" {
+		tlsListener, err = net.Listen("tcp", cfg.TLSListen)
+		if err != nil {
+			log.Fatalln("listening for HTTPS:", err)
+		}
+	}
+	if tlsListener != nil {
+		cr, err := newCertReloader(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			log.Fatalln("loading certificate:", err)
+		}
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go cr.watch(hup, ctx.Done())
+
+		tlsHandler := handler
+		if cfg.HSTSMaxAge > 0 {
+			tlsHandler = hsts(handler, time.Duration(cfg.HSTSMaxAge), cfg.HSTSIncludeSubdomains)
+		}
+		slog.Info("Serving HTTPS", "addr", tlsListener.Addr())
+		serve(tlsListener, tlsHandler, cr.tlsConfig())
+		if cfg.RedirectHTTP {
+			handler = accessLog(newHTTPSRedirect(tlsListener, mux))
+		}
+	}
+	serve(docsListener, handler, nil)
+
+	slog.Info("Ready", "addr", docsListener.Addr())
+	if _, err := systemd.Notify(systemd.Ready); err != nil {
+		slog.Warn("Notifying systemd failed", "err", err)
+	}
+	go watchdog(ctx)
 
-	r := maven.RemoteRepository{URL: u, MayResolveSnapshots: true}
-	c := maven.Coordinate{"org.spongepowered", "spongeapi", "", "", ""}
-	h, err := javadocr.NewJavadocHandler(r, c)
+	select {
+	case <-ctx.Done():
+		slog.Info("Shutting down, draining connections", "timeout", time.Duration(cfg.ShutdownTimeout))
+	case err := <-serveErrs:
+		slog.Error("Serving failed, shutting down", "err", err)
+	}
+	stop()
+	systemd.Notify(systemd.Stopping)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ShutdownTimeout))
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Connections didn't drain in time", "err", err)
+			srv.Close()
+		}
+	}
+	for name, h := range projects {
+		if err := h.Close(); err != nil {
+			slog.Warn("Closing project failed", "project", name, "err", err)
+		}
+	}
+	slog.Info("Stopped")
+}
+
+// watchdog keeps the systemd watchdog fed until ctx is done, if it's enabled.
+func watchdog(ctx context.Context) {
+	interval, err := systemd.WatchdogInterval()
 	if err != nil {
-		panic(err)
-	}
-	h.ExcludeVersion("3.0.1-indev")
-	for _, thing := range []string{
-		"co", "org",
-		"package-list",
-		"overview-frame.html",
-		"constant-values.html",
-		"serialized-form.html",
-		"overview-tree.html",
-		"index-all.html",
-		"deprecated-list.html",
-		"allclasses-frame.html",
-		"allclasses-noframe.html",
-		"index.html",
-		"overview-summary.html",
-		"help-doc.html",
-		"stylesheet.css",
-		"script.js",
-	} {
-		h.AddCompatFor(thing)
-	}
-
-	listenOn := os.Getenv("JAVADOCR_LISTEN")
-	if listenOn == "" {
-		listenOn = ":16080"
-	}
-	log.Println("ready, listening on", listenOn)
-	log.Fatalln(http.ListenAndServe(listenOn, h))
+		slog.Warn("Bad watchdog settings from systemd", "err", err)
+		return
+	}
+	if interval == 0 {
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if _, err := systemd.Notify(systemd.Watchdog); err != nil {
+				slog.Warn("Feeding systemd watchdog failed", "err", err)
+			}
+		}
+	}
 }
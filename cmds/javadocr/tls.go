@@ -0,0 +1,177 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// certPollInterval is how often the certificate and key files are checked
+// for changes.
+const certPollInterval = 30 * time.Second
+
+// certReloader serves a certificate from a pair of files, reloading it when
+// they change.
+type certReloader struct {
+	certFile, keyFile string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	modTime time.Time
+}
+
+func newCertReloader(certFile, keyFile string) (*certReloader, error) {
+	cr := &certReloader{certFile: certFile, keyFile: keyFile}
+	if err := cr.reload(); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// latestModTime returns when the certificate or key was last changed.
+func (cr *certReloader) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, pth := range []string{cr.certFile, cr.keyFile} {
+		fi, err := os.Stat(pth)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if fi.ModTime().After(latest) {
+			latest = fi.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload loads the certificate and key. If they can't be loaded, the
+// certificate we already have is kept.
+func (cr *certReloader) reload() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(cr.certFile, cr.keyFile)
+	if err != nil {
+		return err
+	}
+
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	cr.cert = &cert
+	cr.modTime = modTime
+	return nil
+}
+
+// reloadIfChanged reloads the certificate and key if either file has been
+// changed since we last loaded them.
+func (cr *certReloader) reloadIfChanged() error {
+	modTime, err := cr.latestModTime()
+	if err != nil {
+		return err
+	}
+	cr.mu.RLock()
+	changed := !modTime.Equal(cr.modTime)
+	cr.mu.RUnlock()
+	if !changed {
+		return nil
+	}
+	slog.Info("Certificate changed, reloading", "cert", cr.certFile)
+	return cr.reload()
+}
+
+// watch reloads the certificate whenever it changes or reload is signalled,
+// until stop is closed.
+func (cr *certReloader) watch(reload <-chan os.Signal, stop <-chan struct{}) {
+	t := time.NewTicker(certPollInterval)
+	defer t.Stop()
+	for {
+		var err error
+		select {
+		case <-stop:
+			return
+		case <-reload:
+			slog.Info("Reloading certificate", "cert", cr.certFile)
+			err = cr.reload()
+		case <-t.C:
+			err = cr.reloadIfChanged()
+		}
+		if err != nil {
+			slog.Error("Reloading certificate failed, keeping the old one", "cert", cr.certFile, "err", err)
+		}
+	}
+}
+
+func (cr *certReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cr.mu.RLock()
+	defer cr.mu.RUnlock()
+	return cr.cert, nil
+}
+
+func (cr *certReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:     tls.VersionTLS12,
+		GetCertificate: cr.GetCertificate,
+	}
+}
+
+// hsts adds a Strict-Transport-Security header to responses served over
+// HTTPS.
+func hsts(h http.Handler, maxAge time.Duration, includeSubdomains bool) http.Handler {
+	v := fmt.Sprintf("max-age=%d", int64(maxAge.Seconds()))
+	if includeSubdomains {
+		v += "; includeSubDomains"
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Strict-Transport-Security", v)
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// plainPaths are still served over plain HTTP when everything else is
+// redirected to HTTPS, since health checks and scrapers often won't follow.
+var plainPaths = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+	"/metrics": true,
+}
+
+// httpsRedirect redirects every request to the same URL over HTTPS, on port,
+// apart from those for plainPaths, which go to next.
+type httpsRedirect struct {
+	port string
+	next http.Handler
+}
+
+func (hr httpsRedirect) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if hr.next != nil && plainPaths[r.URL.Path] {
+		hr.next.ServeHTTP(w, r)
+		return
+	}
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(r.Host); err == nil {
+		host = h
+	}
+	if hr.port != "" && hr.port != "443" {
+		host = net.JoinHostPort(host, hr.port)
+	}
+	http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusPermanentRedirect)
+}
+
+// newHTTPSRedirect builds an httpsRedirect to whichever port l is listening on,
+// which leaves plainPaths to next.
+func newHTTPSRedirect(l net.Listener, next http.Handler) httpsRedirect {
+	hr := httpsRedirect{next: next}
+	if addr, ok := l.Addr().(*net.TCPAddr); ok {
+		hr.port = strconv.Itoa(addr.Port)
+	}
+	return hr
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeCert writes a self-signed certificate for commonName to certFile and
+// keyFile.
+func writeCert(t *testing.T, certFile, keyFile, commonName string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     []string{commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func servedCommonName(t *testing.T, cr *certReloader) string {
+	cert, err := cr.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.Subject.CommonName
+}
+
+func TestCertReloader(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "old.example.com")
+
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCommonName(t, cr); got != "old.example.com" {
+		t.Errorf("Got: %s, expected: old.example.com", got)
+	}
+
+	// unchanged files aren't reloaded
+	if err := cr.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+
+	writeCert(t, certFile, keyFile, "new.example.com")
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	if err := cr.reloadIfChanged(); err != nil {
+		t.Fatal(err)
+	}
+	if got := servedCommonName(t, cr); got != "new.example.com" {
+		t.Errorf("Got: %s, expected: new.example.com", got)
+	}
+
+	// a broken certificate doesn't replace a working one
+	os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err := cr.reload(); err == nil {
+		t.Error("Got no error reloading a broken certificate")
+	}
+	if got := servedCommonName(t, cr); got != "new.example.com" {
+		t.Errorf("Got: %s after a failed reload, expected: new.example.com", got)
+	}
+}
+
+func TestCertReloaderServesHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	writeCert(t, certFile, keyFile, "example.com")
+	cr, err := newCertReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{
+		Handler:   hsts(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), 24*time.Hour, true),
+		TLSConfig: cr.tlsConfig(),
+	}
+	go srv.ServeTLS(l, "", "")
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+		ForceAttemptHTTP2: true,
+	}}
+	resp, err := client.Get("https://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Errorf("Got: %s, expected HTTP/2", resp.Proto)
+	}
+	if got := resp.Header.Get("Strict-Transport-Security"); got != "max-age=86400; includeSubDomains" {
+		t.Errorf("Got: %s", got)
+	}
+}
+
+func TestHTTPSRedirect(t *testing.T) {
+	testPlan := map[string]string{
+		"443":  "https://docs.example.com/1.0/index.html?q=1",
+		"8443": "https://docs.example.com:8443/1.0/index.html?q=1",
+	}
+	for port, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		httpsRedirect{port: port}.ServeHTTP(rec, httptest.NewRequest("GET", "http://docs.example.com:8080/1.0/index.html?q=1", nil))
+		if rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusPermanentRedirect)
+		}
+		if got := rec.Header().Get("Location"); got != expected {
+			t.Errorf("Got: %s, expected: %s", got, expected)
+		}
+	}
+
+	// health checks and metrics are still served over plain HTTP
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+	for pth, plain := range map[string]bool{"/healthz": true, "/readyz": true, "/metrics": true, "/metrics/": false, "/1.0/healthz": false} {
+		rec := httptest.NewRecorder()
+		httpsRedirect{port: "443", next: ok}.ServeHTTP(rec, httptest.NewRequest("GET", "http://docs.example.com"+pth, nil))
+		if plain && (rec.Code != http.StatusOK || rec.Body.String() != "ok") {
+			t.Errorf("Got: %d for %s, expected it to be served", rec.Code, pth)
+		} else if !plain && rec.Code != http.StatusPermanentRedirect {
+			t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, http.StatusPermanentRedirect)
+		}
+	}
+
+	// redirects are logged like anything else
+	cfg := config{AccessLog: "combined", AccessLogFile: filepath.Join(t.TempDir(), "access.log")}
+	accessLog, err := cfg.accessLog()
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessLog(httpsRedirect{}).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://docs.example.com/1.0/", nil))
+	if got, _ := os.ReadFile(cfg.AccessLogFile); !strings.Contains(string(got), `"GET http://docs.example.com/1.0/ HTTP/1.1" 308`) {
+		t.Errorf("Got access log: %s", got)
+	}
+
+	// plain HTTP responses don't get HSTS headers
+	rec := httptest.NewRecorder()
+	hsts(http.NotFoundHandler(), time.Hour, false).ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Header().Get("Strict-Transport-Security"); got != "" {
+		t.Errorf("Got: %s over plain HTTP", got)
+	}
+}
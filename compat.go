@@ -0,0 +1,130 @@
+package javadocr
+
+import (
+	"github.com/lukegb/javadocr/maven"
+	"io/fs"
+)
+
+// detectedCompat is the set of names at the top of a version's docs, which
+// are redirected to that version whilst it is the latest.
+type detectedCompat struct {
+	from     maven.Coordinate
+	versions uint64
+	names    map[string]bool
+}
+
+// isCompat reports whether name, the first part of a URL path, should be
+// redirected to the latest version: either it was given to AddCompatFor, or
+// the latest version has a file or folder called name at the top of its
+// docs.
+func (h *JavadocHandler) isCompat(name string) bool {
+	h.compatLock.RLock()
+	defer h.compatLock.RUnlock()
+	if h.compat[name] {
+		return true
+	}
+	return h.detected != nil && h.detected.names[name]
+}
+
+// detectCompat works out which names to redirect from the latest version,
+// if it's cached. If it isn't, and fetch is set, it is downloaded in the
+// background, and the names worked out once it has been; if that fails, we
+// try again the next time we're asked. Until then, the names from the last
+// latest version are kept.
+func (h *JavadocHandler) detectCompat(fetch bool) {
+	latest, ok := h.latestVersion()
+	if !ok {
+		return
+	}
+	if zfs := h.cachedServer(latest); zfs != nil {
+		h.compatFrom(latest, zfs)
+		return
+	}
+	if !fetch {
+		return
+	}
+
+	h.compatLock.Lock()
+	if h.compatFetching {
+		h.compatLock.Unlock()
+		return
+	}
+	h.compatFetching = true
+	h.compatLock.Unlock()
+
+	started := h.goBackground(func() {
+		// fetchForCoordinate calls compatFrom if it works
+		if _, _, _, err := h.fetchForCoordinate(latest); err != nil {
+			h.logger.Warn("Fetching latest version to find its top-level entries failed", "version", latest.Version, "err", err)
+		}
+		h.compatLock.Lock()
+		h.compatFetching = false
+		h.compatLock.Unlock()
+	})
+	if !started {
+		h.compatLock.Lock()
+		h.compatFetching = false
+		h.compatLock.Unlock()
+	}
+}
+
+// detectCompatAfter calls detectCompat in the background once first, such as
+// warming the latest versions, is done, so that the latest version isn't
+// fetched twice. detectCompat won't fetch it in the meantime either.
+func (h *JavadocHandler) detectCompatAfter(first func()) {
+	h.compatLock.Lock()
+	h.compatFetching = true
+	h.compatLock.Unlock()
+	done := func() {
+		h.compatLock.Lock()
+		h.compatFetching = false
+		h.compatLock.Unlock()
+	}
+
+	started := h.goBackground(func() {
+		first()
+		done()
+		h.detectCompat(true)
+	})
+	if !started {
+		done()
+	}
+}
+
+// compatFrom sets the names to redirect to those at the top of zfs, which
+// is the docs for latest, unless it has stopped being the latest version or
+// they have already been worked out. Names of versions are left out, since
+// they'd otherwise never be reachable.
+func (h *JavadocHandler) compatFrom(latest maven.Coordinate, zfs *ZipFileSystem) {
+	h.compatLock.RLock()
+	done := h.detected != nil && h.detected.from == latest && h.detected.versions == h.versionsGeneration()
+	h.compatLock.RUnlock()
+	if done {
+		return
+	}
+
+	generation := h.versionsGeneration()
+	entries, err := fs.ReadDir(zfs, ".")
+	if err != nil {
+		return
+	}
+	names := make(map[string]bool, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() && h.isHidden(name) || name == LatestContainingPrefix {
+			continue
+		}
+		if _, ok := h.coordinateForVersion(name); ok {
+			continue
+		}
+		names[name] = true
+	}
+
+	if current, ok := h.latestVersion(); !ok || current != latest {
+		return
+	}
+	h.compatLock.Lock()
+	h.detected = &detectedCompat{from: latest, versions: generation, names: names}
+	h.compatLock.Unlock()
+	h.logger.Debug("Found top-level entries of latest version", "version", latest.Version, "count", len(names))
+}
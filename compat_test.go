@@ -0,0 +1,132 @@
+package javadocr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJavadocHandlerDetectsCompat(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{
+		"index.html":     "1.0",
+		"net/Foo.html":   "foo",
+		"old-frame.html": "old",
+	})
+	tr.jars["2.0"] = makeJar(t, map[string]string{
+		"index.html":            "2.0",
+		"search.html":           "search",
+		"com/Foo.html":          "foo",
+		"my.module/module.html": "module",
+		"META-INF/MANIFEST.MF":  "Manifest-Version: 1.0",
+	})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, Fallbacks: FallbackOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var testPlan map[string]string
+	check := func(when string) {
+		for pth, expected := range testPlan {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+			if expected == "" {
+				if rec.Code == http.StatusFound {
+					t.Errorf("%s: Got a redirect to %s for %s, expected none", when, rec.Header().Get("Location"), pth)
+				}
+				continue
+			}
+			if rec.Code != http.StatusFound || rec.Header().Get("Location") != expected {
+				t.Errorf("%s: Got: %d %s for %s, expected a redirect to %s", when, rec.Code, rec.Header().Get("Location"), pth, expected)
+			}
+		}
+	}
+	// the latest version is fetched on start, so that they're known before
+	// anyone asks
+	h.background.Wait()
+	if err := h.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	h.background.Wait()
+	if n := atomic.LoadInt32(&tr.jarFetch); n != 1 {
+		t.Errorf("Got: %d downloads, expected the latest version to have been fetched just the once", n)
+	}
+	testPlan = map[string]string{
+		"/com/Foo.html":          "/2.0/com/Foo.html",
+		"/search.html?q=Game":    "/2.0/search.html?q=Game",
+		"/my.module/module.html": "/2.0/my.module/module.html",
+		"/META-INF/MANIFEST.MF":  "",
+		"/net/Foo.html":          "",
+		"/1.0/index.html":        "",
+	}
+	check("latest is 2.0")
+
+	// names can still be added by hand
+	h.AddCompatFor("net")
+	testPlan["/net/Foo.html"] = "/2.0/net/Foo.html"
+	check("net added")
+
+	// and they follow the latest version around, once it's been fetched
+	h.ExcludeVersion("2.0")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/index.html", nil))
+	testPlan = map[string]string{
+		"/old-frame.html": "/1.0/old-frame.html",
+		"/net/Foo.html":   "/1.0/net/Foo.html",
+		"/com/Foo.html":   "",
+		"/search.html":    "",
+	}
+	check("latest is 1.0")
+}
+
+func TestJavadocHandlerCompatDetectionFails(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, Fallbacks: FallbackOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// 1.0 has no docs, which is only found out on start and once per
+	// refresh
+	h.background.Wait()
+	for n := 1; n < 3; n++ {
+		if err := h.refresh(); err != nil {
+			t.Fatal(err)
+		}
+		h.background.Wait()
+		for _, pth := range []string{"/wp-admin/setup.php", "/org/Foo.html", "/index.html"} {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+			if rec.Code != http.StatusNotFound {
+				t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, http.StatusNotFound)
+			}
+		}
+		if misses := atomic.LoadUint64(&h.metrics.cacheMisses); misses != uint64(n+1) {
+			t.Errorf("Got: %d attempts to fetch 1.0 after %d refreshes, expected: %d", misses, n+1, n+1)
+		}
+	}
+}
+
+func TestJavadocHandlerRedirectsUnversionedOnStart(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	tr.jars["2.0"] = makeJar(t, map[string]string{"index.html": "2.0", "org/Foo.html": "foo"})
+	// without warming, and long before the first refresh
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, WarmLatest: 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.background.Wait()
+
+	for _, pth := range []string{"/org/Foo.html", "/index.html"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != "/2.0"+pth {
+			t.Errorf("Got: %d %s for %s, expected a redirect to %s", rec.Code, rec.Header().Get("Location"), pth, "/2.0"+pth)
+		}
+	}
+}
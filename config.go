@@ -0,0 +1,171 @@
+package javadocr
+
+import (
+	"html/template"
+	"log/slog"
+	"time"
+)
+
+// DefaultDegradedBanner is a reasonable DegradedBanner for most projects.
+const DefaultDegradedBanner = `<div style="background: #fcf8e3; border: 1px solid #faebcc; color: #8a6d3b; padding: 0.5em 1em; margin: 0 0 1em 0; font-family: sans-serif;">` +
+	`The documentation repository is currently unreachable, so these docs may be out of date.` +
+	`</div>`
+
+// Config holds the settings for a single project served by a JavadocHandler.
+// The zero value is usable; any durations left unset take their defaults
+// from the package constants.
+type Config struct {
+	// Name identifies the project in logs.
+	Name string
+
+	// CacheDir, if set, is a directory in which downloaded artifacts are
+	// also kept on disk, so that they can still be served if the
+	// repository is unreachable, even across restarts.
+	CacheDir string
+
+	// DegradedBanner, if set, is a fragment of HTML inserted at the top of
+	// every page served whilst the repository is unreachable.
+	DegradedBanner string
+
+	// ExcludeVersions are versions which are never served as the latest
+	// version or warmed, as if ExcludeVersion had been called for each.
+	ExcludeVersions []string
+
+	// WarmLatest is the number of most recent versions to download and
+	// index in the background on startup, or once the versions have first
+	// been fetched if the repository is unreachable then.
+	WarmLatest int
+
+	// WarmNewVersions causes versions which appear in the repository after
+	// startup to be downloaded and indexed as soon as they are discovered,
+	// before anyone asks for them.
+	WarmNewVersions bool
+
+	// SnapshotExpiry is how long a SNAPSHOT artifact is considered fresh
+	// for before we check for a newer build.
+	SnapshotExpiry time.Duration
+	// SnapshotStale is how long past SnapshotExpiry a SNAPSHOT artifact may
+	// still be served whilst it is being revalidated.
+	SnapshotStale time.Duration
+	// ReleaseExpiry is how long a release artifact is considered fresh for.
+	ReleaseExpiry time.Duration
+	// GCInterval is how often we check for new versions and expire old
+	// SNAPSHOT artifacts.
+	GCInterval time.Duration
+	// RefreshJitter is the most that is randomly added to each GCInterval,
+	// so that projects sharing a repository don't poll it in lockstep.
+	RefreshJitter time.Duration
+	// RefreshMaxBackoff is the longest we wait between refreshes whilst
+	// the repository is returning errors.
+	RefreshMaxBackoff time.Duration
+	// Logger is where the handler logs to. If nil, slog.Default is used.
+	Logger *slog.Logger
+
+	// WebhookSecret is the shared secret with which webhook payloads for
+	// this project must be signed. Webhooks are refused if it is empty.
+	WebhookSecret string
+
+	// Scheduler, if set, replaces the IntervalScheduler built from the
+	// settings above. It must not be shared between handlers.
+	Scheduler Scheduler
+	// BrowserMaxAge caps the Cache-Control max-age sent to browsers. The
+	// Surrogate-Control header sent to CDNs is not capped.
+	BrowserMaxAge time.Duration
+	// StaleIfError is how long CDNs may serve stale pages for if we start
+	// returning errors.
+	StaleIfError time.Duration
+	// CacheSize is the most memory, in bytes, that downloaded artifacts
+	// and their compressed variants may take up. The least recently used
+	// artifacts are evicted to keep within it.
+	CacheSize int64
+	// Encoders are used, in order of preference, to compress text entries
+	// for clients which accept them. By default BrotliEncoder is preferred
+	// to GzipEncoder.
+	Encoders []Encoder
+	// Listings decides what is served for folders without an index.html.
+	Listings ListingPolicy
+	// ListingTemplate, if set, replaces DefaultListingTemplate. It is
+	// executed with a *Listing.
+	ListingTemplate *template.Template
+	// HiddenFolders are folders, relative to the root of an artifact,
+	// which are never listed, nor shown in the listings of the folders
+	// above them. If nil, only META-INF is hidden.
+	HiddenFolders []string
+
+	// VersionBanner, if set, is executed with a *VersionBanner and the
+	// result inserted at the top of every HTML page apart from javadoc's
+	// frames, along with a canonical link to the page in the latest
+	// version. DefaultVersionBanner is a reasonable choice.
+	VersionBanner *template.Template
+
+	// Transformers rewrite pages of the content types they ask for, in
+	// order, before the VersionBanner and DegradedBanner are inserted.
+	Transformers []Transformer
+
+	// ErrorTemplates replace DefaultErrorTemplate for the status codes
+	// they're keyed by. They are executed with an *ErrorPage.
+	ErrorTemplates map[int]*template.Template
+
+	// Fallbacks decides whether pages missing from the version asked for
+	// are looked for in other versions.
+	Fallbacks FallbackPolicy
+	// FallbackFetches is how many versions which aren't cached may be
+	// downloaded whilst looking for a page in other versions. By default
+	// only cached versions are looked in.
+	FallbackFetches int
+	// FallbackFetchInterval is how long to leave between such downloads,
+	// so that a flurry of 404s can't push the cache out.
+	FallbackFetchInterval time.Duration
+
+	// ArchiveLimits bound what we'll accept in a javadoc artifact.
+	// Artifacts which go over them aren't served.
+	ArchiveLimits Limits
+
+	// ReadinessWindow is how recently the repository must have answered
+	// us for the handler to be ready. By default it is ReadinessWindow, or
+	// long enough for two refreshes if that is longer.
+	ReadinessWindow time.Duration
+}
+
+func (c Config) withDefaults() Config {
+	if c.SnapshotExpiry == 0 {
+		c.SnapshotExpiry = SnapshotExpiryWindow
+	}
+	if c.SnapshotStale == 0 {
+		c.SnapshotStale = SnapshotStaleWindow
+	}
+	if c.ReleaseExpiry == 0 {
+		c.ReleaseExpiry = ReleaseExpiryWindow
+	}
+	if c.GCInterval == 0 {
+		c.GCInterval = c.SnapshotExpiry / 2
+	}
+	if c.RefreshJitter == 0 {
+		c.RefreshJitter = c.GCInterval / 10
+	}
+	if c.RefreshMaxBackoff == 0 {
+		c.RefreshMaxBackoff = RefreshMaxBackoff
+	}
+	if c.BrowserMaxAge == 0 {
+		c.BrowserMaxAge = BrowserMaxAge
+	}
+	if c.StaleIfError == 0 {
+		c.StaleIfError = StaleIfErrorWindow
+	}
+	if c.CacheSize == 0 {
+		c.CacheSize = LruCacheSize
+	}
+	if c.FallbackFetchInterval == 0 {
+		c.FallbackFetchInterval = FallbackFetchInterval
+	}
+	if c.HiddenFolders == nil {
+		c.HiddenFolders = []string{"META-INF"}
+	}
+	if c.ReadinessWindow == 0 {
+		c.ReadinessWindow = ReadinessWindow
+		if twoRefreshes := 2 * (c.GCInterval + c.RefreshJitter); twoRefreshes > c.ReadinessWindow {
+			c.ReadinessWindow = twoRefreshes
+		}
+	}
+	return c
+}
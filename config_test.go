@@ -0,0 +1,27 @@
+package javadocr
+
+import (
+	"testing"
+	"time"
+)
+
+func TestConfigDefaults(t *testing.T) {
+	c := Config{}.withDefaults()
+	if c.SnapshotExpiry != SnapshotExpiryWindow || c.ReleaseExpiry != ReleaseExpiryWindow || c.BrowserMaxAge != BrowserMaxAge {
+		t.Errorf("zero Config didn't pick up defaults: %#v", c)
+	}
+	if c.GCInterval != GCInterval {
+		t.Errorf("Got GCInterval %v, expected %v", c.GCInterval, GCInterval)
+	}
+
+	c = Config{SnapshotExpiry: 24 * time.Hour, BrowserMaxAge: time.Minute}.withDefaults()
+	if c.SnapshotExpiry != 24*time.Hour || c.BrowserMaxAge != time.Minute {
+		t.Errorf("explicit settings were overridden: %#v", c)
+	}
+	if c.GCInterval != 12*time.Hour {
+		t.Errorf("Got GCInterval %v, expected it to follow SnapshotExpiry", c.GCInterval)
+	}
+	if c.ReadinessWindow < 2*c.GCInterval {
+		t.Errorf("Got ReadinessWindow %v, expected it to cover two refreshes", c.ReadinessWindow)
+	}
+}
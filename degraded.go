@@ -0,0 +1,66 @@
+package javadocr
+
+import (
+	"errors"
+	"github.com/lukegb/javadocr/maven"
+	"time"
+)
+
+// DegradedHeader is set on every response served whilst the repository is
+// unreachable, to the time at which it went away.
+const DegradedHeader = "X-Javadocr-Degraded"
+
+// isUnreachable decides whether an error from the repository means it is
+// down, as opposed to it telling us something doesn't exist.
+func isUnreachable(err error) bool {
+	var ske maven.SkipResolutionError
+	if errors.As(err, &ske) {
+		return false
+	}
+
+	if errors.Is(err, ErrBadArchive) {
+		return false
+	}
+
+	var se *maven.StatusError
+	if errors.As(err, &se) {
+		return se.StatusCode >= 500
+	}
+
+	return true
+}
+
+// noteUpstream records the outcome of talking to the repository, entering or
+// leaving degraded mode as appropriate.
+func (h *JavadocHandler) noteUpstream(err error) {
+	h.upstreamLock.Lock()
+	defer h.upstreamLock.Unlock()
+
+	if err != nil && !isUnreachable(err) {
+		// even if it's telling us something doesn't exist, it's there
+		h.lastReachable = time.Now()
+		return
+	}
+
+	if err == nil {
+		h.lastReachable = time.Now()
+		if !h.degradedSince.IsZero() {
+			h.logger.Info("Repository has recovered", "after", time.Since(h.degradedSince))
+		}
+		h.degradedSince = time.Time{}
+		return
+	}
+
+	if h.degradedSince.IsZero() {
+		h.logger.Warn("Repository is unreachable, serving last-known-good docs", "err", err)
+		h.degradedSince = time.Now()
+	}
+}
+
+// Degraded reports whether the repository is currently unreachable, and
+// if so since when.
+func (h *JavadocHandler) Degraded() (bool, time.Time) {
+	h.upstreamLock.RLock()
+	defer h.upstreamLock.RUnlock()
+	return !h.degradedSince.IsZero(), h.degradedSince
+}
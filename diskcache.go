@@ -0,0 +1,123 @@
+package javadocr
+
+import (
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// diskCacheName is the name of the file in CacheDir which c is kept in.
+func diskCacheName(c maven.Coordinate) string {
+	return strings.Replace(c.String(), ":", "_", -1) + ".jar"
+}
+
+// diskCachePath is where c is kept on disk. Versions come from the
+// repository, so any which could take us out of CacheDir are refused.
+func (h *JavadocHandler) diskCachePath(c maven.Coordinate) (string, error) {
+	if c.Version == "" || strings.ContainsAny(c.Version, `/\`) || strings.Contains(c.Version, "..") {
+		return "", fmt.Errorf("not keeping version %q on disk", c.Version)
+	}
+	return filepath.Join(h.config.CacheDir, diskCacheName(c)), nil
+}
+
+// writeDiskCache keeps a copy of an artifact's data on disk, if we have
+// somewhere to put it. The file is written under a temporary name first so
+// that a crash never leaves a truncated artifact behind.
+func (h *JavadocHandler) writeDiskCache(c maven.Coordinate, data []byte) error {
+	if h.config.CacheDir == "" {
+		return nil
+	}
+	pth, err := h.diskCachePath(c)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(h.config.CacheDir, 0755); err != nil {
+		return err
+	}
+
+	f, err := ioutil.TempFile(h.config.CacheDir, ".download-")
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		os.Remove(f.Name())
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(f.Name())
+		return err
+	}
+	return os.Rename(f.Name(), pth)
+}
+
+// readDiskCache loads the last copy of an artifact we wrote to disk. The
+// entry is marked as having been cached when the file was written, so it is
+// treated as stale and replaced as soon as the repository comes back.
+func (h *JavadocHandler) readDiskCache(c maven.Coordinate) (*JavadocCached, error) {
+	if h.config.CacheDir == "" {
+		return nil, os.ErrNotExist
+	}
+
+	pth, err := h.diskCachePath(c)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := os.Stat(pth)
+	if err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadFile(pth)
+	if err != nil {
+		return nil, err
+	}
+
+	jc, err := h.newJavadocCached(&maven.Artifact{Coordinate: c}, data)
+	if err != nil {
+		return nil, err
+	}
+	jc.cached = fi.ModTime()
+	return jc, nil
+}
+
+// tidyDiskCache removes the artifacts in CacheDir of versions which are no
+// longer in the repository, so that it doesn't grow forever. Other projects
+// may share CacheDir, so their artifacts are left alone.
+func (h *JavadocHandler) tidyDiskCache() {
+	if h.config.CacheDir == "" {
+		return
+	}
+	entries, err := os.ReadDir(h.config.CacheDir)
+	if err != nil {
+		return
+	}
+
+	keep := make(map[string]bool)
+	h.versionsLock.RLock()
+	for _, c := range h.versions {
+		keep[diskCacheName(c)] = true
+	}
+	h.versionsLock.RUnlock()
+
+	ours := strings.TrimSuffix(diskCacheName(maven.Coordinate{
+		GroupId:    h.coordinate.GroupId,
+		ArtifactId: h.coordinate.ArtifactId,
+		Packaging:  "jar",
+		Classifier: "javadoc",
+	}), ".jar")
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.Type().IsRegular() || !strings.HasPrefix(name, ours) || !strings.HasSuffix(name, ".jar") || keep[name] {
+			continue
+		}
+		if err := os.Remove(filepath.Join(h.config.CacheDir, name)); err != nil {
+			h.logger.Warn("Failed to remove old artifact from disk cache", "file", name, "err", err)
+			continue
+		}
+		h.logger.Info("Removed old artifact from disk cache", "file", name)
+	}
+}
@@ -0,0 +1,120 @@
+package javadocr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJavadocHandlerServesFromDiskCache(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{"overview-summary.html": "<html><body>overview</body></html>"})
+	dir := t.TempDir()
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, CacheDir: dir, DegradedBanner: "DEGRADED"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/overview-summary.html", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "org.spongepowered_spongeapi_jar_javadoc_1.0.jar")); err != nil {
+		t.Fatalf("Got: %v, expected the artifact to be on disk", err)
+	}
+
+	// with it gone from memory, and the repository down, it's served off
+	// the disk, marked as such
+	h.Invalidate("1.0")
+	atomic.StoreInt32(&tr.down, 1)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/overview-summary.html", nil))
+	if rec.Code != http.StatusOK || rec.Body.String() != "<html><body>DEGRADEDoverview</body></html>" {
+		t.Errorf("Got: %d with %s, expected the cached page with a banner", rec.Code, rec.Body.String())
+	}
+	if rec.Header().Get(DegradedHeader) == "" {
+		t.Errorf("Got no %s header, expected one", DegradedHeader)
+	}
+	if degraded, since := h.Degraded(); !degraded || since.IsZero() {
+		t.Errorf("Got: %v since %v, expected to be degraded", degraded, since)
+	}
+
+	// and once it's back, we aren't degraded any more
+	atomic.StoreInt32(&tr.down, 0)
+	h.Invalidate("1.0")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/overview-summary.html", nil))
+	if rec.Body.String() != "<html><body>overview</body></html>" || rec.Header().Get(DegradedHeader) != "" {
+		t.Errorf("Got: %s with %s: %q, expected the page as normal", rec.Body.String(), DegradedHeader, rec.Header().Get(DegradedHeader))
+	}
+}
+
+func TestDiskCacheRefusesUnsafeVersions(t *testing.T) {
+	dir := t.TempDir()
+	h := &JavadocHandler{config: Config{CacheDir: filepath.Join(dir, "cache")}}
+	for _, v := range []string{"../../evil", `..\evil`, "1.0/../../evil", "..", ""} {
+		c := testCoordinate
+		c.Version = v
+		if err := h.writeDiskCache(c, []byte("evil")); err == nil {
+			t.Errorf("Got no error for version %q, expected it to be refused", v)
+		}
+	}
+	err := filepath.Walk(dir, func(pth string, fi os.FileInfo, err error) error {
+		if err == nil && !fi.IsDir() {
+			t.Errorf("Got: %s written, expected nothing", pth)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestJavadocHandlerTidiesDiskCache(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	for _, v := range tr.versions {
+		tr.jars[v] = makeJar(t, map[string]string{"overview-summary.html": v})
+	}
+	dir := t.TempDir()
+	// another project's artifact, which isn't ours to remove
+	other := "org.spongepowered_spongevanilla_jar_javadoc_1.0.jar"
+	if err := os.WriteFile(filepath.Join(dir, other), []byte("other"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, CacheDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	for _, v := range tr.versions {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+v+"/overview-summary.html", nil))
+	}
+
+	// 1.0 is pulled from the repository
+	tr.versions = []string{"2.0"}
+	if err := h.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	h.background.Wait()
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+	if got, expected := strings.Join(names, ","), "org.spongepowered_spongeapi_jar_javadoc_2.0.jar,"+other; got != expected {
+		t.Errorf("Got: %s, expected: %s", got, expected)
+	}
+}
@@ -0,0 +1,371 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/adler32"
+	"io"
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// These are the Content-Encodings we can serve a deflated zip entry with
+// without recompressing it, in order of preference.
+const (
+	encodingGzip    = "gzip"
+	encodingDeflate = "deflate"
+)
+
+// An Encoder compresses text entries into a variant which is kept alongside
+// the artifact, for clients which accept its Content-Encoding.
+type Encoder struct {
+	// Name is the Content-Encoding, such as "gzip" or "br".
+	Name string
+	// NewWriter returns a WriteCloser which compresses what is written to
+	// it into w.
+	NewWriter func(w io.Writer) (io.WriteCloser, error)
+}
+
+// GzipEncoder builds gzip variants. Deflated entries are served gzipped
+// without building a variant at all, so it only really costs anything for
+// stored entries.
+var GzipEncoder = Encoder{
+	Name: encodingGzip,
+	NewWriter: func(w io.Writer) (io.WriteCloser, error) {
+		return gzip.NewWriterLevel(w, gzip.BestCompression)
+	},
+}
+
+// isText reports whether a Content-Type is worth compressing.
+func isText(contentType string) bool {
+	mediaType, _, _ := strings.Cut(contentType, ";")
+	switch mediaType {
+	case "application/javascript", "application/json", "application/xml", "image/svg+xml":
+		return true
+	}
+	return strings.HasPrefix(mediaType, "text/")
+}
+
+// acceptsEncoding reports whether an Accept-Encoding header allows enc.
+func acceptsEncoding(header, enc string) bool {
+	accepted := false
+	for _, part := range strings.Split(header, ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding != enc && coding != "*" {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if pq, err := strconv.ParseFloat(v, 64); err == nil {
+				q = pq
+			}
+		}
+		if coding == enc {
+			// an explicit mention overrides *
+			return q > 0
+		}
+		accepted = q > 0
+	}
+	return accepted
+}
+
+// concatReaderAt reads from several ReaderAts one after the other.
+type concatReaderAt struct {
+	parts []*io.SectionReader
+}
+
+func (cr concatReaderAt) ReadAt(b []byte, off int64) (int, error) {
+	n := 0
+	for _, part := range cr.parts {
+		if off >= part.Size() {
+			off -= part.Size()
+			continue
+		}
+		m, err := part.ReadAt(b[n:], off)
+		n += m
+		if err != nil && err != io.EOF {
+			return n, err
+		}
+		if n == len(b) {
+			return n, nil
+		}
+		off = 0
+	}
+	return n, io.EOF
+}
+
+func (cr concatReaderAt) size() int64 {
+	var size int64
+	for _, part := range cr.parts {
+		size += part.Size()
+	}
+	return size
+}
+
+func sectionOf(b []byte) *io.SectionReader {
+	return io.NewSectionReader(bytes.NewReader(b), 0, int64(len(b)))
+}
+
+// encodedFile is a zip entry's compressed data, wrapped up so that it can be
+// served with a Content-Encoding.
+type encodedFile struct {
+	io.ReadSeeker
+	encoding    string
+	contentType string
+	modTime     time.Time
+}
+
+// encoded returns what http.FileServer would serve for the URL path name,
+// compressed with the first of the ZipFileSystem's Encoders which
+// acceptEncoding allows, or deflate as a last resort.
+//
+// Deflated entries are served as gzip or deflate by wrapping the compressed
+// data in a gzip or zlib header and trailer, without inflating it. Text
+// entries are otherwise compressed the first time they are asked for, and
+// the variant kept until VariantBudget runs out.
+func (zfs *ZipFileSystem) encoded(name, acceptEncoding string) (*encodedFile, bool) {
+	zf, ok := zfs.served(name).(*ZipFile)
+	if !ok {
+		return nil, false
+	}
+	contentType := mime.TypeByExtension(path.Ext(zf.f.Name))
+	if contentType == "" {
+		// we can't sniff it if we don't inflate it
+		return nil, false
+	}
+
+	ef := &encodedFile{
+		contentType: contentType,
+		modTime:     zf.ModTime(),
+	}
+	for _, enc := range zfs.encoders() {
+		if !acceptsEncoding(acceptEncoding, enc.Name) {
+			continue
+		}
+		if enc.Name == encodingGzip && zf.f.Method == zip.Deflate {
+			if rs, ok := wrapDeflated(zf.f, gzipHeader(zf.f), gzipTrailer(zf.f)); ok {
+				ef.ReadSeeker, ef.encoding = rs, enc.Name
+				return ef, true
+			}
+		}
+		if !isText(contentType) {
+			continue
+		}
+		if data, ok := zfs.variant(zf.f, "", enc); ok {
+			ef.ReadSeeker, ef.encoding = bytes.NewReader(data), enc.Name
+			return ef, true
+		}
+	}
+
+	if zf.f.Method == zip.Deflate && acceptsEncoding(acceptEncoding, encodingDeflate) {
+		sum, err := zfs.adler32(zf.f)
+		if err != nil {
+			return nil, false
+		}
+		if rs, ok := wrapDeflated(zf.f, zlibHeader, binary.BigEndian.AppendUint32(nil, sum)); ok {
+			ef.ReadSeeker, ef.encoding = rs, encodingDeflate
+			return ef, true
+		}
+	}
+	return nil, false
+}
+
+func (zfs *ZipFileSystem) encoders() []Encoder {
+	if zfs.Encoders == nil {
+		return []Encoder{BrotliEncoder, GzipEncoder}
+	}
+	return zfs.Encoders
+}
+
+// wrapDeflated puts header and trailer around the compressed data of f.
+func wrapDeflated(f *zip.File, header, trailer []byte) (io.ReadSeeker, bool) {
+	raw, err := f.OpenRaw()
+	if err != nil {
+		return nil, false
+	}
+	rawAt, ok := raw.(*io.SectionReader)
+	if !ok {
+		return nil, false
+	}
+
+	cr := concatReaderAt{[]*io.SectionReader{sectionOf(header), rawAt, sectionOf(trailer)}}
+	return io.NewSectionReader(cr, 0, cr.size()), true
+}
+
+type variantKey struct {
+	f *zip.File
+	// transform is the key f was transformed with before it was
+	// compressed, if it was
+	transform string
+	encoding  string
+}
+
+// variant is an entry compressed by an Encoder. It is built once, by
+// whichever request asks for it first.
+type variant struct {
+	once sync.Once
+	// data, ok and dropped are only set whilst variantLock is held
+	data    []byte
+	ok      bool
+	dropped bool
+}
+
+// variant returns f compressed by enc, compressing it if nobody has asked for
+// it before. If transform isn't "", it is f as it was transformed with that
+// key which is compressed, which must have been kept.
+func (zfs *ZipFileSystem) variant(f *zip.File, transform string, enc Encoder) ([]byte, bool) {
+	key := variantKey{f, transform, enc.Name}
+	zfs.variantLock.Lock()
+	if zfs.variants == nil {
+		zfs.variants = make(map[variantKey]*variant)
+	}
+	v, ok := zfs.variants[key]
+	if !ok {
+		v = new(variant)
+		zfs.variants[key] = v
+	}
+	zfs.variantLock.Unlock()
+
+	v.once.Do(func() {
+		var src io.Reader
+		size := int64(f.UncompressedSize64)
+		if transform != "" {
+			transformed, ok := zfs.transformed(f, transform)
+			if !ok {
+				return
+			}
+			src, size = bytes.NewReader(transformed), int64(len(transformed))
+		}
+		if atomic.LoadInt64(&zfs.variantBytes)+size > zfs.VariantBudget {
+			// it might well be smaller than that once compressed, but
+			// we're not going to find out
+			return
+		}
+
+		if src == nil {
+			rc, err := f.Open()
+			if err != nil {
+				zfs.logger().Warn("Compressing entry failed", "name", f.Name, "encoding", enc.Name, "err", err)
+				return
+			}
+			defer rc.Close()
+			src = rc
+		}
+		data, err := compress(src, enc)
+		if err != nil {
+			zfs.logger().Warn("Compressing entry failed", "name", f.Name, "encoding", enc.Name, "err", err)
+			return
+		}
+		if !zfs.reserve(int64(len(data))) {
+			return
+		}
+		zfs.variantLock.Lock()
+		dropped := v.dropped
+		if !dropped {
+			v.data, v.ok = data, true
+		}
+		zfs.variantLock.Unlock()
+		if dropped {
+			// the transformed page it was compressed from has since
+			// been replaced
+			zfs.release(int64(len(data)))
+		}
+	})
+	return v.data, v.ok
+}
+
+// reserve takes size bytes out of what's left of the VariantBudget, if there
+// are that many left.
+func (zfs *ZipFileSystem) reserve(size int64) bool {
+	if atomic.AddInt64(&zfs.variantBytes, size) > zfs.VariantBudget {
+		atomic.AddInt64(&zfs.variantBytes, -size)
+		return false
+	}
+	return true
+}
+
+// release gives size bytes back to the VariantBudget.
+func (zfs *ZipFileSystem) release(size int64) {
+	atomic.AddInt64(&zfs.variantBytes, -size)
+}
+
+// VariantBytes is how much memory is taken up by compressed variants,
+// transformed pages and inflate indexes.
+func (zfs *ZipFileSystem) VariantBytes() int64 {
+	return atomic.LoadInt64(&zfs.variantBytes)
+}
+
+// compress reads everything from src, compressed by enc.
+func compress(src io.Reader, enc Encoder) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := enc.NewWriter(&buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, src); err != nil {
+		w.Close()
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// gzipHeader is a gzip member header (RFC 1952) for a deflated zip entry.
+func gzipHeader(f *zip.File) []byte {
+	h := []byte{0x1f, 0x8b, 8, 0, 0, 0, 0, 0, 0, 255}
+	if mtime := f.Modified.Unix(); mtime > 0 && mtime <= 0xffffffff {
+		binary.LittleEndian.PutUint32(h[4:8], uint32(mtime))
+	}
+	return h
+}
+
+// gzipTrailer is the gzip trailer for a deflated zip entry, which needs the
+// same CRC32 the zip header already has.
+func gzipTrailer(f *zip.File) []byte {
+	t := binary.LittleEndian.AppendUint32(nil, f.CRC32)
+	return binary.LittleEndian.AppendUint32(t, uint32(f.UncompressedSize64))
+}
+
+// zlibHeader is a zlib header (RFC 1950) for deflate with a 32K window.
+var zlibHeader = []byte{0x78, 0x9c}
+
+// adler32 returns the Adler-32 of a zip entry, which zlib needs but zip
+// doesn't record. It is worked out the first time it is asked for.
+func (zfs *ZipFileSystem) adler32(f *zip.File) (uint32, error) {
+	zfs.adlerLock.Lock()
+	sum, ok := zfs.adlers[f]
+	zfs.adlerLock.Unlock()
+	if ok {
+		return sum, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+	h := adler32.New()
+	if _, err := io.Copy(h, rc); err != nil {
+		return 0, err
+	}
+	sum = h.Sum32()
+
+	zfs.adlerLock.Lock()
+	defer zfs.adlerLock.Unlock()
+	if zfs.adlers == nil {
+		zfs.adlers = make(map[*zip.File]uint32)
+	}
+	zfs.adlers[f] = sum
+	return sum, nil
+}
@@ -0,0 +1,238 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	testPlan := []struct {
+		header, enc string
+		expected    bool
+	}{
+		{"gzip", "gzip", true},
+		{"gzip, deflate, br", "deflate", true},
+		{"GZIP", "gzip", true},
+		{"deflate", "gzip", false},
+		{"", "gzip", false},
+		{"gzip;q=0", "gzip", false},
+		{"gzip; q=0.5", "gzip", true},
+		{"*", "gzip", true},
+		{"*, gzip;q=0", "gzip", false},
+		{"*;q=0, gzip", "gzip", true},
+		{"identity", "gzip", false},
+	}
+	for _, tp := range testPlan {
+		if got := acceptsEncoding(tp.header, tp.enc); got != tp.expected {
+			t.Errorf("Got: %v for %s in %q, expected: %v", got, tp.enc, tp.header, tp.expected)
+		}
+	}
+}
+
+func TestZipFileSystemEncoded(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("javadoc ", 1000) + "</body></html>"
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{"org/Foo.html": page, "org/foo.unknown-type": "x"})
+
+	ef, ok := zfs.encoded("/org/Foo.html", "gzip")
+	if !ok {
+		t.Fatal("Foo.html wasn't available gzipped")
+	}
+	if ef.encoding != "gzip" || !strings.HasPrefix(ef.contentType, "text/html") {
+		t.Errorf("Got: %s, %s", ef.encoding, ef.contentType)
+	}
+	gr, err := gzip.NewReader(ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := io.ReadAll(gr)
+	if err != nil {
+		// this also checks the CRC32 and size in the trailer
+		t.Fatal(err)
+	}
+	if string(got) != page {
+		t.Errorf("gzip stream didn't match the page")
+	}
+	if !gr.ModTime.Equal(time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("Got gzip mtime: %v", gr.ModTime)
+	}
+
+	ef, ok = zfs.encoded("/org/Foo.html", "deflate")
+	if !ok || ef.encoding != "deflate" {
+		t.Fatal("Foo.html wasn't available deflated")
+	}
+	for n := 0; n < 2; n++ {
+		// the second time round the Adler-32 is remembered
+		ef.Seek(0, io.SeekStart)
+		zr, err := zlib.NewReader(ef)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err = io.ReadAll(zr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(got) != page {
+			t.Errorf("zlib stream didn't match the page")
+		}
+	}
+
+	// partial reads from the middle line up with the whole
+	ef, _ = zfs.encoded("/org/Foo.html", "gzip")
+	whole, _ := io.ReadAll(ef)
+	ef.Seek(5, io.SeekStart)
+	part := make([]byte, len(whole)-10)
+	if _, err := io.ReadFull(ef, part); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(part, whole[5:len(whole)-5]) {
+		t.Error("reading from an offset didn't match")
+	}
+
+	for _, tp := range []struct{ name, accept string }{
+		{"/org/Foo.html", ""},
+		{"/org/Foo.html", "br"},
+		{"/org/foo.unknown-type", "gzip"},
+		{"/org/", "gzip"},
+		{"/missing.html", "gzip"},
+	} {
+		if _, ok := zfs.encoded(tp.name, tp.accept); ok {
+			t.Errorf("%s was encoded for %q", tp.name, tp.accept)
+		}
+	}
+}
+
+func TestZipFileSystemEncodedStored(t *testing.T) {
+	zfs := newTestZipFileSystem(t, zip.Store, map[string]string{"Foo.html": "<html></html>"})
+	if _, ok := zfs.encoded("/Foo.html", "gzip"); ok {
+		t.Error("a stored entry was encoded without a variant budget")
+	}
+}
+
+func TestJavadocHandlerContentEncoding(t *testing.T) {
+	page := "<html><body>overview</body></html>"
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{"overview-summary.html": page})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/overview-summary.html", nil))
+	identityETag := rec.Header().Get("ETag")
+
+	req := httptest.NewRequest("GET", "/1.0/overview-summary.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+		t.Fatalf("Got: %d with Content-Encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("Vary") != "Accept-Encoding" {
+		t.Errorf("Got Vary: %q", rec.Header().Get("Vary"))
+	}
+	etag := rec.Header().Get("ETag")
+	if etag == "" || etag == identityETag {
+		t.Errorf("Got ETag %s for gzip, and %s for identity", etag, identityETag)
+	}
+	gr, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(gr); string(got) != page {
+		t.Errorf("Got: %s, expected: %s", got, page)
+	}
+
+	// brotli is preferred where it's accepted
+	req = httptest.NewRequest("GET", "/1.0/overview-summary.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip, br")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "br" {
+		t.Fatalf("Got: %d with Content-Encoding %q", rec.Code, rec.Header().Get("Content-Encoding"))
+	}
+	if rec.Header().Get("ETag") == etag {
+		t.Errorf("Got the same ETag %s for br as for gzip", etag)
+	}
+	if got, err := decodeBrotli(rec.Body.Bytes()); err != nil || string(got) != page {
+		t.Errorf("Got: %s, %v, expected: %s", got, err, page)
+	}
+
+	req = httptest.NewRequest("GET", "/1.0/overview-summary.html", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	req.Header.Set("If-None-Match", etag)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != http.StatusNotModified {
+		t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusNotModified)
+	}
+}
+
+func TestZipFileSystemVariants(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("javadoc ", 1000) + "</body></html>"
+	zfs := newTestZipFileSystem(t, zip.Store, map[string]string{"Foo.html": page, "logo.png": page})
+	zfs.VariantBudget = 1 << 20
+
+	ef, ok := zfs.encoded("/Foo.html", "gzip, br")
+	if !ok || ef.encoding != "br" {
+		t.Fatalf("Got: %v, %v, expected the preferred encoder to be used", ef, ok)
+	}
+	compressed, _ := io.ReadAll(ef)
+	if got, err := decodeBrotli(compressed); err != nil || string(got) != page {
+		t.Errorf("Got: %v, expected the br variant to match the page", err)
+	}
+	afterOne := zfs.VariantBytes()
+	if afterOne <= 0 || afterOne >= int64(len(page)) {
+		t.Errorf("Got %d variant bytes for a %d byte page", afterOne, len(page))
+	}
+
+	// asking again doesn't build it again
+	zfs.encoded("/Foo.html", "br")
+	if got := zfs.VariantBytes(); got != afterOne {
+		t.Errorf("Got %d variant bytes, expected %d", got, afterOne)
+	}
+
+	ef, ok = zfs.encoded("/Foo.html", "gzip")
+	if !ok || ef.encoding != "gzip" {
+		t.Fatal("stored entry wasn't available gzipped")
+	}
+	gr, err := gzip.NewReader(ef)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := io.ReadAll(gr); string(got) != page {
+		t.Error("gzip variant didn't match the page")
+	}
+
+	if _, ok := zfs.encoded("/logo.png", "gzip"); ok {
+		t.Error("an image was compressed")
+	}
+	if _, ok := zfs.encoded("/Foo.html", "deflate"); ok {
+		t.Error("a stored entry was deflated without an encoder for it")
+	}
+}
+
+func TestZipFileSystemVariantBudget(t *testing.T) {
+	page := "<html><body>" + strings.Repeat("javadoc ", 1000) + "</body></html>"
+	zfs := newTestZipFileSystem(t, zip.Store, map[string]string{"Foo.html": page, "Bar.html": page})
+	zfs.VariantBudget = int64(len(page)) + 10
+
+	if _, ok := zfs.encoded("/Foo.html", "gzip"); !ok {
+		t.Fatal("the first variant didn't fit in the budget")
+	}
+	if _, ok := zfs.encoded("/Bar.html", "gzip"); ok {
+		t.Error("Got a variant beyond the budget")
+	}
+	if zfs.VariantBytes() > zfs.VariantBudget {
+		t.Errorf("Got %d variant bytes, more than the budget of %d", zfs.VariantBytes(), zfs.VariantBudget)
+	}
+}
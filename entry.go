@@ -3,21 +3,44 @@ package javadocr
 import (
 	"archive/zip"
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
 	"github.com/lukegb/javadocr/maven"
+	"hash/crc32"
+	"io"
+	"io/fs"
 	"io/ioutil"
-	"log"
+	"log/slog"
 	"net/http"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// These are the defaults for the corresponding fields of Config.
 const (
 	SnapshotExpiryWindow = 1 * time.Minute
 	GCInterval           = SnapshotExpiryWindow / 2
 	LruCacheSize         = 512 * 1024 * 1024
+
+	// SnapshotStaleWindow is how long past its expiry a SNAPSHOT artifact
+	// may still be served whilst it is revalidated in the background.
+	SnapshotStaleWindow = 1 * time.Hour
+	// StaleIfErrorWindow is how long caches in front of us may keep
+	// serving a stale response if we start returning errors.
+	StaleIfErrorWindow = 24 * time.Hour
+	// ReleaseExpiryWindow is how long release artifacts may be cached for.
+	ReleaseExpiryWindow = 30 * 24 * time.Hour
+	// BrowserMaxAge caps how long browsers are told they may cache pages
+	// for, regardless of how long the artifact itself is valid.
+	BrowserMaxAge = 10 * time.Minute
+	// RefreshMaxBackoff is the longest we wait between attempts to refresh
+	// whilst the repository is returning errors.
+	RefreshMaxBackoff = 10 * time.Minute
 )
 
 type JavadocCache map[maven.Coordinate]*JavadocCached
@@ -32,7 +55,7 @@ func (jck *JavadocCacheKeys) Len() int {
 }
 
 func (jck *JavadocCacheKeys) Less(i, j int) bool {
-	return jck.jc[jck.c[i]].accessed.After(jck.jc[jck.c[i]].accessed)
+	return jck.jc[jck.c[i]].accessed.After(jck.jc[jck.c[j]].accessed)
 }
 
 func (jck *JavadocCacheKeys) Swap(i, j int) {
@@ -42,15 +65,47 @@ func (jck *JavadocCacheKeys) Swap(i, j int) {
 type JavadocHandler struct {
 	repository maven.Repository
 	coordinate maven.Coordinate
+	config     Config
+	logger     *slog.Logger
+
+	compat         map[string]bool
+	detected       *detectedCompat
+	compatFetching bool
+	compatLock     sync.RWMutex
 
-	compat map[string]bool
+	transformers []Transformer
 
 	versions        []maven.Coordinate
 	excludeVersions map[string]bool
-	versionsLock    sync.RWMutex
+	// generation goes up whenever versions or excludeVersions change
+	generation   uint64
+	versionsLock sync.RWMutex
 
 	versionCache     JavadocCache
 	versionCacheLock sync.RWMutex
+
+	degradedSince time.Time
+	lastReachable time.Time
+	populated     bool
+	upstreamLock  sync.RWMutex
+
+	lastFallbackFetch time.Time
+	fallbackLock      sync.Mutex
+
+	bannerVersions *bannerVersions
+	bannersKey     string
+	banners        map[bannerCacheKey]renderedBanner
+	bannerLock     sync.Mutex
+
+	warmLock  sync.Mutex
+	warmStats WarmStats
+
+	metrics handlerMetrics
+
+	scheduler  Scheduler
+	background sync.WaitGroup
+	closed     bool
+	closeLock  sync.Mutex
 }
 
 type JavadocCached struct {
@@ -59,52 +114,159 @@ type JavadocCached struct {
 	size     int64
 	cached   time.Time
 	accessed time.Time
+
+	// revalidating is set whilst a background check for a newer
+	// SNAPSHOT build is in flight, so we only ever start one.
+	revalidating bool
 }
 
-func (h *JavadocHandler) refresher() {
-	// yay
-	for {
-		(func() {
-			log.Println("Checking for new versions")
-
-			err := h.populateVersions()
-			log.Printf("New versions check concluded with result %v", err)
-		})()
-
-		(func() {
-			h.versionCacheLock.Lock()
-			defer h.versionCacheLock.Unlock()
-			log.Println("Checking SNAPSHOT artifacts for expiry")
-			nvc := make(JavadocCache)
-			for c, el := range h.versionCache {
-				if !c.IsSnapshot() {
-					nvc[c] = el
-					continue
-				}
-
-				if el.cached.After(time.Now().Add(-SnapshotExpiryWindow)) {
-					nvc[c] = el
-					continue
-				}
-
-				log.Printf("Expiring %v", el.artifact.Coordinate.String())
-			}
-			h.versionCache = nvc
-		})()
-		time.Sleep(GCInterval)
+// cacheSize is how much memory the artifact takes up, including any
+// compressed variants built from it.
+func (jc *JavadocCached) cacheSize() int64 {
+	return jc.size + jc.server.VariantBytes()
+}
+
+// refresh is called by the Scheduler to look for new versions and expire old
+// SNAPSHOT artifacts.
+func (h *JavadocHandler) refresh() error {
+	start := time.Now()
+	defer func() {
+		h.metrics.refreshDuration.observe(time.Since(start))
+	}()
+
+	h.logger.Debug("Checking for new versions")
+	err := h.populateVersions()
+	if err != nil {
+		h.logger.Warn("Checking for new versions failed", "err", err)
+	}
+	h.detectCompat(true)
+
+	h.versionCacheLock.Lock()
+	defer h.versionCacheLock.Unlock()
+	if degraded, _ := h.Degraded(); degraded {
+		h.logger.Debug("Repository is unreachable, not expiring SNAPSHOT artifacts")
+		return err
+	}
+	h.logger.Debug("Checking SNAPSHOT artifacts for expiry")
+	nvc := make(JavadocCache)
+	for c, el := range h.versionCache {
+		if !c.IsSnapshot() {
+			nvc[c] = el
+			continue
+		}
+
+		if el.cached.After(time.Now().Add(-h.config.SnapshotExpiry - h.config.SnapshotStale)) {
+			nvc[c] = el
+			continue
+		}
+
+		h.logger.Info("Expiring artifact", "version", c.Version)
+		atomic.AddUint64(&h.metrics.cacheEvictions, 1)
 	}
+	h.versionCache = nvc
+	return err
+}
+
+// TriggerRefresh asks for the list of versions to be refreshed as soon as
+// possible, rather than waiting for the next scheduled refresh.
+func (h *JavadocHandler) TriggerRefresh() {
+	h.scheduler.Trigger()
+}
+
+// goBackground runs f in its own goroutine, unless the handler has been
+// closed. Close waits for any such goroutines to finish.
+func (h *JavadocHandler) goBackground(f func()) bool {
+	h.closeLock.Lock()
+	defer h.closeLock.Unlock()
+	if h.closed {
+		return false
+	}
+
+	h.background.Add(1)
+	go func() {
+		defer h.background.Done()
+		f()
+	}()
+	return true
+}
+
+func (h *JavadocHandler) isClosed() bool {
+	h.closeLock.Lock()
+	defer h.closeLock.Unlock()
+	return h.closed
+}
+
+// Close stops the handler refreshing in the background, and waits for any
+// downloads it started on its own behalf to finish. Requests may still be
+// served afterwards, but the versions and cache will no longer be kept up to
+// date.
+func (h *JavadocHandler) Close() error {
+	h.closeLock.Lock()
+	if h.closed {
+		h.closeLock.Unlock()
+		return nil
+	}
+	h.closed = true
+	h.closeLock.Unlock()
+
+	h.scheduler.Stop()
+	h.background.Wait()
+	return nil
 }
 
 func (h *JavadocHandler) ExcludeVersion(v string) {
 	h.versionsLock.Lock()
-	defer h.versionsLock.Unlock()
 	h.excludeVersions[v] = true
+	h.generation++
+	h.versionsLock.Unlock()
+	h.detectCompat(false)
 }
 
 func (h *JavadocHandler) IncludeVersion(v string) {
 	h.versionsLock.Lock()
-	defer h.versionsLock.Unlock()
 	delete(h.excludeVersions, v)
+	h.generation++
+	h.versionsLock.Unlock()
+	h.detectCompat(false)
+}
+
+// versionsGeneration goes up whenever the known or excluded versions change.
+func (h *JavadocHandler) versionsGeneration() uint64 {
+	h.versionsLock.RLock()
+	defer h.versionsLock.RUnlock()
+	return h.generation
+}
+
+// Invalidate drops any cached copy of version v, so that the next request for
+// it downloads it again. It reports whether there was anything to drop.
+func (h *JavadocHandler) Invalidate(v string) bool {
+	h.versionCacheLock.Lock()
+	defer h.versionCacheLock.Unlock()
+
+	found := false
+	for c := range h.versionCache {
+		if c.Version == v {
+			h.logger.Info("Invalidating artifact", "version", c.Version)
+			delete(h.versionCache, c)
+			atomic.AddUint64(&h.metrics.cacheEvictions, 1)
+			found = true
+		}
+	}
+	return found
+}
+
+// InvalidateSnapshots drops every cached SNAPSHOT artifact.
+func (h *JavadocHandler) InvalidateSnapshots() {
+	h.versionCacheLock.Lock()
+	defer h.versionCacheLock.Unlock()
+
+	for c := range h.versionCache {
+		if c.IsSnapshot() {
+			h.logger.Info("Invalidating artifact", "version", c.Version)
+			delete(h.versionCache, c)
+			atomic.AddUint64(&h.metrics.cacheEvictions, 1)
+		}
+	}
 }
 
 // must be called whilst holding versionCacheLock!
@@ -119,169 +281,424 @@ func (h *JavadocHandler) tidyVersionCache() {
 	sort.Sort(jcks)
 
 	var runningTotalSize int64 = 0
-	cutoff := -1
+	culled := 0
 	for k, n := range jcks.c {
-		if cutoff != -1 {
+		runningTotalSize += h.versionCache[n].cacheSize()
+		// always keep the most recently used, however big it is
+		if k > 0 && runningTotalSize > h.config.CacheSize {
 			delete(h.versionCache, n)
-		}
-
-		runningTotalSize += h.versionCache[n].size
-		if runningTotalSize > LruCacheSize {
-			cutoff = k
-			break
+			atomic.AddUint64(&h.metrics.cacheEvictions, 1)
+			culled++
 		}
 	}
 
-	if cutoff > 0 {
-		log.Printf("Culled LRU cache at point %d", h.versionCache)
+	if culled > 0 {
+		h.logger.Info("Culled LRU cache", "culled", culled)
 	}
 
 }
 
 func (h *JavadocHandler) calculateValidUntil(c maven.Coordinate, cachedAt time.Time) time.Time {
 	if c.IsSnapshot() {
-		return cachedAt.Add(SnapshotExpiryWindow)
+		return cachedAt.Add(h.config.SnapshotExpiry)
 	} else {
-		// 30 days
-		return time.Now().Add(2592000 * time.Second)
+		return time.Now().Add(h.config.ReleaseExpiry)
 	}
 }
 
-func (h *JavadocHandler) fetchForCoordinate(c maven.Coordinate) (*ZipFileSystem, time.Time, error) {
-	jc, ok := (func() (*JavadocCached, bool) {
-		h.versionCacheLock.RLock()
-		defer h.versionCacheLock.RUnlock()
+// How fetchForCoordinate found an artifact, for the access log.
+const (
+	cacheHit   = "hit"
+	cacheStale = "stale"
+	cacheMiss  = "miss"
+	cacheDisk  = "disk"
+)
+
+func (h *JavadocHandler) fetchForCoordinate(c maven.Coordinate) (*ZipFileSystem, time.Time, string, error) {
+	jc, validUntil, status := (func() (*JavadocCached, time.Time, string) {
+		h.versionCacheLock.Lock()
+		defer h.versionCacheLock.Unlock()
 
 		jc, ok := h.versionCache[c]
+		if !ok {
+			return nil, time.Time{}, cacheMiss
+		}
 
-		if ok {
-			validUntil := h.calculateValidUntil(c, jc.cached)
-			now := time.Now()
-			if validUntil.Before(now) || validUntil.Equal(now) {
-				// NOPE NOT VALID
-				return jc, false
-			}
+		jc.accessed = time.Now()
+		validUntil := h.calculateValidUntil(c, jc.cached)
+		if time.Now().Before(validUntil) {
+			return jc, validUntil, cacheHit
 		}
 
-		return jc, ok
+		if !c.IsSnapshot() {
+			// NOPE NOT VALID
+			return nil, time.Time{}, cacheMiss
+		}
+
+		// serve the stale copy, but go and find out if there's a new build
+		if !jc.revalidating {
+			jc.revalidating = true
+			jc.revalidating = h.goBackground(func() {
+				h.revalidate(c, jc)
+			})
+		}
+		return jc, validUntil, cacheStale
 	})()
-	if ok {
-		return jc.server, h.calculateValidUntil(c, jc.cached), nil
+	if status != cacheMiss {
+		atomic.AddUint64(&h.metrics.cacheHits, 1)
+		return jc.server, validUntil, status, nil
 	}
+	atomic.AddUint64(&h.metrics.cacheMisses, 1)
 
-	artifact, err := h.repository.Resolve(c)
+	artifact, err := h.resolve(c)
+	if err == nil {
+		jc, err = h.download(artifact)
+	}
+	h.noteUpstream(err)
 	if err != nil {
-		return nil, time.Now(), err
+		if !isUnreachable(err) {
+			return nil, time.Now(), status, err
+		}
+
+		var derr error
+		jc, derr = h.readDiskCache(c)
+		if derr != nil {
+			return nil, time.Now(), status, err
+		}
+		status = cacheDisk
+		h.logger.Warn("Serving artifact from disk cache", "version", c.Version, "err", err)
 	}
 
-	rc, err := artifact.Fetch()
-	defer rc.Close()
+	h.versionCacheLock.Lock()
+	jc.accessed = time.Now()
+	h.versionCache[c] = jc
+	h.tidyVersionCache()
+	h.versionCacheLock.Unlock()
+
+	if latest, ok := h.latestVersion(); ok && latest == c {
+		h.compatFrom(c, jc.server)
+	}
+	return jc.server, h.calculateValidUntil(c, jc.cached), status, nil
+}
+
+// revalidate checks whether a stale SNAPSHOT entry is still the latest build,
+// and only downloads the artifact again if it has actually changed.
+func (h *JavadocHandler) revalidate(c maven.Coordinate, jc *JavadocCached) {
+	h.logger.Debug("Revalidating artifact", "version", c.Version)
+
+	var njc *JavadocCached
+	artifact, err := h.resolve(c)
+	// the resolved filename embeds the snapshot timestamp and build number
+	// from the metadata, so if it hasn't moved then neither has the build
+	sameBuild := err == nil && jc.artifact.URL != nil && artifact.URL.String() == jc.artifact.URL.String()
+	if err == nil && !sameBuild {
+		njc, err = h.download(artifact)
+	}
+
+	h.versionCacheLock.Lock()
+	defer h.versionCacheLock.Unlock()
+
+	jc.revalidating = false
+	h.noteUpstream(err)
 	if err != nil {
-		return nil, time.Now(), err
+		// keep serving what we have until it falls out of the stale window
+		h.logger.Warn("Revalidating artifact failed", "version", c.Version, "err", err)
+		return
+	}
+
+	if sameBuild {
+		h.logger.Debug("Artifact is unchanged", "version", c.Version)
+		jc.cached = time.Now()
+		return
 	}
 
-	data, err := ioutil.ReadAll(rc)
+	h.logger.Info("Artifact has a new build", "version", c.Version, "url", artifact.URL.String())
+	if h.versionCache[c] == jc {
+		njc.accessed = jc.accessed
+		h.versionCache[c] = njc
+		h.tidyVersionCache()
+	}
+}
+
+func (h *JavadocHandler) resolve(c maven.Coordinate) (*maven.Artifact, error) {
+	var artifact *maven.Artifact
+	err := h.timeRepository("resolve", func() error {
+		var err error
+		artifact, err = h.repository.Resolve(c)
+		return err
+	})
+	return artifact, err
+}
+
+func (h *JavadocHandler) download(artifact *maven.Artifact) (*JavadocCached, error) {
+	var data []byte
+	err := h.timeRepository("fetch", func() error {
+		rc, err := artifact.Fetch()
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+
+		limit := h.config.ArchiveLimits.withDefaults().MaxUncompressedSize
+		data, err = ioutil.ReadAll(io.LimitReader(rc, limit+1))
+		if err == nil && int64(len(data)) > limit {
+			err = &ArchiveError{Reason: fmt.Sprintf("is more than %d bytes, the limit", limit)}
+		}
+		return err
+	})
 	if err != nil {
-		return nil, time.Now(), err
+		return nil, err
 	}
 
+	jc, err := h.newJavadocCached(artifact, data)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := h.writeDiskCache(artifact.Coordinate, data); err != nil {
+		h.logger.Error("Failed to write artifact to disk cache", "version", artifact.Coordinate.Version, "err", err)
+	}
+	return jc, nil
+}
+
+func (h *JavadocHandler) newJavadocCached(artifact *maven.Artifact, data []byte) (*JavadocCached, error) {
 	bb := bytes.NewReader(data)
 	zr, err := zip.NewReader(bb, int64(len(data)))
 	if err != nil {
-		return nil, time.Now(), err
+		return nil, err
 	}
 
-	zfs, err := NewZipFileSystem(zr)
+	zfs, err := NewZipFileSystemWithLimits(zr, h.config.ArchiveLimits)
 	if err != nil {
-		return nil, time.Now(), err
+		h.logger.Error("Rejected artifact", "version", artifact.Coordinate.Version, "err", err)
+		return nil, err
 	}
-
-	jc = new(JavadocCached)
+	zfs.Logger = h.logger.With("version", artifact.Coordinate.Version)
+	sum := sha256.Sum256(data)
+	zfs.Checksum = hex.EncodeToString(sum[:8])
+	zfs.Encoders = h.config.Encoders
+	// variants of the text entries shouldn't come to more than the
+	// artifact, since it's mostly compressed text itself
+	zfs.VariantBudget = int64(len(data))
+
+	jc := new(JavadocCached)
 	jc.server = zfs
 	jc.size = int64(len(data))
 	jc.cached = time.Now()
 	jc.artifact = artifact
-
-	h.versionCacheLock.Lock()
-	h.versionCache[c] = jc
-	h.tidyVersionCache()
-	h.versionCacheLock.Unlock()
-
-	return jc.server, h.calculateValidUntil(c, jc.cached), nil
+	return jc, nil
 }
 
 func (h *JavadocHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	sr := &statusRecorder{ResponseWriter: w}
+	w = sr
+	metricsVersion := "unknown"
+	defer func() {
+		h.metrics.requests.inc(metricsVersion, strconv.Itoa(sr.status()))
+	}()
+
+	ri := requestInfoFromContext(r.Context())
+	if ri != nil {
+		ri.Project = h.config.Name
+	}
+
 	pth := strings.TrimPrefix(r.URL.Path, "/")
 	pieces := strings.SplitN(pth, "/", 2)
 
-	if x, ok := h.compat[pieces[0]]; r.URL.Path == "/" || (x && ok) {
-		h.versionsLock.RLock()
-		var vr maven.Coordinate
-		for n := len(h.versions) - 1; n >= 0; n-- {
-			vr = h.versions[n]
-			if excl, ok := h.excludeVersions[vr.Version]; !vr.IsSnapshot() && !(ok && excl) {
-				break
-			}
+	if r.URL.Path == "/" || h.isCompat(pieces[0]) {
+		vr, ok := h.latestVersion()
+		if !ok {
+			// we haven't managed to fetch any versions yet
+			h.serveError(w, r, http.StatusServiceUnavailable, "", r.URL.Path)
+			return
 		}
-		h.versionsLock.RUnlock()
 		q := ""
 		if r.URL.RawQuery != "" {
 			q = "?" + r.URL.RawQuery
 		}
+		metricsVersion = vr.Version
+		if ri != nil {
+			ri.Version = vr.Version
+		}
 		w.Header().Add("Location", "/"+vr.Version+r.URL.Path+q)
 		w.WriteHeader(http.StatusFound)
 		return
 	}
 
+	if pieces[0] == LatestContainingPrefix && len(pieces) == 2 {
+		h.serveLatestContaining(w, r, "/"+pieces[1])
+		return
+	}
+
 	// otherwise, try and find that version
-	var vr *maven.Coordinate
-	h.versionsLock.Lock()
-	for _, r := range h.versions {
-		if r.Version == pieces[0] {
-			vr = &r
-			break
-		}
+	page := ""
+	if len(pieces) == 2 {
+		page = "/" + pieces[1]
+	}
+	vr, ok := h.coordinateForVersion(pieces[0])
+	if !ok {
+		// this is as likely to be someone poking around as a real
+		// version, so don't go looking for the page elsewhere
+		h.serveError(w, r, http.StatusNotFound, pieces[0], "")
+		return
+	}
+	metricsVersion = vr.Version
+	if ri != nil {
+		ri.Version = vr.Version
+	}
+	if len(pieces) == 1 {
+		http.Redirect(w, r, pageURL(vr.Version, "/", r), http.StatusMovedPermanently)
+		return
 	}
-	h.versionsLock.Unlock()
 
-	if vr == nil {
-		w.WriteHeader(http.StatusNotFound)
+	zf, validUntil, cacheStatus, err := h.fetchForCoordinate(vr)
+	if ri != nil {
+		ri.Cache = cacheStatus
+	}
+	if status := fetchErrorStatus(err); status == http.StatusNotFound {
+		h.pageNotFound(w, r, h.errorPageFor(status, vr.Version, ""), page)
+		return
+	} else if err != nil {
+		h.serveError(w, r, status, vr.Version, "")
 		return
 	}
 
-	zf, validUntil, err := h.fetchForCoordinate(*vr)
-	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+	r.URL.Path = "/" + pieces[1]
+	etag, hasETag := zf.ETag(r.URL.Path)
+
+	// folders without an index are listed, unless they mustn't be
+	if _, err := fs.Stat(zf, fsPath(r.URL.Path)); err != nil {
+		h.pageNotFound(w, r, h.errorPageFor(http.StatusNotFound, vr.Version, r.URL.Path), r.URL.Path)
+		return
+	}
+	folder, listing := zf.served(r.URL.Path).(*ZipFolder)
+	if listing && (h.config.Listings == ListingsOff || h.isHidden(fsPath(r.URL.Path))) {
+		h.serveError(w, r, http.StatusNotFound, vr.Version, r.URL.Path)
 		return
 	}
 
+	tc := &TransformContext{
+		Project:    h.config.Name,
+		Coordinate: vr,
+		Path:       r.URL.Path,
+	}
+	if degraded, since := h.Degraded(); degraded {
+		w.Header().Set(DegradedHeader, since.UTC().Format(http.TimeFormat))
+		tc.Degraded = true
+	}
+	switch f := zf.served(r.URL.Path).(type) {
+	case *ZipFolder:
+		tc.ContentType = "text/html"
+	case *ZipFile:
+		tc.ContentType = mediaType(f.Name())
+	}
+	transformers, transformKey := h.transformersFor(tc)
+	if transformKey != "" && hasETag {
+		// the page isn't what it would otherwise be
+		etag = strings.TrimSuffix(etag, `"`) + fmt.Sprintf(`-t%08x"`, crc32.ChecksumIEEE([]byte(transformKey)))
+	}
+
+	// serve deflated entries as they are, if the client will take them,
+	// and compress transformed pages once they've been kept
+	w.Header().Add("Vary", "Accept-Encoding")
+	var ef *encodedFile
+	if transformKey == "" {
+		ef, _ = zf.encoded(r.URL.Path, r.Header.Get("Accept-Encoding"))
+	} else if file, ok := zf.served(r.URL.Path).(*ZipFile); ok {
+		ef, _ = zf.encodedTransformed(file, transformKey, r.Header.Get("Accept-Encoding"))
+	}
+	if ef != nil && hasETag {
+		etag = strings.TrimSuffix(etag, `"`) + "-" + ef.encoding + `"`
+	}
+
 	// set the cache expiry (for Fastly)
 	validUntilSecondsFromNow := int64(validUntil.Sub(time.Now()).Seconds())
+	if validUntilSecondsFromNow < 0 {
+		// we're serving a stale SNAPSHOT whilst we revalidate it
+		validUntilSecondsFromNow = 0
+	}
 	browserValidUntilSecondsFromNow := validUntilSecondsFromNow
-	if browserValidUntilSecondsFromNow > 600 {
-		// cap browser validity to 10 minutes
-		browserValidUntilSecondsFromNow = 600
+	if maxAge := int64(h.config.BrowserMaxAge.Seconds()); browserValidUntilSecondsFromNow > maxAge {
+		// cap browser validity
+		browserValidUntilSecondsFromNow = maxAge
 	}
-	w.Header().Set("Surrogate-Control", fmt.Sprintf("max-age=%d", validUntilSecondsFromNow))
+	w.Header().Set("Surrogate-Control", fmt.Sprintf("max-age=%d, stale-while-revalidate=%d, stale-if-error=%d",
+		validUntilSecondsFromNow, int64(h.config.SnapshotStale.Seconds()), int64(h.config.StaleIfError.Seconds())))
 	w.Header().Set("Cache-Control", fmt.Sprintf("max-age=%d", browserValidUntilSecondsFromNow))
 
-	zfh := http.FileServer(zf)
+	if hasETag {
+		w.Header().Set("ETag", etag)
+		if inm := r.Header.Get("If-None-Match"); inm != "" {
+			if (r.Method == "GET" || r.Method == "HEAD") && etagMatches(inm, etag) {
+				w.Header().Del("Content-Type")
+				w.WriteHeader(http.StatusNotModified)
+				return
+			}
+			// If-Modified-Since is ignored if If-None-Match is given,
+			// which http.FileServer forgets to do for directories
+			r.Header.Del("If-Modified-Since")
+		}
+	}
+
+	if ef != nil {
+		w.Header().Set("Content-Encoding", ef.encoding)
+		w.Header().Set("Content-Type", ef.contentType)
+		http.ServeContent(w, r, "", ef.modTime, ef)
+		return
+	}
 
-	r.URL.Path = "/" + pieces[1]
+	if listing {
+		h.serveListing(w, r, vr.Version, folder, transformers, tc)
+		return
+	}
+	if file, ok := zf.served(r.URL.Path).(*ZipFile); ok && transformKey != "" {
+		h.serveTransformed(w, r, zf, file, transformers, transformKey, tc)
+		return
+	}
+
+	zfh := http.FileServer(http.FS(zf))
 	zfh.ServeHTTP(w, r)
 	return
 }
 
+// coordinateForVersion finds the javadoc coordinate for a known version.
+func (h *JavadocHandler) coordinateForVersion(v string) (maven.Coordinate, bool) {
+	h.versionsLock.RLock()
+	defer h.versionsLock.RUnlock()
+	for _, c := range h.versions {
+		if c.Version == v {
+			return c, true
+		}
+	}
+	return maven.Coordinate{}, false
+}
+
+// AddCompatFor makes URLs starting with thing redirect to the latest version,
+// as well as those starting with any of the names at the top of its docs.
 func (jh *JavadocHandler) AddCompatFor(thing string) {
+	jh.compatLock.Lock()
+	defer jh.compatLock.Unlock()
 	jh.compat[thing] = true
 }
 
 func (jh *JavadocHandler) populateVersions() error {
-	versions, err := jh.repository.VersionsForCoordinate(jh.coordinate)
+	var versions []maven.Coordinate
+	err := jh.timeRepository("versions", func() error {
+		var err error
+		versions, err = jh.repository.VersionsForCoordinate(jh.coordinate)
+		return err
+	})
+	jh.noteUpstream(err)
 	if err != nil {
+		// keep serving the last version list we managed to fetch
 		return err
 	}
 
+	jh.upstreamLock.Lock()
+	first := !jh.populated
+	jh.populated = true
+	jh.upstreamLock.Unlock()
+
 	inVersions := make([]maven.Coordinate, len(versions))
 
 	for n, v := range versions {
@@ -291,22 +708,68 @@ func (jh *JavadocHandler) populateVersions() error {
 	}
 
 	jh.versionsLock.Lock()
-	defer jh.versionsLock.Unlock()
+	discovered := newVersions(jh.versions, inVersions)
 	jh.versions = inVersions
+	jh.generation++
+	jh.versionsLock.Unlock()
+	jh.tidyDiskCache()
+
+	if first {
+		// whether we've just started or the repository has just come
+		// back, so that starting degraded doesn't mean never warming, and
+		// unversioned URLs are redirected without waiting for a refresh
+		latest := jh.latestVersions(jh.config.WarmLatest)
+		jh.detectCompatAfter(func() {
+			jh.warm(latest)
+		})
+	}
+	if len(discovered) > 0 {
+		jh.logger.Info("Discovered new versions", "count", len(discovered))
+		if jh.config.WarmNewVersions {
+			jh.goBackground(func() {
+				jh.warm(discovered)
+			})
+		}
+	}
 
 	return nil
 }
 
 func NewJavadocHandler(repository maven.Repository, coordinate maven.Coordinate) (*JavadocHandler, error) {
+	return NewJavadocHandlerWithConfig(repository, coordinate, Config{})
+}
+
+func NewJavadocHandlerWithConfig(repository maven.Repository, coordinate maven.Coordinate, config Config) (*JavadocHandler, error) {
 	jh := new(JavadocHandler)
 	jh.repository = repository
 	jh.coordinate = coordinate
+	jh.config = config.withDefaults()
+	jh.logger = jh.config.Logger
+	if jh.logger == nil {
+		jh.logger = slog.Default()
+	}
+	jh.logger = jh.logger.With("project", jh.config.Name, "coordinate", coordinate.String())
 	jh.excludeVersions = make(map[string]bool)
 	jh.versionCache = make(JavadocCache)
 	jh.compat = make(map[string]bool)
+	jh.transformers = append(append([]Transformer(nil), config.Transformers...), jh.builtinTransformers()...)
+	for _, v := range config.ExcludeVersions {
+		jh.excludeVersions[v] = true
+	}
 	if err := jh.populateVersions(); err != nil {
-		return nil, err
+		if !isUnreachable(err) {
+			return nil, err
+		}
+		// start degraded, and keep trying in the background; we won't
+		// be ready until we've managed to fetch the versions
+		jh.logger.Warn("Repository is unreachable, starting without any versions", "err", err)
+	}
+	jh.scheduler = jh.config.Scheduler
+	if jh.scheduler == nil {
+		is := NewIntervalScheduler(jh.config.GCInterval, jh.config.RefreshJitter, jh.config.RefreshMaxBackoff)
+		is.Logger = jh.logger
+		jh.scheduler = is
 	}
-	go jh.refresher()
+	jh.scheduler.Start(jh.refresh)
 	return jh, nil
 }
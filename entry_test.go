@@ -0,0 +1,411 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var testCoordinate = maven.Coordinate{GroupId: "org.spongepowered", ArtifactId: "spongeapi"}
+
+// testRepository serves maven-metadata.xml listing versions, and javadoc jars
+// for those versions which have them, counting what it is asked for.
+type testRepository struct {
+	*httptest.Server
+	versions []string
+	jars     map[string][]byte
+	// build is the current build number of every SNAPSHOT
+	build int32
+	// builds, if set, are served as the jar of every SNAPSHOT for each
+	// build number, instead of what's in jars
+	builds map[int32][]byte
+	// down, if set, makes every request fail as if the repository were
+	// having an outage
+	down int32
+	// jarDelay holds up every jar download, so that any which overlap
+	// can be seen to
+	jarDelay time.Duration
+
+	jarsInFlight     int32
+	mostJarsInFlight int32
+
+	metadataFetch int32
+	buildFetch    int32
+	jarFetch      int32
+}
+
+func newTestRepository(t *testing.T, versions ...string) *testRepository {
+	tr := &testRepository{versions: versions, jars: make(map[string][]byte), build: 1}
+	tr.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&tr.down) != 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		base := "/org/spongepowered/spongeapi/"
+		if r.URL.Path == base+"maven-metadata.xml" {
+			atomic.AddInt32(&tr.metadataFetch, 1)
+			fmt.Fprint(w, "<metadata><versioning><versions>")
+			for _, v := range tr.versions {
+				fmt.Fprintf(w, "<version>%s</version>", v)
+			}
+			fmt.Fprint(w, "</versions></versioning></metadata>")
+			return
+		}
+
+		pieces := strings.Split(strings.TrimPrefix(r.URL.Path, base), "/")
+		if len(pieces) != 2 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		version, filename := pieces[0], pieces[1]
+		if filename == "maven-metadata.xml" {
+			atomic.AddInt32(&tr.buildFetch, 1)
+			fmt.Fprintf(w, "<metadata><versioning><snapshot><timestamp>20160101.000000</timestamp><buildNumber>%d</buildNumber></snapshot></versioning></metadata>", atomic.LoadInt32(&tr.build))
+			return
+		}
+
+		jar, ok := tr.jars[version]
+		if build, isBuild := tr.builds[atomic.LoadInt32(&tr.build)]; isBuild && strings.HasSuffix(version, "-SNAPSHOT") {
+			jar, ok = build, true
+		}
+		if !ok || !strings.HasSuffix(filename, "-javadoc.jar") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		atomic.AddInt32(&tr.jarFetch, 1)
+		inFlight := atomic.AddInt32(&tr.jarsInFlight, 1)
+		defer atomic.AddInt32(&tr.jarsInFlight, -1)
+		for most := atomic.LoadInt32(&tr.mostJarsInFlight); inFlight > most; most = atomic.LoadInt32(&tr.mostJarsInFlight) {
+			if atomic.CompareAndSwapInt32(&tr.mostJarsInFlight, most, inFlight) {
+				break
+			}
+		}
+		time.Sleep(tr.jarDelay)
+		w.Write(jar)
+	}))
+	t.Cleanup(tr.Close)
+	return tr
+}
+
+// makeJar builds a zip file containing files, deflated.
+func makeJar(t testing.TB, files map[string]string) []byte {
+	return makeJarWithMethod(t, zip.Deflate, files)
+}
+
+// makeJarWithMethod builds a zip file containing files, compressed with
+// method.
+func makeJarWithMethod(t testing.TB, method uint16, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:     name,
+			Method:   method,
+			Modified: time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(files[name])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// newZipReader reads the zip file jar.
+func newZipReader(t testing.TB, jar []byte) *zip.Reader {
+	zr, err := zip.NewReader(bytes.NewReader(jar), int64(len(jar)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return zr
+}
+
+func (tr *testRepository) repository(t *testing.T) maven.RemoteRepository {
+	u, err := url.Parse(tr.URL + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return maven.RemoteRepository{URL: u, MayResolveSnapshots: true}
+}
+
+// handler serves the repository's javadoc, with config, until the test is
+// over. Unless config says otherwise, nothing is garbage collected whilst it
+// runs.
+func (tr *testRepository) handler(t *testing.T, config Config) *JavadocHandler {
+	if config.GCInterval == 0 {
+		config.GCInterval = time.Hour
+	}
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { h.Close() })
+	return h
+}
+
+func TestJavadocHandlerTriggerRefreshAndClose(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h.TriggerRefresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt32(&tr.metadataFetch) < 2 {
+		if time.Now().After(deadline) {
+			t.Fatal("TriggerRefresh didn't cause a refresh")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if err := h.Close(); err != nil {
+		t.Fatal(err)
+	}
+	fetches := atomic.LoadInt32(&tr.metadataFetch)
+	h.TriggerRefresh()
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadInt32(&tr.metadataFetch); got != fetches {
+		t.Errorf("refreshed after Close: %d fetches, expected %d", got, fetches)
+	}
+}
+
+func TestJavadocHandlerConditionalRequests(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{
+		"overview-summary.html": "<html><body>overview</body></html>",
+		"org/Foo.html":          "<html><body>foo</body></html>",
+	})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, pth := range []string{"/1.0/overview-summary.html", "/1.0/org/"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		etag, lastModified := rec.Header().Get("ETag"), rec.Header().Get("Last-Modified")
+		if rec.Code != http.StatusOK || etag == "" || lastModified == "" {
+			t.Fatalf("Got: %d with ETag %q and Last-Modified %q for %s", rec.Code, etag, lastModified, pth)
+		}
+
+		testPlan := []struct {
+			header, value string
+			expected      int
+		}{
+			{"If-None-Match", etag, http.StatusNotModified},
+			{"If-None-Match", `"something-else"`, http.StatusOK},
+			{"If-Modified-Since", lastModified, http.StatusNotModified},
+			{"If-Modified-Since", "Thu, 01 Jan 2015 00:00:00 GMT", http.StatusOK},
+		}
+		for _, tp := range testPlan {
+			req := httptest.NewRequest("GET", pth, nil)
+			req.Header.Set(tp.header, tp.value)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tp.expected {
+				t.Errorf("Got: %d for %s with %s: %s, expected: %d", rec.Code, pth, tp.header, tp.value, tp.expected)
+			}
+			if got := rec.Header().Get("ETag"); got != etag {
+				t.Errorf("Got ETag: %s, expected: %s", got, etag)
+			}
+		}
+
+		// If-None-Match wins over If-Modified-Since
+		req := httptest.NewRequest("GET", pth, nil)
+		req.Header.Set("If-None-Match", `"something-else"`)
+		req.Header.Set("If-Modified-Since", lastModified)
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			t.Errorf("Got: %d for %s with a stale ETag and a fresh date, expected: %d", rec.Code, pth, http.StatusOK)
+		}
+	}
+}
+
+func TestJavadocHandlerEvictsLeastRecentlyUsed(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0")
+	for _, v := range tr.versions {
+		tr.jars[v] = makeJar(t, map[string]string{"overview-summary.html": v})
+	}
+	// room for two artifacts, but not three
+	size := int64(len(tr.jars["1.0"]))
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, CacheSize: 2*size + size/2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	for _, v := range []string{"1.0", "2.0", "1.0", "3.0"} {
+		if _, _, _, err := h.fetchForCoordinate(maven.Coordinate{GroupId: testCoordinate.GroupId, ArtifactId: testCoordinate.ArtifactId, Version: v, Classifier: "javadoc", Packaging: "jar"}); err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	h.versionCacheLock.RLock()
+	defer h.versionCacheLock.RUnlock()
+	var cached []string
+	for c := range h.versionCache {
+		cached = append(cached, c.Version)
+	}
+	sort.Strings(cached)
+	if strings.Join(cached, ",") != "1.0,3.0" {
+		t.Errorf("Got: %v cached, expected 1.0 and 3.0", cached)
+	}
+}
+
+func TestJavadocHandlerVersionWithoutSlash(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{"index.html": "<html><body>index</body></html>"})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	testPlan := map[string]string{
+		"/1.0":     "/1.0/",
+		"/1.0?a=b": "/1.0/?a=b",
+	}
+	for pth, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != http.StatusMovedPermanently || rec.Header().Get("Location") != expected {
+			t.Errorf("Got: %d to %s for %s, expected: %d to %s", rec.Code, rec.Header().Get("Location"), pth, http.StatusMovedPermanently, expected)
+		}
+	}
+	if n := atomic.LoadInt32(&tr.jarFetch); n != 0 {
+		t.Errorf("Got: %d downloads, expected the redirect to come first", n)
+	}
+}
+
+func TestJavadocHandlerRevalidatesStaleSnapshots(t *testing.T) {
+	tr := newTestRepository(t, "1.0-SNAPSHOT")
+	tr.builds = map[int32][]byte{
+		1: makeJar(t, map[string]string{"overview-summary.html": "build 1"}),
+		2: makeJar(t, map[string]string{"overview-summary.html": "build 2"}),
+	}
+	expiry := 100 * time.Millisecond
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, SnapshotExpiry: expiry, SnapshotStale: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	get := func(expectedBody, expectedCache string) {
+		t.Helper()
+		ri := &requestInfo{}
+		req := httptest.NewRequest("GET", "/1.0-SNAPSHOT/overview-summary.html", nil)
+		req = req.WithContext(context.WithValue(req.Context(), requestInfoKey{}, ri))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if got := rec.Body.String(); got != expectedBody {
+			t.Errorf("Got: %s, expected: %s", got, expectedBody)
+		}
+		if ri.Cache != expectedCache {
+			t.Errorf("Got: %s from the cache, expected: %s", ri.Cache, expectedCache)
+		}
+		// whatever's left of the expiry rounds down to nothing
+		if got, expected := rec.Header().Get("Surrogate-Control"), "max-age=0, stale-while-revalidate=3600, stale-if-error=86400"; got != expected {
+			t.Errorf("Got Surrogate-Control: %s, expected: %s", got, expected)
+		}
+	}
+	counts := func(when string, builds, jars int32) {
+		t.Helper()
+		h.background.Wait()
+		if got := atomic.LoadInt32(&tr.buildFetch); got != builds {
+			t.Errorf("%s: Got: %d build lookups, expected: %d", when, got, builds)
+		}
+		if got := atomic.LoadInt32(&tr.jarFetch); got != jars {
+			t.Errorf("%s: Got: %d downloads, expected: %d", when, got, jars)
+		}
+	}
+	cachedAt := func() time.Time {
+		h.versionCacheLock.RLock()
+		defer h.versionCacheLock.RUnlock()
+		for _, jc := range h.versionCache {
+			return jc.cached
+		}
+		return time.Time{}
+	}
+
+	get("build 1", cacheMiss)
+	get("build 1", cacheHit)
+	counts("fresh", 1, 1)
+
+	// once it's expired, the stale copy is served whilst we check for a
+	// new build, which there isn't, so it's just good for a while longer
+	firstCached := cachedAt()
+	time.Sleep(expiry)
+	get("build 1", cacheStale)
+	counts("same build", 2, 1)
+	if !cachedAt().After(firstCached) {
+		t.Errorf("Got: cached at %v, expected it to have been bumped from %v", cachedAt(), firstCached)
+	}
+	get("build 1", cacheHit)
+
+	// a new build replaces it, but only after the stale copy is served
+	atomic.StoreInt32(&tr.build, 2)
+	time.Sleep(expiry)
+	get("build 1", cacheStale)
+	counts("new build", 3, 2)
+	get("build 2", cacheHit)
+}
+
+func TestJavadocHandlerSnapshotCacheHeaders(t *testing.T) {
+	testPlan := []struct {
+		config                         Config
+		surrogateMaxAge, browserMaxAge int64
+		stale                          int64
+	}{
+		{Config{}, 60, 60, 3600},
+		{Config{SnapshotExpiry: 10 * time.Minute, SnapshotStale: 2 * time.Hour, BrowserMaxAge: time.Hour}, 600, 600, 7200},
+		{Config{SnapshotExpiry: time.Hour, SnapshotStale: time.Minute}, 3600, 600, 60},
+	}
+	for _, tp := range testPlan {
+		tr := newTestRepository(t, "1.0-SNAPSHOT")
+		tr.jars["1.0-SNAPSHOT"] = makeJar(t, map[string]string{"overview-summary.html": "overview"})
+		tp.config.GCInterval = time.Hour
+		h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, tp.config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer h.Close()
+
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0-SNAPSHOT/overview-summary.html", nil))
+		// a second may have ticked by since it was cached
+		var surrogateMaxAge, stale, staleIfError, browserMaxAge int64
+		fmt.Sscanf(rec.Header().Get("Surrogate-Control"), "max-age=%d, stale-while-revalidate=%d, stale-if-error=%d", &surrogateMaxAge, &stale, &staleIfError)
+		fmt.Sscanf(rec.Header().Get("Cache-Control"), "max-age=%d", &browserMaxAge)
+		if surrogateMaxAge < tp.surrogateMaxAge-1 || surrogateMaxAge > tp.surrogateMaxAge || stale != tp.stale || staleIfError != 86400 {
+			t.Errorf("Got Surrogate-Control: %s, expected max-age=%d, stale-while-revalidate=%d", rec.Header().Get("Surrogate-Control"), tp.surrogateMaxAge, tp.stale)
+		}
+		if browserMaxAge < tp.browserMaxAge-1 || browserMaxAge > tp.browserMaxAge {
+			t.Errorf("Got Cache-Control: %s, expected max-age=%d", rec.Header().Get("Cache-Control"), tp.browserMaxAge)
+		}
+	}
+}
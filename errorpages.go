@@ -0,0 +1,183 @@
+package javadocr
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"html/template"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// nearVersions is how many versions either side of the one asked for are
+// suggested on error pages.
+const nearVersions = 2
+
+// ErrorPage is what an error template is executed with.
+type ErrorPage struct {
+	Project    string
+	Status     int
+	StatusText string
+	// Message explains what went wrong, in a sentence.
+	Message string
+
+	// Version is the version which was asked for, if any, and Path the
+	// page within it.
+	Version string
+	Path    string
+
+	// Latest is the latest version, and LatestURL the top of its docs.
+	// They are empty if we don't know of any versions yet.
+	Latest    string
+	LatestURL string
+	// Nearest are the known versions closest to Version.
+	Nearest []VersionLink
+	// Elsewhere, if its URL is set, is the nearest version which does
+	// have the page.
+	Elsewhere VersionLink
+}
+
+// VersionLink links to a version's docs, or a page within them.
+type VersionLink struct {
+	Version string
+	URL     string
+}
+
+func versionLink(version string) VersionLink {
+	return VersionLink{Version: version, URL: "/" + url.PathEscape(version) + "/"}
+}
+
+// DefaultErrorTemplate is used for error pages if the Config doesn't give a
+// template for the status code in ErrorTemplates.
+var DefaultErrorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{.Status}} {{.StatusText}}{{if .Project}} - {{.Project}}{{end}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #333; }
+h1 { font-weight: normal; }
+a { color: #4a6782; text-decoration: none; }
+a:hover { text-decoration: underline; }
+</style>
+</head>
+<body>
+<h1>{{.Status}} {{.StatusText}}</h1>
+<p>{{.Message}}</p>
+{{if .Elsewhere.URL}}<p>It's in <a href="{{.Elsewhere.URL}}">version {{.Elsewhere.Version}}</a>, though.</p>
+{{end}}{{if .Nearest}}<p>Try {{range $n, $v := .Nearest}}{{if $n}}, {{end}}<a href="{{$v.URL}}">{{$v.Version}}</a>{{end}}.</p>
+{{end}}{{if .LatestURL}}<p><a href="{{.LatestURL}}">Go to the latest docs ({{.Latest}})</a></p>
+{{end}}</body>
+</html>
+`))
+
+// fetchErrorStatus decides which status to answer with when we couldn't get
+// the artifact for a version.
+func fetchErrorStatus(err error) int {
+	var ske maven.SkipResolutionError
+	var se *maven.StatusError
+	switch {
+	case errors.As(err, &ske), errors.As(err, &se) && se.StatusCode == http.StatusNotFound:
+		// the version exists, but there are no docs for it
+		return http.StatusNotFound
+	case errors.Is(err, ErrBadArchive), isUnreachable(err):
+		return http.StatusBadGateway
+	}
+	return http.StatusInternalServerError
+}
+
+// latestVersion finds the newest version which isn't a SNAPSHOT or
+// excluded.
+func (h *JavadocHandler) latestVersion() (maven.Coordinate, bool) {
+	h.versionsLock.RLock()
+	defer h.versionsLock.RUnlock()
+	for n := len(h.versions) - 1; n >= 0; n-- {
+		vr := h.versions[n]
+		if excl, ok := h.excludeVersions[vr.Version]; !vr.IsSnapshot() && !(ok && excl) {
+			return vr, true
+		}
+	}
+	return maven.Coordinate{}, false
+}
+
+// nearestVersions returns up to n known versions either side of v, oldest
+// first, not including v itself.
+func (h *JavadocHandler) nearestVersions(v string, n int) []string {
+	var versions []string
+	for _, c := range h.sortedVersions() {
+		versions = append(versions, c.Version)
+	}
+	at := sort.Search(len(versions), func(i int) bool {
+		return maven.CompareVersions(versions[i], v) >= 0
+	})
+	after := at
+	if after < len(versions) && versions[after] == v {
+		after++
+	}
+	return append(versions[max(at-n, 0):at:at], versions[after:min(after+n, len(versions))]...)
+}
+
+// errorPageFor builds the ErrorPage for status, for the page pth in version.
+// pth is empty if the problem is with the version as a whole.
+func (h *JavadocHandler) errorPageFor(status int, version, pth string) *ErrorPage {
+	ep := &ErrorPage{
+		Project:    h.config.Name,
+		Status:     status,
+		StatusText: http.StatusText(status),
+		Version:    version,
+		Path:       pth,
+	}
+	if latest, ok := h.latestVersion(); ok {
+		ep.Latest = latest.Version
+		ep.LatestURL = versionLink(latest.Version).URL
+	}
+	if version != "" {
+		for _, v := range h.nearestVersions(version, nearVersions) {
+			ep.Nearest = append(ep.Nearest, versionLink(v))
+		}
+	}
+
+	_, known := h.coordinateForVersion(version)
+	switch {
+	case status == http.StatusNotFound && (!known || pth == ""):
+		ep.Message = fmt.Sprintf("There are no docs for version %s.", version)
+	case status == http.StatusNotFound:
+		ep.Message = fmt.Sprintf("Version %s doesn't have a page at %s.", version, pth)
+	case status == http.StatusServiceUnavailable:
+		ep.Message = "We haven't found out which versions there are yet. Please try again shortly."
+	case status == http.StatusBadGateway:
+		ep.Message = fmt.Sprintf("We couldn't get the docs for version %s from the repository.", version)
+	default:
+		ep.Message = "Something went wrong whilst finding that page."
+	}
+	return ep
+}
+
+// serveError answers with status, and an error page saying what was being
+// looked for.
+func (h *JavadocHandler) serveError(w http.ResponseWriter, r *http.Request, status int, version, pth string) {
+	h.renderError(w, r, h.errorPageFor(status, version, pth))
+}
+
+// renderError answers with the error page ep.
+func (h *JavadocHandler) renderError(w http.ResponseWriter, r *http.Request, ep *ErrorPage) {
+	tmpl := h.config.ErrorTemplates[ep.Status]
+	if tmpl == nil {
+		tmpl = DefaultErrorTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, ep); err != nil {
+		h.logger.Error("Rendering error page failed", "status", ep.Status, "err", err)
+		http.Error(w, http.StatusText(ep.Status), ep.Status)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(ep.Status)
+	if r.Method != "HEAD" {
+		w.Write(buf.Bytes())
+	}
+}
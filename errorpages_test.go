@@ -0,0 +1,100 @@
+package javadocr
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestJavadocHandlerErrorPages(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "2.1", "3.0", "4.0-SNAPSHOT")
+	tr.jars["2.0"] = makeJar(t, map[string]string{"overview-summary.html": "<html><body>overview</body></html>"})
+	tr.jars["3.0"] = makeJar(t, map[string]string{"overview-summary.html": "<html><body>overview</body></html>"})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{Name: "spongeapi", GCInterval: time.Hour, Fallbacks: FallbackOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	testPlan := map[string]struct {
+		code     int
+		contains []string
+	}{
+		"/2.5/overview-summary.html": {http.StatusNotFound, []string{
+			"There are no docs for version 2.5.",
+			`<a href="/2.0/">2.0</a>, <a href="/2.1/">2.1</a>, <a href="/3.0/">3.0</a>, <a href="/4.0-SNAPSHOT/">4.0-SNAPSHOT</a>`,
+			`<a href="/3.0/">Go to the latest docs (3.0)</a>`,
+		}},
+		"/3.0/missing.html": {http.StatusNotFound, []string{
+			"Version 3.0 doesn&#39;t have a page at /missing.html.",
+			`<a href="/2.0/">2.0</a>, <a href="/2.1/">2.1</a>, <a href="/4.0-SNAPSHOT/">4.0-SNAPSHOT</a>`,
+		}},
+		"/1.0/overview-summary.html": {http.StatusNotFound, []string{
+			"There are no docs for version 1.0.",
+			`Try <a href="/2.0/">2.0</a>, <a href="/2.1/">2.1</a>.`,
+		}},
+	}
+	for pth, tp := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != tp.code {
+			t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, tp.code)
+		}
+		if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+			t.Errorf("Got: %s for %s, expected: text/html; charset=utf-8", ct, pth)
+		}
+		body := rec.Body.String()
+		for _, s := range tp.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("Got: %s for %s, expected it to contain %s", body, pth, s)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("HEAD", "/2.5/", nil))
+	if rec.Code != http.StatusNotFound || rec.Body.Len() != 0 {
+		t.Errorf("Got: %d with %d bytes for HEAD, expected: %d with none", rec.Code, rec.Body.Len(), http.StatusNotFound)
+	}
+
+	// versions we haven't fetched yet can't be fetched whilst the repository
+	// is down
+	atomic.StoreInt32(&tr.down, 1)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/2.0/overview-summary.html", nil))
+	if rec.Code != http.StatusBadGateway || !strings.Contains(rec.Body.String(), "We couldn&#39;t get the docs for version 2.0") {
+		t.Errorf("Got: %d with %s whilst the repository was down, expected: %d", rec.Code, rec.Body.String(), http.StatusBadGateway)
+	}
+}
+
+func TestJavadocHandlerErrorTemplates(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	atomic.StoreInt32(&tr.down, 1)
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval: time.Hour,
+		ErrorTemplates: map[int]*template.Template{
+			http.StatusServiceUnavailable: template.Must(template.New("503").Parse(`down: {{.Status}} {{.Path}}`)),
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Body.String() != "down: 503 /" {
+		t.Errorf("Got: %d with %q, expected: %d with %q", rec.Code, rec.Body.String(), http.StatusServiceUnavailable, "down: 503 /")
+	}
+
+	// other statuses still get the default
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/9.0/", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "There are no docs for version 9.0.") {
+		t.Errorf("Got: %d with %q, expected the default 404 page", rec.Code, rec.Body.String())
+	}
+}
@@ -0,0 +1,182 @@
+package javadocr
+
+import (
+	"github.com/lukegb/javadocr/maven"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// FallbackPolicy decides what happens when a page isn't in the version asked
+// for, but might be in another.
+type FallbackPolicy int
+
+const (
+	// FallbackOffer links to the page in the nearest version which has
+	// it from the 404 page.
+	FallbackOffer FallbackPolicy = iota
+	// FallbackRedirect redirects to the page in the nearest version which
+	// has it, if there is one.
+	FallbackRedirect
+	// FallbackOff doesn't look in other versions.
+	FallbackOff
+)
+
+// FallbackFetchInterval is the default for the corresponding field of Config.
+const FallbackFetchInterval = 10 * time.Second
+
+// LatestContainingPrefix is the first part of URLs which redirect to a page
+// in the newest version which has it, wherever it has been removed from
+// since; for instance /latest-containing/org/spongepowered/api/Game.html.
+const LatestContainingPrefix = "latest-containing"
+
+// sortedVersions returns the known versions, oldest first.
+func (h *JavadocHandler) sortedVersions() []maven.Coordinate {
+	h.versionsLock.RLock()
+	versions := make([]maven.Coordinate, len(h.versions))
+	copy(versions, h.versions)
+	h.versionsLock.RUnlock()
+
+	sort.SliceStable(versions, func(i, j int) bool {
+		return maven.CompareVersions(versions[i].Version, versions[j].Version) < 0
+	})
+	return versions
+}
+
+// cachedServer returns the ZipFileSystem for c if it is in the cache, even
+// if it's stale.
+func (h *JavadocHandler) cachedServer(c maven.Coordinate) *ZipFileSystem {
+	h.versionCacheLock.RLock()
+	defer h.versionCacheLock.RUnlock()
+	if jc, ok := h.versionCache[c]; ok {
+		return jc.server
+	}
+	return nil
+}
+
+// findContaining returns the first of candidates which has the page pth.
+// Versions which are already cached are always looked in, but only the
+// first FallbackFetches which aren't are downloaded, and then only if the
+// last such download was at least FallbackFetchInterval ago.
+func (h *JavadocHandler) findContaining(pth string, candidates []maven.Coordinate) (maven.Coordinate, bool) {
+	fetches := h.config.FallbackFetches
+	for _, c := range candidates {
+		zf := h.cachedServer(c)
+		if zf == nil {
+			if fetches <= 0 || !h.mayFallbackFetch() {
+				continue
+			}
+			fetches--
+
+			var err error
+			zf, _, _, err = h.fetchForCoordinate(c)
+			if err != nil {
+				continue
+			}
+		}
+		if _, err := fs.Stat(zf, fsPath(pth)); err == nil {
+			return c, true
+		}
+	}
+	return maven.Coordinate{}, false
+}
+
+// mayFallbackFetch reports whether findContaining may download a version
+// now, and if so counts it as having done so.
+func (h *JavadocHandler) mayFallbackFetch() bool {
+	h.fallbackLock.Lock()
+	defer h.fallbackLock.Unlock()
+	if time.Since(h.lastFallbackFetch) < h.config.FallbackFetchInterval {
+		return false
+	}
+	h.lastFallbackFetch = time.Now()
+	return true
+}
+
+// nearestContaining finds the version nearest to version which has the page
+// pth, looking at newer versions before older ones the same distance away.
+func (h *JavadocHandler) nearestContaining(version, pth string) (maven.Coordinate, bool) {
+	versions := h.sortedVersions()
+	at := sort.Search(len(versions), func(i int) bool {
+		return maven.CompareVersions(versions[i].Version, version) >= 0
+	})
+	older, newer := at-1, at
+	if newer < len(versions) && versions[newer].Version == version {
+		newer++
+	}
+
+	candidates := make([]maven.Coordinate, 0, len(versions))
+	for older >= 0 || newer < len(versions) {
+		if newer < len(versions) {
+			candidates = append(candidates, versions[newer])
+			newer++
+		}
+		if older >= 0 {
+			candidates = append(candidates, versions[older])
+			older--
+		}
+	}
+	return h.findContaining(pth, candidates)
+}
+
+// pageURL is the URL of the page pth in version, keeping the query from r if
+// it's given.
+func pageURL(version, pth string, r *http.Request) string {
+	u := "/" + url.PathEscape(version) + "/" + strings.TrimPrefix(pth, "/")
+	if r != nil && r.URL.RawQuery != "" {
+		u += "?" + r.URL.RawQuery
+	}
+	return u
+}
+
+// pageNotFound answers with the 404 page ep for the page pth, pointing at or
+// redirecting to the nearest version to ep.Version which does have it,
+// according to the Config's Fallbacks.
+func (h *JavadocHandler) pageNotFound(w http.ResponseWriter, r *http.Request, ep *ErrorPage, pth string) {
+	if h.config.Fallbacks != FallbackOff && strings.TrimPrefix(pth, "/") != "" {
+		if c, ok := h.nearestContaining(ep.Version, pth); ok {
+			if h.config.Fallbacks == FallbackRedirect {
+				http.Redirect(w, r, pageURL(c.Version, pth, r), http.StatusFound)
+				return
+			}
+			ep.Elsewhere = VersionLink{Version: c.Version, URL: pageURL(c.Version, pth, r)}
+		}
+	}
+	h.renderError(w, r, ep)
+}
+
+// serveLatestContaining redirects to the page pth in the newest version
+// which has it, ignoring SNAPSHOTs and excluded versions.
+func (h *JavadocHandler) serveLatestContaining(w http.ResponseWriter, r *http.Request, pth string) {
+	h.versionsLock.RLock()
+	candidates := make([]maven.Coordinate, 0, len(h.versions))
+	for n := len(h.versions) - 1; n >= 0; n-- {
+		vr := h.versions[n]
+		if excl, ok := h.excludeVersions[vr.Version]; !vr.IsSnapshot() && !(ok && excl) {
+			candidates = append(candidates, vr)
+		}
+	}
+	h.versionsLock.RUnlock()
+
+	if len(candidates) == 0 {
+		h.serveError(w, r, http.StatusServiceUnavailable, "", pth)
+		return
+	}
+	c, ok := h.findContaining(pth, candidates)
+	if !ok {
+		h.renderError(w, r, &ErrorPage{
+			Project:    h.config.Name,
+			Status:     http.StatusNotFound,
+			StatusText: http.StatusText(http.StatusNotFound),
+			Message:    "None of the versions we looked in have a page at " + pth + ".",
+			Path:       pth,
+			Latest:     candidates[0].Version,
+			LatestURL:  versionLink(candidates[0].Version).URL,
+		})
+		return
+	}
+	http.Redirect(w, r, pageURL(c.Version, pth, r), http.StatusFound)
+}
@@ -0,0 +1,175 @@
+package javadocr
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newFallbackTestHandler serves versions in which org/Old.html was removed
+// after 2.0, and org/New.html added in 4.0.
+func newFallbackTestHandler(t *testing.T, config Config) (*JavadocHandler, *testRepository) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0", "4.0")
+	for _, v := range tr.versions {
+		files := map[string]string{"overview-summary.html": "<html><body>" + v + "</body></html>"}
+		switch v {
+		case "1.0", "2.0":
+			files["org/Old.html"] = "old"
+		case "4.0":
+			files["org/New.html"] = "new"
+		}
+		tr.jars[v] = makeJar(t, files)
+	}
+	h := tr.handler(t, config)
+	// start with nothing cached, rather than with the latest version,
+	// which is fetched to find out what to redirect to it
+	h.background.Wait()
+	h.Invalidate("4.0")
+	atomic.StoreInt32(&tr.jarFetch, 0)
+	return h, tr
+}
+
+func TestJavadocHandlerFallbacks(t *testing.T) {
+	testPlan := map[string]struct {
+		config   Config
+		expected map[string]string
+	}{
+		"offer": {
+			Config{FallbackFetches: 3, FallbackFetchInterval: time.Nanosecond},
+			map[string]string{
+				"/3.0/org/Old.html":     `It's in <a href="/2.0/org/Old.html">version 2.0</a>`,
+				"/1.0/org/New.html":     `It's in <a href="/4.0/org/New.html">version 4.0</a>`,
+				"/3.0/org/Old.html?a=b": `It's in <a href="/2.0/org/Old.html?a=b">version 2.0</a>`,
+				"/3.0/org/Gone.html":    "Version 3.0 doesn&#39;t have a page at /org/Gone.html.",
+				"/2.5/org/Old.html":     "There are no docs for version 2.5.",
+			},
+		},
+		"redirect": {
+			Config{Fallbacks: FallbackRedirect, FallbackFetches: 3, FallbackFetchInterval: time.Nanosecond},
+			map[string]string{
+				"/3.0/org/Old.html?a=b": "/2.0/org/Old.html?a=b",
+				"/3.0/org/Gone.html":    "Version 3.0 doesn&#39;t have a page at /org/Gone.html.",
+				"/9.0/org/New.html":     "There are no docs for version 9.0.",
+			},
+		},
+		"off": {
+			Config{Fallbacks: FallbackOff},
+			map[string]string{
+				"/3.0/org/Old.html": "Version 3.0 doesn&#39;t have a page at /org/Old.html.",
+			},
+		},
+	}
+	for name, tp := range testPlan {
+		h, _ := newFallbackTestHandler(t, tp.config)
+		for pth, expected := range tp.expected {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+			if strings.HasPrefix(expected, "/") {
+				if rec.Code != http.StatusFound || rec.Header().Get("Location") != expected {
+					t.Errorf("%s: Got: %d to %s for %s, expected: %d to %s", name, rec.Code, rec.Header().Get("Location"), pth, http.StatusFound, expected)
+				}
+				continue
+			}
+			if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), expected) {
+				t.Errorf("%s: Got: %d with %s for %s, expected: %d with %s", name, rec.Code, rec.Body.String(), pth, http.StatusNotFound, expected)
+			}
+			if (name == "off" || strings.HasPrefix(expected, "There are no")) && strings.Contains(rec.Body.String(), "It's in") {
+				t.Errorf("%s: Got: %s for %s, expected no fallback", name, rec.Body.String(), pth)
+			}
+		}
+	}
+}
+
+func TestJavadocHandlerFallbackFetches(t *testing.T) {
+	h, _ := newFallbackTestHandler(t, Config{FallbackFetches: 1, FallbackFetchInterval: time.Nanosecond})
+
+	// 2.0 is the only one we're allowed to download
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/org/New.html", nil))
+	if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "It's in") {
+		t.Errorf("Got: %d with %s, expected a 404 without a fallback", rec.Code, rec.Body.String())
+	}
+
+	// but versions which are already cached can always be looked in
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/4.0/org/New.html", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Got: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/org/New.html", nil))
+	if !strings.Contains(rec.Body.String(), `It's in <a href="/4.0/org/New.html">version 4.0</a>`) {
+		t.Errorf("Got: %d with %s, expected a fallback to 4.0", rec.Code, rec.Body.String())
+	}
+}
+
+func TestJavadocHandlerFallbackFetchLimits(t *testing.T) {
+	h, tr := newFallbackTestHandler(t, Config{})
+	fetches := func() int32 { return atomic.LoadInt32(&tr.jarFetch) }
+
+	// junk isn't looked for anywhere
+	for _, pth := range []string{"/wp-admin/setup.php", "/9.0/org/Old.html"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != http.StatusNotFound {
+			t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, http.StatusNotFound)
+		}
+	}
+	if n := fetches(); n != 0 {
+		t.Errorf("Got: %d downloads for unknown versions, expected none", n)
+	}
+
+	// by default, only what's cached is looked in
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/3.0/org/Old.html", nil))
+	if rec.Code != http.StatusNotFound || strings.Contains(rec.Body.String(), "It's in") || fetches() != 1 {
+		t.Errorf("Got: %d with %s after %d downloads, expected a 404 without a fallback after 1", rec.Code, rec.Body.String(), fetches())
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/2.0/org/Old.html", nil))
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/3.0/org/Old.html", nil))
+	if !strings.Contains(rec.Body.String(), `It's in <a href="/2.0/org/Old.html">version 2.0</a>`) {
+		t.Errorf("Got: %s, expected a fallback to the cached 2.0", rec.Body.String())
+	}
+
+	// and downloads, once allowed, are spaced out
+	h, tr = newFallbackTestHandler(t, Config{FallbackFetches: 3, FallbackFetchInterval: time.Hour})
+	for _, pth := range []string{"/4.0/org/Old.html", "/3.0/org/New.html", "/1.0/org/Gone.html"} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+	}
+	// 4.0 and 1.0 as they were asked for, and 3.0 whilst looking for
+	// org/Old.html; 2.0 had to wait
+	if n := fetches(); n != 3 {
+		t.Errorf("Got: %d downloads, expected: 3", n)
+	}
+}
+
+func TestJavadocHandlerLatestContaining(t *testing.T) {
+	h, _ := newFallbackTestHandler(t, Config{ExcludeVersions: []string{"4.0"}, FallbackFetches: 4, FallbackFetchInterval: time.Nanosecond})
+
+	testPlan := map[string]string{
+		"/latest-containing/org/Old.html":          "/2.0/org/Old.html",
+		"/latest-containing/org/Old.html?a=b":      "/2.0/org/Old.html?a=b",
+		"/latest-containing/overview-summary.html": "/3.0/overview-summary.html",
+		"/latest-containing/org/":                  "/2.0/org/",
+	}
+	for pth, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != http.StatusFound || rec.Header().Get("Location") != expected {
+			t.Errorf("Got: %d to %s for %s, expected: %d to %s", rec.Code, rec.Header().Get("Location"), pth, http.StatusFound, expected)
+		}
+	}
+
+	// 4.0 is excluded, so doesn't count
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/latest-containing/org/New.html", nil))
+	if rec.Code != http.StatusNotFound || !strings.Contains(rec.Body.String(), "None of the versions we looked in have a page at /org/New.html.") {
+		t.Errorf("Got: %d with %s, expected: %d", rec.Code, rec.Body.String(), http.StatusNotFound)
+	}
+}
@@ -0,0 +1,81 @@
+package javadocr
+
+import (
+	"net/http"
+	"time"
+)
+
+// ReadinessWindow is the default for Config.ReadinessWindow.
+const ReadinessWindow = 5 * time.Minute
+
+// Health describes whether a JavadocHandler is able to serve its project.
+type Health struct {
+	// Ready is true once the list of versions has been fetched, for as
+	// long as the repository keeps answering within the readiness window.
+	Ready bool `json:"ready"`
+	// Populated is true once the list of versions has been fetched.
+	Populated bool `json:"populated"`
+	Versions  int  `json:"versions"`
+	// LastReachable is when the repository last answered us.
+	LastReachable *time.Time `json:"last_reachable,omitempty"`
+	DegradedSince *time.Time `json:"degraded_since,omitempty"`
+}
+
+// Health reports on whether the handler is ready to serve its project.
+func (h *JavadocHandler) Health() Health {
+	var hl Health
+
+	h.versionsLock.RLock()
+	hl.Versions = len(h.versions)
+	h.versionsLock.RUnlock()
+
+	h.upstreamLock.RLock()
+	hl.Populated = h.populated
+	if !h.lastReachable.IsZero() {
+		lastReachable := h.lastReachable
+		hl.LastReachable = &lastReachable
+	}
+	if !h.degradedSince.IsZero() {
+		degradedSince := h.degradedSince
+		hl.DegradedSince = &degradedSince
+	}
+	h.upstreamLock.RUnlock()
+
+	hl.Ready = hl.Populated && hl.LastReachable != nil && time.Since(*hl.LastReachable) <= h.config.ReadinessWindow
+	return hl
+}
+
+// HealthHandler answers liveness checks: if it's serving at all, the process
+// is alive.
+type HealthHandler struct{}
+
+func (HealthHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, struct {
+		Status string `json:"status"`
+	}{"ok"})
+}
+
+// ReadinessHandler answers readiness checks. It responds with 200 if every
+// project is ready, and 503 otherwise, along with the Health of each.
+type ReadinessHandler struct {
+	Projects Projects
+}
+
+func (rh ReadinessHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ready := true
+	projects := make(map[string]Health, len(rh.Projects))
+	for name, h := range rh.Projects {
+		hl := h.Health()
+		ready = ready && hl.Ready
+		projects[name] = hl
+	}
+
+	code, status := http.StatusOK, "ready"
+	if !ready {
+		code, status = http.StatusServiceUnavailable, "not ready"
+	}
+	writeJSON(w, code, struct {
+		Status   string            `json:"status"`
+		Projects map[string]Health `json:"projects"`
+	}{status, projects})
+}
@@ -0,0 +1,78 @@
+package javadocr
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadinessStartingDegraded(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	atomic.StoreInt32(&tr.down, 1)
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{Name: "spongeapi", GCInterval: time.Hour})
+	if err != nil {
+		t.Fatalf("didn't start whilst the repository was down: %v", err)
+	}
+	defer h.Close()
+	rh := ReadinessHandler{Projects: Projects{"spongeapi": h}}
+
+	rec := httptest.NewRecorder()
+	rh.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Got: %d for the latest version with no versions known, expected: %d", rec.Code, http.StatusServiceUnavailable)
+	}
+
+	atomic.StoreInt32(&tr.down, 0)
+	h.TriggerRefresh()
+	deadline := time.Now().Add(5 * time.Second)
+	for !h.Health().Ready {
+		if time.Now().After(deadline) {
+			t.Fatal("didn't become ready after the repository came back")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	rec = httptest.NewRecorder()
+	rh.ServeHTTP(rec, httptest.NewRequest("GET", "/readyz", nil))
+	if rec.Code != http.StatusOK {
+		t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusOK)
+	}
+	var body struct {
+		Status   string
+		Projects map[string]Health
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if hl := body.Projects["spongeapi"]; !hl.Ready || !hl.Populated || hl.Versions != 2 || hl.DegradedSince != nil {
+		t.Errorf("Got: %#v", hl)
+	}
+}
+
+func TestReadinessWindow(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, ReadinessWindow: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	if !h.Health().Ready {
+		t.Fatal("wasn't ready after fetching versions")
+	}
+
+	h.upstreamLock.Lock()
+	h.lastReachable = time.Now().Add(-2 * time.Minute)
+	h.upstreamLock.Unlock()
+	if h.Health().Ready {
+		t.Error("still ready after not hearing from the repository for longer than the window")
+	}
+}
@@ -0,0 +1,478 @@
+package javadocr
+
+import (
+	"bufio"
+	"compress/flate"
+	"errors"
+	"io"
+)
+
+// This is a deliberately simple DEFLATE (RFC 1951) decoder, after Mark
+// Adler's puff.c. It is only used to find where blocks start, so that reading
+// a deflated entry can later be resumed from near any offset with
+// compress/flate; compress/flate does all the decompression we actually
+// serve.
+
+const (
+	maxCodeBits  = 15
+	maxLitCodes  = 286
+	maxDistCodes = 30
+	windowSize   = 32 * 1024
+)
+
+var errCorruptDeflate = errors.New("javadocr: corrupt deflate stream")
+
+var (
+	lengthBase  = [...]uint16{3, 4, 5, 6, 7, 8, 9, 10, 11, 13, 15, 17, 19, 23, 27, 31, 35, 43, 51, 59, 67, 83, 99, 115, 131, 163, 195, 227, 258}
+	lengthExtra = [...]uint8{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 0}
+	distBase    = [...]uint16{1, 2, 3, 4, 5, 7, 9, 13, 17, 25, 33, 49, 65, 97, 129, 193, 257, 385, 513, 769, 1025, 1537, 2049, 3073, 4097, 6145, 8193, 12289, 16385, 24577}
+	distExtra   = [...]uint8{0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 6, 7, 7, 8, 8, 9, 9, 10, 10, 11, 11, 12, 12, 13, 13}
+	// the order in which code length code lengths are given
+	codeLengthOrder = [...]uint8{16, 17, 18, 0, 8, 7, 9, 6, 10, 5, 11, 4, 12, 3, 13, 2, 14, 1, 15}
+)
+
+// huffman is a canonical Huffman code: how many codes there are of each
+// length, and the symbols in code order.
+type huffman struct {
+	count  [maxCodeBits + 1]uint16
+	symbol []uint16
+}
+
+// build sets up h from the code length of each symbol. Incomplete codes are
+// allowed, since a single distance code is.
+func (h *huffman) build(lengths []uint8) error {
+	h.count = [maxCodeBits + 1]uint16{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	if int(h.count[0]) == len(lengths) {
+		// no codes at all
+		h.symbol = h.symbol[:0]
+		return nil
+	}
+
+	left := 1
+	for l := 1; l <= maxCodeBits; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return errCorruptDeflate
+		}
+	}
+
+	var offs [maxCodeBits + 1]uint16
+	for l := 1; l < maxCodeBits; l++ {
+		offs[l+1] = offs[l] + h.count[l]
+	}
+	h.symbol = make([]uint16, len(lengths))
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbol[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	return nil
+}
+
+// inflateCheckpoint is somewhere a deflate stream can be resumed from: the
+// start of a block, and the window of output before it.
+type inflateCheckpoint struct {
+	// bit is the offset into the compressed data, in bits.
+	bit int64
+	// out is the offset into the decompressed data.
+	out    int64
+	window []byte
+}
+
+// indexer decodes a deflate stream, noting checkpoints as it goes.
+type indexer struct {
+	r       io.ByteReader
+	bitBuf  uint32
+	bitCnt  uint
+	bytesIn int64
+
+	out    int64
+	window [windowSize]byte
+
+	lit, dist huffman
+
+	spacing     int64
+	checkpoints []inflateCheckpoint
+}
+
+func (ix *indexer) bits(n uint) (uint32, error) {
+	for ix.bitCnt < n {
+		b, err := ix.r.ReadByte()
+		if err == io.EOF {
+			return 0, io.ErrUnexpectedEOF
+		} else if err != nil {
+			return 0, err
+		}
+		ix.bytesIn++
+		ix.bitBuf |= uint32(b) << ix.bitCnt
+		ix.bitCnt += 8
+	}
+	v := ix.bitBuf & (1<<n - 1)
+	ix.bitBuf >>= n
+	ix.bitCnt -= n
+	return v, nil
+}
+
+// bitOffset is how many bits of the compressed data have been consumed.
+func (ix *indexer) bitOffset() int64 {
+	return ix.bytesIn*8 - int64(ix.bitCnt)
+}
+
+func (ix *indexer) emit(b byte) {
+	ix.window[ix.out%windowSize] = b
+	ix.out++
+}
+
+func (ix *indexer) decode(h *huffman) (uint16, error) {
+	code, first, index := 0, 0, 0
+	for l := 1; l <= maxCodeBits; l++ {
+		b, err := ix.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return h.symbol[index+(code-first)], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errCorruptDeflate
+}
+
+func (ix *indexer) checkpoint() {
+	last := int64(0)
+	if n := len(ix.checkpoints); n > 0 {
+		last = ix.checkpoints[n-1].out
+	}
+	if ix.out-last < ix.spacing {
+		return
+	}
+
+	n := ix.out
+	if n > windowSize {
+		n = windowSize
+	}
+	window := make([]byte, n)
+	for i := range window {
+		window[i] = ix.window[(ix.out-n+int64(i))%windowSize]
+	}
+	ix.checkpoints = append(ix.checkpoints, inflateCheckpoint{bit: ix.bitOffset(), out: ix.out, window: window})
+}
+
+func (ix *indexer) run() error {
+	for {
+		ix.checkpoint()
+
+		final, err := ix.bits(1)
+		if err != nil {
+			return err
+		}
+		typ, err := ix.bits(2)
+		if err != nil {
+			return err
+		}
+		switch typ {
+		case 0:
+			err = ix.stored()
+		case 1:
+			err = ix.fixed()
+		case 2:
+			err = ix.dynamic()
+		default:
+			err = errCorruptDeflate
+		}
+		if err != nil {
+			return err
+		}
+		if final == 1 {
+			return nil
+		}
+	}
+}
+
+func (ix *indexer) stored() error {
+	// stored blocks start on a byte boundary
+	ix.bitBuf, ix.bitCnt = 0, 0
+	v, err := ix.bits(32)
+	if err != nil {
+		return err
+	}
+	length, nlength := uint16(v), uint16(v>>16)
+	if length != ^nlength {
+		return errCorruptDeflate
+	}
+	for ; length > 0; length-- {
+		b, err := ix.r.ReadByte()
+		if err == io.EOF {
+			return io.ErrUnexpectedEOF
+		} else if err != nil {
+			return err
+		}
+		ix.bytesIn++
+		ix.emit(b)
+	}
+	return nil
+}
+
+var fixedLit, fixedDist huffman
+
+func init() {
+	var lengths [288]uint8
+	for n := range lengths {
+		switch {
+		case n < 144:
+			lengths[n] = 8
+		case n < 256:
+			lengths[n] = 9
+		case n < 280:
+			lengths[n] = 7
+		default:
+			lengths[n] = 8
+		}
+	}
+	fixedLit.build(lengths[:])
+
+	var distLengths [maxDistCodes]uint8
+	for n := range distLengths {
+		distLengths[n] = 5
+	}
+	fixedDist.build(distLengths[:])
+}
+
+func (ix *indexer) fixed() error {
+	return ix.codes(&fixedLit, &fixedDist)
+}
+
+func (ix *indexer) dynamic() error {
+	v, err := ix.bits(14)
+	if err != nil {
+		return err
+	}
+	nlen, ndist, ncode := int(v&0x1f)+257, int(v>>5&0x1f)+1, int(v>>10)+4
+	if nlen > maxLitCodes || ndist > maxDistCodes {
+		return errCorruptDeflate
+	}
+
+	var lengths [maxLitCodes + maxDistCodes]uint8
+	for n := 0; n < ncode; n++ {
+		l, err := ix.bits(3)
+		if err != nil {
+			return err
+		}
+		lengths[codeLengthOrder[n]] = uint8(l)
+	}
+	var lencode huffman
+	if err := lencode.build(lengths[:19]); err != nil {
+		return err
+	}
+	for n := range lengths[:19] {
+		lengths[n] = 0
+	}
+
+	for n := 0; n < nlen+ndist; {
+		sym, err := ix.decode(&lencode)
+		if err != nil {
+			return err
+		}
+		if sym < 16 {
+			lengths[n] = uint8(sym)
+			n++
+			continue
+		}
+
+		var l uint8
+		var rep uint32
+		switch sym {
+		case 16:
+			if n == 0 {
+				return errCorruptDeflate
+			}
+			l = lengths[n-1]
+			rep, err = ix.bits(2)
+			rep += 3
+		case 17:
+			rep, err = ix.bits(3)
+			rep += 3
+		default:
+			rep, err = ix.bits(7)
+			rep += 11
+		}
+		if err != nil {
+			return err
+		}
+		if n+int(rep) > nlen+ndist {
+			return errCorruptDeflate
+		}
+		for ; rep > 0; rep-- {
+			lengths[n] = l
+			n++
+		}
+	}
+	if lengths[256] == 0 {
+		// there has to be an end of block code
+		return errCorruptDeflate
+	}
+
+	if err := ix.lit.build(lengths[:nlen]); err != nil {
+		return err
+	}
+	if err := ix.dist.build(lengths[nlen : nlen+ndist]); err != nil {
+		return err
+	}
+	return ix.codes(&ix.lit, &ix.dist)
+}
+
+func (ix *indexer) codes(lit, dist *huffman) error {
+	for {
+		sym, err := ix.decode(lit)
+		if err != nil {
+			return err
+		}
+		if sym < 256 {
+			ix.emit(byte(sym))
+			continue
+		}
+		if sym == 256 {
+			return nil
+		}
+
+		sym -= 257
+		if int(sym) >= len(lengthBase) {
+			return errCorruptDeflate
+		}
+		extra, err := ix.bits(uint(lengthExtra[sym]))
+		if err != nil {
+			return err
+		}
+		length := int64(lengthBase[sym]) + int64(extra)
+
+		dsym, err := ix.decode(dist)
+		if err != nil {
+			return err
+		}
+		if int(dsym) >= len(distBase) {
+			return errCorruptDeflate
+		}
+		extra, err = ix.bits(uint(distExtra[dsym]))
+		if err != nil {
+			return err
+		}
+		distance := int64(distBase[dsym]) + int64(extra)
+		if distance > ix.out {
+			return errCorruptDeflate
+		}
+
+		for ; length > 0; length-- {
+			ix.emit(ix.window[(ix.out-distance)%windowSize])
+		}
+	}
+}
+
+// buildInflateIndex finds checkpoints roughly every spacing bytes of output
+// through the deflate stream r.
+func buildInflateIndex(r io.Reader, spacing int64) ([]inflateCheckpoint, error) {
+	ix := &indexer{
+		r:       bufio.NewReader(r),
+		spacing: spacing,
+		// the start of the stream is always a checkpoint
+		checkpoints: []inflateCheckpoint{{}},
+	}
+	if err := ix.run(); err != nil {
+		return nil, err
+	}
+	return ix.checkpoints, nil
+}
+
+// inflateIndexSize is roughly how much memory the checkpoints in an index
+// take up, which is mostly their windows.
+func inflateIndexSize(cps []inflateCheckpoint) int64 {
+	var size int64
+	for _, cp := range cps {
+		// the two offsets and the window's slice header, then the
+		// window itself
+		size += 40 + int64(len(cp.window))
+	}
+	return size
+}
+
+// bitShiftReader reads a stream of bytes starting shift bits into the first.
+// Since DEFLATE packs bits starting with the least significant, this turns a
+// block which starts part-way through a byte into a stream which
+// compress/flate can read.
+type bitShiftReader struct {
+	r     io.ByteReader
+	shift uint
+	cur   byte
+	eof   bool
+}
+
+func newBitShiftReader(r io.ByteReader, shift uint) (*bitShiftReader, error) {
+	bsr := &bitShiftReader{r: r, shift: shift}
+	b, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	bsr.cur = b
+	return bsr, nil
+}
+
+func (bsr *bitShiftReader) Read(p []byte) (int, error) {
+	if bsr.shift == 0 {
+		// nothing to shift, just pass the bytes on
+		n := 0
+		for ; n < len(p) && !bsr.eof; n++ {
+			p[n] = bsr.cur
+			b, err := bsr.r.ReadByte()
+			if err == io.EOF {
+				bsr.eof = true
+			} else if err != nil {
+				return n + 1, err
+			}
+			bsr.cur = b
+		}
+		if n == 0 && bsr.eof {
+			return 0, io.EOF
+		}
+		return n, nil
+	}
+
+	n := 0
+	for ; n < len(p); n++ {
+		if bsr.eof {
+			if n == 0 {
+				return 0, io.EOF
+			}
+			return n, nil
+		}
+		next, err := bsr.r.ReadByte()
+		if err == io.EOF {
+			bsr.eof = true
+			next = 0
+		} else if err != nil {
+			return n, err
+		}
+		p[n] = bsr.cur>>bsr.shift | next<<(8-bsr.shift)
+		bsr.cur = next
+	}
+	return n, nil
+}
+
+// resumeInflate returns a reader of the decompressed data of the deflate
+// stream raw from checkpoint cp onwards.
+func resumeInflate(raw *io.SectionReader, cp inflateCheckpoint) (io.ReadCloser, error) {
+	sr := io.NewSectionReader(raw, cp.bit/8, raw.Size()-cp.bit/8)
+	bsr, err := newBitShiftReader(bufio.NewReader(sr), uint(cp.bit%8))
+	if err != nil {
+		return nil, err
+	}
+	return flate.NewReaderDict(bsr, cp.window), nil
+}
@@ -0,0 +1,189 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"testing"
+)
+
+// testDeflateInputs are things to deflate which between them use every kind
+// of block.
+func testDeflateInputs() map[string][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	random := make([]byte, 300*1024)
+	rnd.Read(random)
+
+	var javadoc strings.Builder
+	for n := 0; javadoc.Len() < 2*1024*1024; n++ {
+		fmt.Fprintf(&javadoc, `<tr class="rowColor"><td class="colFirst"><a href="org/spongepowered/api/Thing%d.html">Thing%d</a></td><td>%d</td></tr>`+"\n", n, n, rnd.Intn(1000))
+	}
+
+	return map[string][]byte{
+		"empty":   {},
+		"short":   []byte("hello, world"),
+		"random":  random,
+		"javadoc": []byte(javadoc.String()),
+	}
+}
+
+func deflate(t testing.TB, data []byte, level int) []byte {
+	var buf bytes.Buffer
+	fw, err := flate.NewWriter(&buf, level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fw.Write(data)
+	fw.Close()
+	return buf.Bytes()
+}
+
+func TestInflateIndexResumes(t *testing.T) {
+	for name, data := range testDeflateInputs() {
+		for _, level := range []int{flate.NoCompression, flate.BestSpeed, flate.DefaultCompression, flate.HuffmanOnly} {
+			compressed := deflate(t, data, level)
+			raw := io.NewSectionReader(bytes.NewReader(compressed), 0, int64(len(compressed)))
+			cps, err := buildInflateIndex(raw, 64*1024)
+			if err != nil {
+				t.Fatalf("%s at level %d: %v", name, level, err)
+			}
+			if len(data) > 256*1024 && len(cps) < 2 {
+				t.Errorf("%s at level %d: Got %d checkpoints", name, level, len(cps))
+			}
+
+			for _, cp := range cps {
+				fr, err := resumeInflate(raw, cp)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := io.ReadAll(fr)
+				if err != nil {
+					t.Fatalf("%s at level %d, resuming from %d: %v", name, level, cp.out, err)
+				}
+				if !bytes.Equal(got, data[cp.out:]) {
+					t.Errorf("%s at level %d: resuming from %d didn't match", name, level, cp.out)
+				}
+			}
+		}
+	}
+}
+
+func TestInflateIndexRejectsCorruption(t *testing.T) {
+	compressed := deflate(t, testDeflateInputs()["javadoc"], flate.DefaultCompression)
+	if _, err := buildInflateIndex(bytes.NewReader(compressed[:len(compressed)/2]), 64*1024); err == nil {
+		t.Error("Got no error for a truncated stream")
+	}
+	if _, err := buildInflateIndex(bytes.NewReader([]byte{0xff, 0xff, 0xff}), 64*1024); err == nil {
+		t.Error("Got no error for a reserved block type")
+	}
+}
+
+func TestZipFileSeek(t *testing.T) {
+	page := string(testDeflateInputs()["javadoc"])
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{"index-all.html": page})
+	stored := newTestZipFileSystem(t, zip.Store, map[string]string{"index-all.html": page})
+
+	for name, zfs := range map[string]*ZipFileSystem{"deflated": zfs, "stored": stored} {
+		file, err := zfs.Open("index-all.html")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		f := file.(io.ReadSeeker)
+
+		// jump around, backwards and forwards, near and far
+		for _, offset := range []int64{1500000, 10, 1500100, 600000, 2000000, 0, int64(len(page)) - 5, 300000} {
+			if _, err := f.Seek(offset, io.SeekStart); err != nil {
+				t.Fatal(err)
+			}
+			buf := make([]byte, 100)
+			n, err := io.ReadFull(f, buf)
+			if err != nil && err != io.ErrUnexpectedEOF {
+				t.Fatalf("%s: reading at %d: %v", name, offset, err)
+			}
+			if expected := page[offset:min(offset+100, int64(len(page)))]; string(buf[:n]) != expected {
+				t.Errorf("%s: Got: %q at %d, expected: %q", name, buf[:n], offset, expected)
+			}
+		}
+
+		// relative seeks are relative to the last seek
+		f.Seek(1000, io.SeekStart)
+		if pos, _ := f.Seek(10, io.SeekCurrent); pos != 1010 {
+			t.Errorf("%s: Got: %d, expected: 1010", name, pos)
+		}
+
+		f.Seek(int64(len(page))+10, io.SeekStart)
+		if n, err := f.Read(make([]byte, 10)); n != 0 || err != io.EOF {
+			t.Errorf("%s: Got: %d, %v reading past the end", name, n, err)
+		}
+	}
+}
+
+func TestZipFileInflateIndexIsAccounted(t *testing.T) {
+	page := string(testDeflateInputs()["javadoc"])
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{"index-all.html": page})
+	file, err := zfs.Open("index-all.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if zfs.VariantBytes() != 0 {
+		t.Fatalf("Got %d variant bytes before seeking", zfs.VariantBytes())
+	}
+
+	f := file.(io.ReadSeeker)
+	f.Seek(int64(len(page))-100, io.SeekStart)
+	if _, err := io.ReadFull(f, make([]byte, 100)); err != nil {
+		t.Fatal(err)
+	}
+	zf := zfs.served("/index-all.html").(*ZipFile)
+	if expected := inflateIndexSize(zf.index); zfs.VariantBytes() != expected || expected < windowSize {
+		t.Errorf("Got %d variant bytes, expected %d for the inflate index", zfs.VariantBytes(), expected)
+	}
+}
+
+func benchmarkZipFileSeek(b *testing.B, zfs *ZipFileSystem, size int64) {
+	file, err := zfs.Open("index-all.html")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer file.Close()
+	f := file.(io.ReadSeeker)
+
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, 4096)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		f.Seek(rnd.Int63n(size-int64(len(buf))), io.SeekStart)
+		if _, err := io.ReadFull(f, buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkZipFileSeekDeflated(b *testing.B) {
+	page := testDeflateInputs()["javadoc"]
+	benchmarkZipFileSeek(b, newTestZipFileSystem(b, zip.Deflate, map[string]string{"index-all.html": string(page)}), int64(len(page)))
+}
+
+func BenchmarkZipFileSeekStored(b *testing.B) {
+	page := testDeflateInputs()["javadoc"]
+	benchmarkZipFileSeek(b, newTestZipFileSystem(b, zip.Store, map[string]string{"index-all.html": string(page)}), int64(len(page)))
+}
+
+func BenchmarkInflateIndex(b *testing.B) {
+	page := testDeflateInputs()["javadoc"]
+	compressed := deflate(b, page, flate.DefaultCompression)
+	b.SetBytes(int64(len(page)))
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		if _, err := buildInflateIndex(bytes.NewReader(compressed), inflateCheckpointSpacing); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io/fs"
+	"strings"
+)
+
+// These are the defaults for the corresponding fields of Limits.
+const (
+	MaxArchiveEntries   = 200000
+	MaxUncompressedSize = 2 * 1024 * 1024 * 1024
+	MaxEntrySize        = 256 * 1024 * 1024
+	MaxCompressionRatio = 200
+)
+
+// ratioExemptSize is the size below which entries aren't held to
+// MaxCompressionRatio; however well they compress, they can't do much harm.
+const ratioExemptSize = 1024 * 1024
+
+// ErrBadArchive is matched by every ArchiveError when used with errors.Is.
+var ErrBadArchive = errors.New("bad archive")
+
+// ArchiveError is returned when an artifact is rejected for going over its
+// Limits, or for containing entries which could be malicious.
+type ArchiveError struct {
+	// Entry is the name of the offending entry, or empty if the problem
+	// is with the archive as a whole.
+	Entry  string
+	Reason string
+}
+
+func (e *ArchiveError) Error() string {
+	if e.Entry == "" {
+		return fmt.Sprintf("rejecting archive: %s", e.Reason)
+	}
+	return fmt.Sprintf("rejecting archive: %q %s", e.Entry, e.Reason)
+}
+
+func (e *ArchiveError) Is(target error) bool {
+	return target == ErrBadArchive
+}
+
+// Limits bound what a ZipFileSystem will accept from an archive, so that a
+// zip bomb in the repository can't exhaust our memory. Sizes are in bytes,
+// and are those the archive claims for its entries, which archive/zip
+// holds them to when they are read. Any fields left as zero take their
+// defaults from the package constants.
+type Limits struct {
+	// MaxEntries is the most files and folders the archive may contain.
+	MaxEntries int
+	// MaxUncompressedSize is the most that every entry may come to when
+	// uncompressed, and also the largest the archive itself may be.
+	MaxUncompressedSize int64
+	// MaxEntrySize is the most a single entry may come to when
+	// uncompressed.
+	MaxEntrySize int64
+	// MaxCompressionRatio is how many times bigger than its compressed
+	// size an entry of a megabyte or more may be.
+	MaxCompressionRatio int64
+}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxEntries == 0 {
+		l.MaxEntries = MaxArchiveEntries
+	}
+	if l.MaxUncompressedSize == 0 {
+		l.MaxUncompressedSize = MaxUncompressedSize
+	}
+	if l.MaxEntrySize == 0 {
+		l.MaxEntrySize = MaxEntrySize
+	}
+	if l.MaxCompressionRatio == 0 {
+		l.MaxCompressionRatio = MaxCompressionRatio
+	}
+	return l
+}
+
+// checkEntry makes sure a single entry is within the limits and is something
+// we're willing to serve. It returns the entry's name without any trailing
+// slash, which is a valid fs.FS path.
+func (l Limits) checkEntry(f *zip.File) (string, error) {
+	name := strings.TrimSuffix(f.Name, "/")
+	if !fs.ValidPath(name) || name == "." || strings.Contains(name, `\`) {
+		return "", &ArchiveError{Entry: f.Name, Reason: "has a name which isn't a plain relative path"}
+	}
+
+	mode := f.Mode()
+	if mode&fs.ModeSymlink != 0 {
+		return "", &ArchiveError{Entry: f.Name, Reason: "is a symlink"}
+	}
+	if mode.Type() != 0 && !mode.IsDir() {
+		return "", &ArchiveError{Entry: f.Name, Reason: "isn't a regular file"}
+	}
+
+	size := f.UncompressedSize64
+	if size > uint64(l.MaxEntrySize) {
+		return "", &ArchiveError{Entry: f.Name, Reason: fmt.Sprintf("is %d bytes uncompressed, more than the limit of %d", size, l.MaxEntrySize)}
+	}
+	if size >= ratioExemptSize && size/uint64(l.MaxCompressionRatio) > f.CompressedSize64 {
+		return "", &ArchiveError{Entry: f.Name, Reason: fmt.Sprintf("compresses %d bytes into %d, more than the limit of %d:1", size, f.CompressedSize64, l.MaxCompressionRatio)}
+	}
+	return name, nil
+}
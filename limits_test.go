@@ -0,0 +1,186 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// craftedEntry is an entry for craftJar, which is written as-is.
+type craftedEntry struct {
+	header zip.FileHeader
+	data   string
+}
+
+// craftJar builds a zip file with entries that zip.Writer would normally
+// stop us from writing, such as ones which lie about their size.
+func craftJar(t *testing.T, entries ...craftedEntry) *zip.Reader {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		fh := e.header
+		if fh.CompressedSize64 == 0 && fh.UncompressedSize64 == 0 {
+			fh.CompressedSize64 = uint64(len(e.data))
+			fh.UncompressedSize64 = uint64(len(e.data))
+		}
+		w, err := zw.CreateRaw(&fh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write([]byte(e.data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return newZipReader(t, buf.Bytes())
+}
+
+func TestZipFileSystemLimits(t *testing.T) {
+	symlink := zip.FileHeader{Name: "org/Foo.html"}
+	symlink.SetMode(fs.ModeSymlink | 0777)
+	device := zip.FileHeader{Name: "org/Foo.html"}
+	device.SetMode(fs.ModeDevice | 0666)
+
+	bomb := bytes.Repeat([]byte{0}, 4*1024*1024)
+	bombJar := makeJar(t, map[string]string{"index.html": string(bomb)})
+
+	testPlan := map[string]struct {
+		zr     *zip.Reader
+		limits Limits
+		entry  string
+	}{
+		"parent": {
+			zr:    craftJar(t, craftedEntry{zip.FileHeader{Name: "../index.html"}, "x"}),
+			entry: "../index.html",
+		},
+		"parent inside": {
+			zr:    craftJar(t, craftedEntry{zip.FileHeader{Name: "org/../../index.html"}, "x"}),
+			entry: "org/../../index.html",
+		},
+		"absolute": {
+			zr:    craftJar(t, craftedEntry{zip.FileHeader{Name: "/etc/passwd"}, "x"}),
+			entry: "/etc/passwd",
+		},
+		"backslash": {
+			zr:    craftJar(t, craftedEntry{zip.FileHeader{Name: `..\index.html`}, "x"}),
+			entry: `..\index.html`,
+		},
+		"symlink": {
+			zr:    craftJar(t, craftedEntry{symlink, "/etc/passwd"}),
+			entry: "org/Foo.html",
+		},
+		"device": {
+			zr:    craftJar(t, craftedEntry{device, ""}),
+			entry: "org/Foo.html",
+		},
+		"duplicate": {
+			zr: craftJar(t,
+				craftedEntry{zip.FileHeader{Name: "org/Foo.html"}, "foo"},
+				craftedEntry{zip.FileHeader{Name: "org/Foo.html"}, "evil"},
+			),
+			entry: "org/Foo.html",
+		},
+		"file then folder": {
+			zr: craftJar(t,
+				craftedEntry{zip.FileHeader{Name: "org"}, "foo"},
+				craftedEntry{zip.FileHeader{Name: "org/Foo.html"}, "foo"},
+			),
+			entry: "org/Foo.html",
+		},
+		"folder then file": {
+			zr: craftJar(t,
+				craftedEntry{zip.FileHeader{Name: "org/Foo.html"}, "foo"},
+				craftedEntry{zip.FileHeader{Name: "org"}, "foo"},
+			),
+			entry: "org",
+		},
+		"entries": {
+			zr:     craftJar(t, craftedEntry{zip.FileHeader{Name: "a"}, "a"}, craftedEntry{zip.FileHeader{Name: "b"}, "b"}, craftedEntry{zip.FileHeader{Name: "c"}, "c"}),
+			limits: Limits{MaxEntries: 2},
+		},
+		"total size": {
+			zr:     craftJar(t, craftedEntry{zip.FileHeader{Name: "a"}, "aaaaaa"}, craftedEntry{zip.FileHeader{Name: "b"}, "bbbbbb"}),
+			limits: Limits{MaxUncompressedSize: 10},
+		},
+		"entry size": {
+			zr:     craftJar(t, craftedEntry{zip.FileHeader{Name: "a"}, "aaaaaa"}),
+			limits: Limits{MaxEntrySize: 5},
+			entry:  "a",
+		},
+		"claimed size": {
+			zr: craftJar(t, craftedEntry{zip.FileHeader{
+				Name:               "index.html",
+				Method:             zip.Deflate,
+				CompressedSize64:   3,
+				UncompressedSize64: 1 << 40,
+			}, "\x03\x00\x00"}),
+			entry: "index.html",
+		},
+		"ratio": {
+			zr:    newZipReader(t, bombJar),
+			entry: "index.html",
+		},
+	}
+	for name, tp := range testPlan {
+		zfs, err := NewZipFileSystemWithLimits(tp.zr, tp.limits)
+		if zfs != nil || !errors.Is(err, ErrBadArchive) {
+			t.Errorf("%s: Got: %v, %v, expected an archive error", name, zfs, err)
+			continue
+		}
+		var ae *ArchiveError
+		if !errors.As(err, &ae) || ae.Entry != tp.entry {
+			t.Errorf("%s: Got: %v, expected it to be about %q", name, err, tp.entry)
+		}
+	}
+
+	// a folder with an entry of its own is fine, as are files which
+	// compress well if they're small
+	zr := craftJar(t,
+		craftedEntry{zip.FileHeader{Name: "org/"}, ""},
+		craftedEntry{zip.FileHeader{Name: "org/Foo.html"}, "foo"},
+	)
+	if _, err := NewZipFileSystem(zr); err != nil {
+		t.Errorf("Got: %v for a folder entry, expected no error", err)
+	}
+	small := makeJar(t, map[string]string{"index.html": string(bomb[:64*1024])})
+	if _, err := NewZipFileSystem(newZipReader(t, small)); err != nil {
+		t.Errorf("Got: %v for a small, compressible file, expected no error", err)
+	}
+}
+
+func TestJavadocHandlerRejectsBadArchive(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{"index.html": string(bytes.Repeat([]byte{0}, 4*1024*1024))})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/index.html", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusBadGateway)
+	}
+	if degraded, _ := h.Degraded(); degraded {
+		t.Error("Got degraded, expected a bad archive not to count as the repository being down")
+	}
+
+	h, err = NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, ArchiveLimits: Limits{MaxUncompressedSize: 1024}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/index.html", nil))
+	if rec.Code != http.StatusBadGateway {
+		t.Errorf("Got: %d for an oversized download, expected: %d", rec.Code, http.StatusBadGateway)
+	}
+}
@@ -0,0 +1,179 @@
+package javadocr
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+)
+
+// ListingPolicy decides what is served for folders in an artifact which
+// have no index.html.
+type ListingPolicy int
+
+const (
+	// ListingsStyled renders the Config's ListingTemplate.
+	ListingsStyled ListingPolicy = iota
+	// ListingsOff serves a 404 instead of a listing.
+	ListingsOff
+)
+
+// Listing is what a ListingTemplate is executed with.
+type Listing struct {
+	Project string
+	Version string
+	// Root is the URL of the top of this version's docs.
+	Root string
+	// Path is the folder being listed, relative to Root, with a trailing
+	// slash unless it is Root itself.
+	Path        string
+	Breadcrumbs []ListingLink
+	Entries     []ListingEntry
+}
+
+// ListingLink is one of the folders above the one being listed.
+type ListingLink struct {
+	Name string
+	URL  string
+}
+
+// ListingEntry is a file or folder inside the one being listed.
+type ListingEntry struct {
+	Name    string
+	URL     string
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// HumanSize is the size of the entry in bytes, KiB or MiB.
+func (le ListingEntry) HumanSize() string {
+	switch {
+	case le.IsDir:
+		return ""
+	case le.Size < 1024:
+		return fmt.Sprintf("%d B", le.Size)
+	case le.Size < 1024*1024:
+		return fmt.Sprintf("%.1f KiB", float64(le.Size)/1024)
+	}
+	return fmt.Sprintf("%.1f MiB", float64(le.Size)/(1024*1024))
+}
+
+// DefaultListingTemplate is used for listings if the Config doesn't give a
+// ListingTemplate.
+var DefaultListingTemplate = template.Must(template.New("listing").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>{{if .Project}}{{.Project}} {{end}}{{.Version}}: /{{.Path}}</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #333; }
+nav { margin-bottom: 1em; }
+table { border-collapse: collapse; }
+td { padding: 0.2em 1.5em 0.2em 0; }
+td.size { text-align: right; color: #777; }
+a { color: #4a6782; text-decoration: none; }
+a:hover { text-decoration: underline; }
+</style>
+</head>
+<body>
+<nav>{{range $n, $crumb := .Breadcrumbs}}{{if $n}} / {{end}}<a href="{{$crumb.URL}}">{{$crumb.Name}}</a>{{end}}</nav>
+<table>
+{{range .Entries}}<tr><td><a href="{{.URL}}">{{.Name}}{{if .IsDir}}/{{end}}</a></td><td class="size">{{.HumanSize}}</td><td>{{.ModTime.UTC.Format "2006-01-02 15:04"}}</td></tr>
+{{end}}</table>
+<p><a href="{{.Root}}">Back to the {{.Version}} docs</a></p>
+</body>
+</html>
+`))
+
+// isHidden reports whether the folder at the fs.FS path name is one of the
+// Config's HiddenFolders, or inside one.
+func (h *JavadocHandler) isHidden(name string) bool {
+	for _, hidden := range h.config.HiddenFolders {
+		hidden = strings.Trim(hidden, "/")
+		if hidden == "" {
+			continue
+		}
+		if name == hidden || strings.HasPrefix(name, hidden+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// listingFor builds the Listing of folder, which is at the URL path pth
+// within version.
+func (h *JavadocHandler) listingFor(version, pth string, folder *ZipFolder) *Listing {
+	root := "/" + url.PathEscape(version) + "/"
+	l := &Listing{
+		Project: h.config.Name,
+		Version: version,
+		Root:    root,
+		Path:    strings.TrimPrefix(pth, "/"),
+	}
+	if l.Path == "/" {
+		l.Path = ""
+	}
+
+	l.Breadcrumbs = append(l.Breadcrumbs, ListingLink{Name: version, URL: root})
+	crumbURL := root
+	for _, piece := range strings.Split(strings.Trim(pth, "/"), "/") {
+		if piece == "" {
+			continue
+		}
+		crumbURL += url.PathEscape(piece) + "/"
+		l.Breadcrumbs = append(l.Breadcrumbs, ListingLink{Name: piece, URL: crumbURL})
+	}
+
+	for _, inode := range folder.inodes {
+		// a colon would make the name look like a URL scheme
+		le := ListingEntry{
+			Name:    inode.Name(),
+			URL:     (&url.URL{Path: inode.Name()}).String(),
+			IsDir:   inode.IsDir(),
+			Size:    inode.Size(),
+			ModTime: inode.ModTime(),
+		}
+		if le.IsDir {
+			if h.isHidden(path.Join(l.Path, le.Name)) {
+				continue
+			}
+			le.URL += "/"
+		}
+		l.Entries = append(l.Entries, le)
+	}
+	return l
+}
+
+// serveListing renders the listing of folder, according to the Config's
+// ListingTemplate, and passes it through ts. Listings are cheap to render,
+// so what the transformers make of them isn't kept.
+func (h *JavadocHandler) serveListing(w http.ResponseWriter, r *http.Request, version string, folder *ZipFolder, ts []Transformer, tc *TransformContext) {
+	tmpl := h.config.ListingTemplate
+	if tmpl == nil {
+		tmpl = DefaultListingTemplate
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, h.listingFor(version, r.URL.Path, folder)); err != nil {
+		h.logger.Error("Rendering listing failed", "version", version, "path", r.URL.Path, "err", err)
+		h.serveError(w, r, http.StatusInternalServerError, version, r.URL.Path)
+		return
+	}
+	page := buf.Bytes()
+	if len(ts) > 0 {
+		var out bytes.Buffer
+		if err := transform(&out, &buf, ts, tc); err != nil {
+			h.logger.Error("Transforming listing failed", "version", version, "path", r.URL.Path, "err", err)
+			h.serveError(w, r, http.StatusInternalServerError, version, r.URL.Path)
+			return
+		}
+		page = out.Bytes()
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	http.ServeContent(w, r, "", folder.ModTime(), bytes.NewReader(page))
+}
@@ -0,0 +1,157 @@
+package javadocr
+
+import (
+	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// listingTestFiles have folders which are listed, and ones which are hidden.
+var listingTestFiles = map[string]string{
+	"overview-summary.html":       "<html><body>overview</body></html>",
+	"org/Foo.html":                "<html><body>foo</body></html>",
+	"org/sub/Bar:Baz.html":        "<html><body>bar</body></html>",
+	"META-INF/MANIFEST.MF":        "Manifest-Version: 1.0\n",
+	"META-INF/maven/pom.xml":      "<project/>",
+	"resources/big/fonts.woff2":   strings.Repeat("x", 2048),
+	"resources/big/index.html":    "<html><body>fonts</body></html>",
+	"resources/small/inherit.gif": "GIF89a",
+}
+
+func TestJavadocHandlerListings(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, listingTestFiles)
+	h := tr.handler(t, Config{})
+
+	testPlan := map[string]struct {
+		code     int
+		contains []string
+		omits    []string
+	}{
+		"/1.0/": {http.StatusOK, []string{`href="/1.0/"`, `href="org/"`, `href="overview-summary.html"`}, []string{"META-INF"}},
+		"/1.0/org/": {http.StatusOK, []string{
+			`<a href="/1.0/">1.0</a> / <a href="/1.0/org/">org</a>`,
+			`href="Foo.html"`, `href="sub/"`, "29 B",
+			`<a href="/1.0/">Back to the 1.0 docs</a>`,
+		}, nil},
+		"/1.0/org/sub/":             {http.StatusOK, []string{`href="./Bar:Baz.html"`, `<a href="/1.0/org/sub/">sub</a>`}, nil},
+		"/1.0/resources/":           {http.StatusOK, []string{`href="big/"`, `href="small/"`}, nil},
+		"/1.0/resources/big/":       {http.StatusOK, []string{"fonts"}, []string{"fonts.woff2"}},
+		"/1.0/META-INF/":            {http.StatusNotFound, nil, nil},
+		"/1.0/META-INF/maven/":      {http.StatusNotFound, nil, nil},
+		"/1.0/META-INF/MANIFEST.MF": {http.StatusOK, []string{"Manifest-Version"}, nil},
+		"/1.0/org/Foo.html":         {http.StatusOK, []string{"foo"}, nil},
+	}
+	for pth, tp := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if rec.Code != tp.code {
+			t.Errorf("Got: %d for %s, expected: %d", rec.Code, pth, tp.code)
+			continue
+		}
+		body := rec.Body.String()
+		for _, s := range tp.contains {
+			if !strings.Contains(body, s) {
+				t.Errorf("Got: %s for %s, expected it to contain %s", body, pth, s)
+			}
+		}
+		for _, s := range tp.omits {
+			if strings.Contains(body, s) {
+				t.Errorf("Got: %s for %s, expected it not to contain %s", body, pth, s)
+			}
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/resources/small/", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/html; charset=utf-8" {
+		t.Errorf("Got: %s, expected: text/html; charset=utf-8", ct)
+	}
+	if rec.Header().Get("ETag") == "" || rec.Header().Get("Last-Modified") == "" {
+		t.Errorf("Got: %v, expected an ETag and Last-Modified for a listing", rec.Header())
+	}
+}
+
+func TestJavadocHandlerListingPolicy(t *testing.T) {
+	testPlan := map[string]struct {
+		config   Config
+		expected map[string]int
+	}{
+		"off": {
+			Config{Listings: ListingsOff},
+			map[string]int{
+				"/1.0/":                     http.StatusNotFound,
+				"/1.0/org/":                 http.StatusNotFound,
+				"/1.0/resources/big/":       http.StatusOK,
+				"/1.0/org/Foo.html":         http.StatusOK,
+				"/1.0/META-INF/MANIFEST.MF": http.StatusOK,
+			},
+		},
+		"nothing hidden": {
+			Config{HiddenFolders: []string{}},
+			map[string]int{
+				"/1.0/META-INF/":       http.StatusOK,
+				"/1.0/META-INF/maven/": http.StatusOK,
+			},
+		},
+		"more hidden": {
+			Config{HiddenFolders: []string{"META-INF", "/resources/"}},
+			map[string]int{
+				"/1.0/META-INF/":        http.StatusNotFound,
+				"/1.0/resources/":       http.StatusNotFound,
+				"/1.0/resources/small/": http.StatusNotFound,
+				"/1.0/resources/big/":   http.StatusOK,
+				"/1.0/org/":             http.StatusOK,
+			},
+		},
+	}
+	for name, tp := range testPlan {
+		tr := newTestRepository(t, "1.0")
+		tr.jars["1.0"] = makeJar(t, listingTestFiles)
+		h := tr.handler(t, tp.config)
+		for pth, expected := range tp.expected {
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+			if rec.Code != expected {
+				t.Errorf("%s: Got: %d for %s, expected: %d", name, rec.Code, pth, expected)
+			}
+		}
+	}
+}
+
+func TestJavadocHandlerListingTemplate(t *testing.T) {
+	tmpl := template.Must(template.New("listing").Parse(`{{.Project}} {{.Version}} {{.Path}}:{{range .Entries}} {{.Name}}={{.HumanSize}}{{end}}`))
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, listingTestFiles)
+	h := tr.handler(t, Config{Name: "spongeapi", ListingTemplate: tmpl})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/resources/", nil))
+	if expected := "spongeapi 1.0 resources/: big= small="; rec.Body.String() != expected {
+		t.Errorf("Got: %s, expected: %s", rec.Body.String(), expected)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/", nil))
+	if expected := "spongeapi 1.0 : org= overview-summary.html=34 B resources="; rec.Body.String() != expected {
+		t.Errorf("Got: %s, expected: %s", rec.Body.String(), expected)
+	}
+}
+
+func TestJavadocHandlerListingTemplateFailure(t *testing.T) {
+	tmpl := template.Must(template.New("listing").Parse(`{{.Nope}}`))
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, listingTestFiles)
+	h := tr.handler(t, Config{Name: "spongeapi", ListingTemplate: tmpl})
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/1.0/resources/", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("Got: %d, expected: %d", rec.Code, http.StatusInternalServerError)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") || !strings.Contains(rec.Body.String(), "1.0") {
+		t.Errorf("Got: %s %s, expected the error page", ct, rec.Body.String())
+	}
+}
@@ -2,11 +2,14 @@ package maven
 
 import (
 	"errors"
+	"fmt"
 	"io"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"path"
 	"strings"
+	"time"
 )
 
 type SkipResolutionError string
@@ -21,6 +24,27 @@ var (
 	ErrBadStatus           = errors.New(`bad HTTP status`)
 )
 
+// StatusError is returned when the repository responds with anything other
+// than 200 OK. It matches ErrBadStatus when used with errors.Is.
+type StatusError struct {
+	URL        *url.URL
+	StatusCode int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("bad HTTP status %d fetching %v", e.StatusCode, e.URL)
+}
+
+func (e *StatusError) Is(target error) bool {
+	return target == ErrBadStatus
+}
+
+// DefaultRequestTimeout is how long a request to a RemoteRepository without
+// its own Client may take, including reading the response, before we give up.
+const DefaultRequestTimeout = 5 * time.Minute
+
+var defaultClient = &http.Client{Timeout: DefaultRequestTimeout}
+
 var (
 	mavenMetadataURL = &url.URL{
 		Path: "maven-metadata.xml",
@@ -36,6 +60,27 @@ type Repository interface {
 type RemoteRepository struct {
 	URL                 *url.URL
 	MayResolveSnapshots bool
+
+	// Logger is where requests to the repository are logged, at debug
+	// level. If nil, slog.Default is used.
+	Logger *slog.Logger
+	// Client is used to make requests to the repository. If nil, a client
+	// which gives up after DefaultRequestTimeout is used.
+	Client *http.Client
+}
+
+func (r RemoteRepository) client() *http.Client {
+	if r.Client == nil {
+		return defaultClient
+	}
+	return r.Client
+}
+
+func (r RemoteRepository) logger() *slog.Logger {
+	if r.Logger == nil {
+		return slog.Default()
+	}
+	return r.Logger
 }
 
 func (r RemoteRepository) Resolve(c Coordinate) (*Artifact, error) {
@@ -97,13 +142,16 @@ func (r RemoteRepository) get(u *url.URL) (io.ReadCloser, error) {
 		Method: "GET",
 		URL:    u,
 	}
-	resp, err := http.DefaultClient.Do(req)
+	start := time.Now()
+	resp, err := r.client().Do(req)
 	if err != nil {
+		r.logger().Warn("Repository request failed", "url", u.String(), "err", err, "duration", time.Since(start))
 		return nil, err
 	}
+	r.logger().Debug("Repository request", "url", u.String(), "status", resp.StatusCode, "duration", time.Since(start))
 	if resp.StatusCode != http.StatusOK {
 		resp.Body.Close()
-		return nil, ErrBadStatus
+		return nil, &StatusError{URL: u, StatusCode: resp.StatusCode}
 	}
 	return resp.Body, nil
 }
@@ -1,11 +1,13 @@
 package maven
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 )
 
 func TestRepositoryDirectoryBuilder(t *testing.T) {
@@ -28,7 +30,7 @@ func TestRepositoryDirectoryBuilder(t *testing.T) {
 
 func testRepositoryResolution(t *testing.T, rr RemoteRepository, expectSnapshotFailure bool) {
 	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintln(w, "%s", `<metadata>
+		fmt.Fprint(w, `<metadata>
 <groupId>org.spongepowered</groupId>
 <artifactId>spongeapi</artifactId>
 <version>2.1-SNAPSHOT</version>
@@ -81,7 +83,7 @@ func testRepositoryResolution(t *testing.T, rr RemoteRepository, expectSnapshotF
 	for coord, dest := range snapshotCoordinates {
 		artifact, err := rr.Resolve(coord)
 		if expectSnapshotFailure && err != ErrSnapshotsNotAllowed {
-			t.Error("expected ErrSnapshotsNotAllowed, got %#v", err)
+			t.Errorf("expected ErrSnapshotsNotAllowed, got %#v", err)
 			continue
 		} else if expectSnapshotFailure {
 			continue
@@ -115,7 +117,7 @@ func TestRepositoryVersionsForCoordinate(t *testing.T) {
 			return
 		}
 
-		fmt.Fprintln(w, "%s", `
+		fmt.Fprint(w, `
 <?xml version="1.0" encoding="UTF-8"?>
 <metadata>
   <groupId>org.spongepowered</groupId>
@@ -168,3 +170,56 @@ func TestRepositoryVersionsForCoordinate(t *testing.T) {
 		}
 	}
 }
+
+func TestRepositoryBadStatus(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer ts.Close()
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := RemoteRepository{URL: u}
+	_, err = rr.VersionsForCoordinate(Coordinate{"org.spongepowered", "spongeapi", "", "", ""})
+	if !errors.Is(err, ErrBadStatus) {
+		t.Fatalf("expected ErrBadStatus, got %#v", err)
+	}
+	var se *StatusError
+	if !errors.As(err, &se) || se.StatusCode != http.StatusNotFound {
+		t.Errorf("expected a StatusError with a 404, got %#v", err)
+	}
+}
+
+func TestRepositoryTimeout(t *testing.T) {
+	unblock := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	defer ts.Close()
+	defer close(unblock)
+
+	if got := (RemoteRepository{}).client().Timeout; got != DefaultRequestTimeout {
+		t.Errorf("Got: %v, expected: %v", got, DefaultRequestTimeout)
+	}
+
+	u, err := url.Parse(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr := RemoteRepository{URL: u, Client: &http.Client{Timeout: 10 * time.Millisecond}}
+	done := make(chan error, 1)
+	go func() {
+		_, err := rr.VersionsForCoordinate(Coordinate{"org.spongepowered", "spongeapi", "", "", ""})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil {
+			t.Error("expected the request to time out")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("request to a repository which never answers didn't give up")
+	}
+}
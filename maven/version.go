@@ -0,0 +1,107 @@
+package maven
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// qualifiers are the well-known version qualifiers, in the order Maven sorts
+// them. Anything else sorts after these, alphabetically.
+var qualifiers = map[string]int{
+	"alpha":     1,
+	"a":         1,
+	"beta":      2,
+	"b":         2,
+	"milestone": 3,
+	"m":         3,
+	"rc":        4,
+	"cr":        4,
+	"snapshot":  5,
+}
+
+// versionTokens splits a version into numbers and qualifiers, at dots and
+// hyphens and wherever it changes between digits and letters.
+func versionTokens(v string) []string {
+	var tokens []string
+	var cur strings.Builder
+	lastDigit := false
+	for _, r := range strings.ToLower(v) {
+		if r == '.' || r == '-' || r == '_' {
+			if cur.Len() > 0 {
+				tokens = append(tokens, cur.String())
+			}
+			cur.Reset()
+			continue
+		}
+		if cur.Len() > 0 && unicode.IsDigit(r) != lastDigit {
+			tokens = append(tokens, cur.String())
+			cur.Reset()
+		}
+		lastDigit = unicode.IsDigit(r)
+		cur.WriteRune(r)
+	}
+	if cur.Len() > 0 {
+		tokens = append(tokens, cur.String())
+	}
+	return tokens
+}
+
+// compareTokens compares two tokens of a version. Numbers sort after
+// qualifiers, and qualifiers before nothing at all, so that 1.0-beta comes
+// before 1.0, which comes before 1.0.1.
+func compareTokens(a, b string) int {
+	an, aErr := strconv.ParseUint(a, 10, 64)
+	bn, bErr := strconv.ParseUint(b, 10, 64)
+	switch {
+	case a == b:
+		return 0
+	case aErr == nil && bErr == nil:
+		if an < bn {
+			return -1
+		} else if an > bn {
+			return 1
+		}
+		return 0
+	case aErr == nil:
+		return 1
+	case bErr == nil:
+		return -1
+	case a == "":
+		return 1
+	case b == "":
+		return -1
+	}
+
+	aq, aKnown := qualifiers[a]
+	bq, bKnown := qualifiers[b]
+	switch {
+	case aKnown && bKnown:
+		return aq - bq
+	case aKnown:
+		return -1
+	case bKnown:
+		return 1
+	}
+	return strings.Compare(a, b)
+}
+
+// CompareVersions compares two versions roughly as Maven would, returning a
+// negative number if a comes before b, a positive one if it comes after, and
+// zero if they are the same.
+func CompareVersions(a, b string) int {
+	at, bt := versionTokens(a), versionTokens(b)
+	for n := 0; n < len(at) || n < len(bt); n++ {
+		var ta, tb string
+		if n < len(at) {
+			ta = at[n]
+		}
+		if n < len(bt) {
+			tb = bt[n]
+		}
+		if c := compareTokens(ta, tb); c != 0 {
+			return c
+		}
+	}
+	return 0
+}
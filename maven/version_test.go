@@ -0,0 +1,37 @@
+package maven
+
+import (
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	testPlan := []struct {
+		a, b     string
+		expected int
+	}{
+		{"1.0", "1.0", 0},
+		{"1.0", "1.0.0", -1},
+		{"1.0", "1.1", -1},
+		{"1.9", "1.10", -1},
+		{"2.0", "10.0", -1},
+		{"1.0-alpha", "1.0-beta", -1},
+		{"1.0-beta", "1.0-rc1", -1},
+		{"1.0-rc1", "1.0-rc2", -1},
+		{"1.0-rc2", "1.0-SNAPSHOT", -1},
+		{"1.0-SNAPSHOT", "1.0", -1},
+		{"1.0", "1.0.1", -1},
+		{"1.0-beta", "1.0.1", -1},
+		{"3.0.1-indev", "3.0.1", -1},
+		{"7.4.0", "8.0.0-SNAPSHOT", -1},
+	}
+	for _, tp := range testPlan {
+		got := CompareVersions(tp.a, tp.b)
+		if (got < 0) != (tp.expected < 0) || (got > 0) != (tp.expected > 0) {
+			t.Errorf("Got: %d comparing %s and %s, expected: %d", got, tp.a, tp.b, tp.expected)
+		}
+		got = CompareVersions(tp.b, tp.a)
+		if (got < 0) != (tp.expected > 0) || (got > 0) != (tp.expected < 0) {
+			t.Errorf("Got: %d comparing %s and %s, expected: %d", got, tp.b, tp.a, -tp.expected)
+		}
+	}
+}
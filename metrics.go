@@ -0,0 +1,370 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the histogram buckets
+// used for repository requests and refreshes.
+var latencyBuckets = []float64{0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+
+// counterVec is a set of counters distinguished by their label values.
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]uint64
+}
+
+func labelKey(labelValues ...string) string {
+	return strings.Join(labelValues, "\xff")
+}
+
+func (cv *counterVec) inc(labelValues ...string) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	if cv.values == nil {
+		cv.values = make(map[string]uint64)
+	}
+	cv.values[labelKey(labelValues...)]++
+}
+
+// snapshot returns the label values and counts, sorted by label values.
+func (cv *counterVec) snapshot() ([][]string, []uint64) {
+	cv.mu.Lock()
+	defer cv.mu.Unlock()
+	keys := make([]string, 0, len(cv.values))
+	for k := range cv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	labels := make([][]string, len(keys))
+	counts := make([]uint64, len(keys))
+	for n, k := range keys {
+		labels[n] = strings.Split(k, "\xff")
+		counts[n] = cv.values[k]
+	}
+	return labels, counts
+}
+
+// histogram counts observations into latencyBuckets.
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a set of histograms distinguished by their label values.
+type histogramVec struct {
+	mu     sync.Mutex
+	values map[string]*histogram
+}
+
+func (hv *histogramVec) observe(d time.Duration, labelValues ...string) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	if hv.values == nil {
+		hv.values = make(map[string]*histogram)
+	}
+	k := labelKey(labelValues...)
+	hi, ok := hv.values[k]
+	if !ok {
+		hi = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		hv.values[k] = hi
+	}
+
+	s := d.Seconds()
+	for n, le := range latencyBuckets {
+		if s <= le {
+			hi.counts[n]++
+		}
+	}
+	hi.sum += s
+	hi.count++
+}
+
+func (hv *histogramVec) snapshot() ([][]string, []histogram) {
+	hv.mu.Lock()
+	defer hv.mu.Unlock()
+	keys := make([]string, 0, len(hv.values))
+	for k := range hv.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	labels := make([][]string, len(keys))
+	his := make([]histogram, len(keys))
+	for n, k := range keys {
+		labels[n] = strings.Split(k, "\xff")
+		hi := *hv.values[k]
+		hi.counts = append([]uint64(nil), hi.counts...)
+		his[n] = hi
+	}
+	return labels, his
+}
+
+// handlerMetrics is what a JavadocHandler counts about itself.
+type handlerMetrics struct {
+	requests counterVec // version, code
+
+	cacheHits      uint64
+	cacheMisses    uint64
+	cacheEvictions uint64
+
+	repositoryDuration histogramVec // op
+	repositoryErrors   counterVec   // op, kind
+	refreshDuration    histogramVec
+}
+
+// errorKind sorts errors from the repository into a few broad kinds.
+func errorKind(err error) string {
+	var ske maven.SkipResolutionError
+	var se *maven.StatusError
+	var ne net.Error
+	var xe *xml.SyntaxError
+	switch {
+	case errors.As(err, &ske):
+		return "not_allowed"
+	case errors.As(err, &se) && se.StatusCode >= 500:
+		return "http_5xx"
+	case errors.As(err, &se):
+		return "http_4xx"
+	case errors.As(err, &ne) && ne.Timeout():
+		return "timeout"
+	case errors.As(err, &ne):
+		return "network"
+	case errors.As(err, &xe), errors.Is(err, zip.ErrFormat), errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, ErrBadArchive):
+		return "invalid"
+	}
+	return "other"
+}
+
+// timeRepository runs a request to the repository, recording how long it
+// took and what went wrong, if anything.
+func (h *JavadocHandler) timeRepository(op string, f func() error) error {
+	start := time.Now()
+	err := f()
+	h.metrics.repositoryDuration.observe(time.Since(start), op)
+	if err != nil {
+		h.metrics.repositoryErrors.inc(op, errorKind(err))
+	}
+	return err
+}
+
+// statusRecorder remembers the status code and size of the response written
+// through it.
+type statusRecorder struct {
+	http.ResponseWriter
+	code  int
+	bytes int64
+}
+
+func (sr *statusRecorder) WriteHeader(code int) {
+	if sr.code == 0 {
+		sr.code = code
+	}
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *statusRecorder) Write(b []byte) (int, error) {
+	if sr.code == 0 {
+		sr.code = http.StatusOK
+	}
+	n, err := sr.ResponseWriter.Write(b)
+	sr.bytes += int64(n)
+	return n, err
+}
+
+func (sr *statusRecorder) status() int {
+	if sr.code == 0 {
+		return http.StatusOK
+	}
+	return sr.code
+}
+
+// MetricsHandler serves metrics about every project in the Prometheus text
+// exposition format. The metrics are:
+//
+//	javadocr_http_requests_total{project,version,code}          counter
+//	javadocr_cache_hits_total{project}                          counter
+//	javadocr_cache_misses_total{project}                        counter
+//	javadocr_cache_evictions_total{project}                     counter
+//	javadocr_cache_entries{project}                             gauge
+//	javadocr_cache_bytes{project}                               gauge
+//	javadocr_repository_request_duration_seconds{project,op}    histogram
+//	javadocr_repository_errors_total{project,op,kind}           counter
+//	javadocr_refresh_duration_seconds{project}                  histogram
+//	javadocr_versions{project}                                  gauge
+//	javadocr_degraded{project}                                  gauge
+//	javadocr_warm_total{project,result}                         counter
+//	javadocr_warm_pending{project}                              gauge
+//
+// The version label is "unknown" for requests for versions we don't know
+// about, so that it can't be made to grow without bound. The op label is one
+// of "versions", "resolve" or "fetch".
+type MetricsHandler struct {
+	Projects Projects
+}
+
+type metricsWriter struct {
+	w    io.Writer
+	name string
+}
+
+func (mw *metricsWriter) family(name, typ, help string) {
+	mw.name = name
+	fmt.Fprintf(mw.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func escapeLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+// sample writes a sample of the current family. labels alternate between
+// names and values.
+func (mw *metricsWriter) sample(suffix string, value string, labels ...string) {
+	var b strings.Builder
+	b.WriteString(mw.name)
+	b.WriteString(suffix)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for n := 0; n < len(labels); n += 2 {
+			if n > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(&b, `%s="%s"`, labels[n], escapeLabelValue(labels[n+1]))
+		}
+		b.WriteByte('}')
+	}
+	fmt.Fprintf(mw.w, "%s %s\n", b.String(), value)
+}
+
+func formatUint(v uint64) string {
+	return strconv.FormatUint(v, 10)
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func (mw *metricsWriter) histogram(hi histogram, labels ...string) {
+	for n, le := range latencyBuckets {
+		mw.sample("_bucket", formatUint(hi.counts[n]), append(labels, "le", formatFloat(le))...)
+	}
+	mw.sample("_bucket", formatUint(hi.count), append(labels, "le", "+Inf")...)
+	mw.sample("_sum", formatFloat(hi.sum), labels...)
+	mw.sample("_count", formatUint(hi.count), labels...)
+}
+
+func (mh MetricsHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	mw := &metricsWriter{w: w}
+	names := mh.Projects.Names()
+
+	mw.family("javadocr_http_requests_total", "counter", "HTTP requests served, by version and status code.")
+	for _, name := range names {
+		labels, counts := mh.Projects[name].metrics.requests.snapshot()
+		for n, lv := range labels {
+			mw.sample("", formatUint(counts[n]), "project", name, "version", lv[0], "code", lv[1])
+		}
+	}
+
+	for _, c := range []struct {
+		name, help string
+		get        func(*JavadocHandler) uint64
+	}{
+		{"javadocr_cache_hits_total", "Requests for an artifact served from the cache.", func(h *JavadocHandler) uint64 { return atomic.LoadUint64(&h.metrics.cacheHits) }},
+		{"javadocr_cache_misses_total", "Requests for an artifact which had to be downloaded.", func(h *JavadocHandler) uint64 { return atomic.LoadUint64(&h.metrics.cacheMisses) }},
+		{"javadocr_cache_evictions_total", "Artifacts dropped from the cache.", func(h *JavadocHandler) uint64 { return atomic.LoadUint64(&h.metrics.cacheEvictions) }},
+	} {
+		mw.family(c.name, "counter", c.help)
+		for _, name := range names {
+			mw.sample("", formatUint(c.get(mh.Projects[name])), "project", name)
+		}
+	}
+
+	entries := make(map[string]int)
+	bytes := make(map[string]int64)
+	for _, name := range names {
+		h := mh.Projects[name]
+		h.versionCacheLock.RLock()
+		entries[name] = len(h.versionCache)
+		for _, jc := range h.versionCache {
+			bytes[name] += jc.cacheSize()
+		}
+		h.versionCacheLock.RUnlock()
+	}
+	mw.family("javadocr_cache_entries", "gauge", "Artifacts currently cached.")
+	for _, name := range names {
+		mw.sample("", strconv.Itoa(entries[name]), "project", name)
+	}
+	mw.family("javadocr_cache_bytes", "gauge", "Size of the artifacts currently cached.")
+	for _, name := range names {
+		mw.sample("", strconv.FormatInt(bytes[name], 10), "project", name)
+	}
+
+	mw.family("javadocr_repository_request_duration_seconds", "histogram", "Time taken by requests to the Maven repository.")
+	for _, name := range names {
+		labels, his := mh.Projects[name].metrics.repositoryDuration.snapshot()
+		for n, lv := range labels {
+			mw.histogram(his[n], "project", name, "op", lv[0])
+		}
+	}
+
+	mw.family("javadocr_repository_errors_total", "counter", "Failed requests to the Maven repository, by kind of failure.")
+	for _, name := range names {
+		labels, counts := mh.Projects[name].metrics.repositoryErrors.snapshot()
+		for n, lv := range labels {
+			mw.sample("", formatUint(counts[n]), "project", name, "op", lv[0], "kind", lv[1])
+		}
+	}
+
+	mw.family("javadocr_refresh_duration_seconds", "histogram", "Time taken to check for new versions and expire old artifacts.")
+	for _, name := range names {
+		_, his := mh.Projects[name].metrics.refreshDuration.snapshot()
+		for _, hi := range his {
+			mw.histogram(hi, "project", name)
+		}
+	}
+
+	mw.family("javadocr_versions", "gauge", "Versions known in the repository.")
+	for _, name := range names {
+		h := mh.Projects[name]
+		h.versionsLock.RLock()
+		n := len(h.versions)
+		h.versionsLock.RUnlock()
+		mw.sample("", strconv.Itoa(n), "project", name)
+	}
+
+	mw.family("javadocr_degraded", "gauge", "Whether the repository is currently unreachable.")
+	for _, name := range names {
+		v := "0"
+		if degraded, _ := mh.Projects[name].Degraded(); degraded {
+			v = "1"
+		}
+		mw.sample("", v, "project", name)
+	}
+
+	mw.family("javadocr_warm_total", "counter", "Artifacts fetched ahead of time by cache warming.")
+	for _, name := range names {
+		ws := mh.Projects[name].WarmStats()
+		mw.sample("", formatUint(ws.Warmed), "project", name, "result", "warmed")
+		mw.sample("", formatUint(ws.Failed), "project", name, "result", "failed")
+	}
+	mw.family("javadocr_warm_pending", "gauge", "Artifacts waiting to be fetched by cache warming.")
+	for _, name := range names {
+		mw.sample("", formatUint(mh.Projects[name].WarmStats().Pending), "project", name)
+	}
+}
@@ -0,0 +1,113 @@
+package javadocr
+
+import (
+	"errors"
+	"github.com/lukegb/javadocr/maven"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// metricNames are the metric families we promise to export. Dashboards and
+// alerts depend on these, so don't change them lightly.
+var metricNames = map[string]string{
+	"javadocr_http_requests_total":                 "counter",
+	"javadocr_cache_hits_total":                    "counter",
+	"javadocr_cache_misses_total":                  "counter",
+	"javadocr_cache_evictions_total":               "counter",
+	"javadocr_cache_entries":                       "gauge",
+	"javadocr_cache_bytes":                         "gauge",
+	"javadocr_repository_request_duration_seconds": "histogram",
+	"javadocr_repository_errors_total":             "counter",
+	"javadocr_refresh_duration_seconds":            "histogram",
+	"javadocr_versions":                            "gauge",
+	"javadocr_degraded":                            "gauge",
+	"javadocr_warm_total":                          "counter",
+	"javadocr_warm_pending":                        "gauge",
+}
+
+func scrape(t *testing.T, projects Projects) string {
+	rec := httptest.NewRecorder()
+	MetricsHandler{Projects: projects}.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d", rec.Code)
+	}
+	return rec.Body.String()
+}
+
+func TestMetricsHandler(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	tr.jars["2.0"] = makeJar(t, map[string]string{"overview-summary.html": "<html></html>"})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, Fallbacks: FallbackOff})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	// 2.0 is fetched on start, to find out what to redirect to it
+	h.background.Wait()
+
+	for _, pth := range []string{"/2.0/overview-summary.html", "/2.0/overview-summary.html", "/2.0/missing.html", "/9.0/index.html", "/1.0/index.html"} {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", pth, nil))
+	}
+
+	out := scrape(t, Projects{"spongeapi": h})
+	for name, typ := range metricNames {
+		if !strings.Contains(out, "# HELP "+name+" ") {
+			t.Errorf("no HELP for %s", name)
+		}
+		if !strings.Contains(out, "# TYPE "+name+" "+typ+"\n") {
+			t.Errorf("no TYPE %s for %s", typ, name)
+		}
+	}
+
+	for _, sample := range []string{
+		`javadocr_http_requests_total{project="spongeapi",version="2.0",code="200"} 2`,
+		`javadocr_http_requests_total{project="spongeapi",version="2.0",code="404"} 1`,
+		`javadocr_http_requests_total{project="spongeapi",version="unknown",code="404"} 1`,
+		`javadocr_http_requests_total{project="spongeapi",version="1.0",code="404"} 1`,
+		`javadocr_cache_hits_total{project="spongeapi"} 3`,
+		`javadocr_cache_misses_total{project="spongeapi"} 2`,
+		`javadocr_cache_entries{project="spongeapi"} 1`,
+		`javadocr_repository_request_duration_seconds_count{project="spongeapi",op="versions"} 1`,
+		`javadocr_repository_request_duration_seconds_bucket{project="spongeapi",op="fetch",le="+Inf"} 2`,
+		`javadocr_repository_errors_total{project="spongeapi",op="fetch",kind="http_4xx"} 1`,
+		`javadocr_versions{project="spongeapi"} 2`,
+		`javadocr_degraded{project="spongeapi"} 0`,
+	} {
+		if !strings.Contains(out, sample+"\n") {
+			t.Errorf("missing sample %s", sample)
+		}
+	}
+	if t.Failed() {
+		t.Log(out)
+	}
+}
+
+func TestErrorKind(t *testing.T) {
+	testPlan := map[error]string{
+		maven.ErrSnapshotsNotAllowed:        "not_allowed",
+		&maven.StatusError{StatusCode: 404}: "http_4xx",
+		&maven.StatusError{StatusCode: 503}: "http_5xx",
+		errors.New("something else"):        "other",
+		&timeoutError{}:                     "timeout",
+	}
+	for err, expected := range testPlan {
+		if got := errorKind(err); got != expected {
+			t.Errorf("%v: got %s, expected %s", err, got, expected)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timed out" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestEscapeLabelValue(t *testing.T) {
+	if got := escapeLabelValue("a\"b\\c\nd"); got != `a\"b\\c\nd` {
+		t.Errorf("got %s", got)
+	}
+}
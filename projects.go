@@ -0,0 +1,18 @@
+package javadocr
+
+import (
+	"sort"
+)
+
+// Projects is a set of JavadocHandlers, keyed by project name.
+type Projects map[string]*JavadocHandler
+
+// Names returns the names of all the projects, sorted.
+func (p Projects) Names() []string {
+	names := make([]string, 0, len(p))
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,139 @@
+package javadocr
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// A Scheduler decides when a JavadocHandler refreshes its list of versions
+// and expires old SNAPSHOT artifacts.
+type Scheduler interface {
+	// Start begins calling refresh in the background and returns
+	// immediately. It is called once, by the handler that owns the
+	// Scheduler.
+	Start(refresh func() error)
+	// Trigger asks for refresh to be called as soon as possible.
+	Trigger()
+	// Stop stops calling refresh, waiting for any call in progress to
+	// finish first.
+	Stop()
+}
+
+// IntervalScheduler calls refresh every Interval plus up to Jitter, so that
+// many projects sharing a repository don't all poll it at once. Whilst
+// refresh returns errors, the interval is doubled each time up to MaxBackoff.
+// The zero value is ready to use, and can be stopped without being started.
+type IntervalScheduler struct {
+	Interval   time.Duration
+	Jitter     time.Duration
+	MaxBackoff time.Duration
+	// Logger is where failures are logged. If nil, slog.Default is used.
+	Logger *slog.Logger
+
+	initOnce sync.Once
+	trigger  chan struct{}
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	lock    sync.Mutex
+	done    chan struct{} // nil until started
+	stopped bool
+}
+
+func NewIntervalScheduler(interval, jitter, maxBackoff time.Duration) *IntervalScheduler {
+	return &IntervalScheduler{
+		Interval:   interval,
+		Jitter:     jitter,
+		MaxBackoff: maxBackoff,
+	}
+}
+
+func (s *IntervalScheduler) init() {
+	s.initOnce.Do(func() {
+		s.trigger = make(chan struct{}, 1)
+		s.stop = make(chan struct{})
+	})
+}
+
+func (s *IntervalScheduler) logger() *slog.Logger {
+	if s.Logger == nil {
+		return slog.Default()
+	}
+	return s.Logger
+}
+
+func (s *IntervalScheduler) Start(refresh func() error) {
+	s.init()
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.stopped || s.done != nil {
+		return
+	}
+	s.done = make(chan struct{})
+	go s.run(refresh, s.done)
+}
+
+func (s *IntervalScheduler) run(refresh func() error, done chan struct{}) {
+	defer close(done)
+
+	failures := 0
+	for {
+		t := time.NewTimer(s.nextDelay(failures))
+		select {
+		case <-s.stop:
+			t.Stop()
+			return
+		case <-s.trigger:
+			t.Stop()
+		case <-t.C:
+		}
+
+		if err := refresh(); err != nil {
+			failures++
+			s.logger().Warn("Refresh failed, backing off", "failures", failures, "err", err)
+		} else {
+			failures = 0
+		}
+	}
+}
+
+// nextDelay works out how long to wait before the next refresh, given how
+// many have failed in a row.
+func (s *IntervalScheduler) nextDelay(failures int) time.Duration {
+	d := s.Interval
+	for n := 0; n < failures && d < s.MaxBackoff; n++ {
+		d *= 2
+	}
+	if s.MaxBackoff > s.Interval && d > s.MaxBackoff {
+		d = s.MaxBackoff
+	}
+	if s.Jitter > 0 {
+		d += time.Duration(rand.Int63n(int64(s.Jitter)))
+	}
+	return d
+}
+
+func (s *IntervalScheduler) Trigger() {
+	s.init()
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+		// there's already one waiting
+	}
+}
+
+func (s *IntervalScheduler) Stop() {
+	s.init()
+	s.stopOnce.Do(func() {
+		close(s.stop)
+	})
+	s.lock.Lock()
+	s.stopped = true
+	done := s.done
+	s.lock.Unlock()
+	if done != nil {
+		<-done
+	}
+}
@@ -0,0 +1,94 @@
+package javadocr
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIntervalSchedulerBackoff(t *testing.T) {
+	s := NewIntervalScheduler(time.Second, 0, 10*time.Second)
+	testPlan := map[int]time.Duration{
+		0:  time.Second,
+		1:  2 * time.Second,
+		3:  8 * time.Second,
+		4:  10 * time.Second,
+		50: 10 * time.Second,
+	}
+	for failures, expected := range testPlan {
+		if got := s.nextDelay(failures); got != expected {
+			t.Errorf("after %d failures got %v, expected %v", failures, got, expected)
+		}
+	}
+}
+
+func TestIntervalSchedulerJitter(t *testing.T) {
+	s := NewIntervalScheduler(time.Second, time.Second, time.Minute)
+	for n := 0; n < 100; n++ {
+		if got := s.nextDelay(0); got < time.Second || got >= 2*time.Second {
+			t.Fatalf("got %v, expected between 1s and 2s", got)
+		}
+	}
+}
+
+func TestIntervalSchedulerTriggerAndStop(t *testing.T) {
+	var calls int32
+	called := make(chan struct{}, 10)
+	s := NewIntervalScheduler(time.Hour, 0, time.Hour)
+	s.Start(func() error {
+		atomic.AddInt32(&calls, 1)
+		called <- struct{}{}
+		return errors.New("nope")
+	})
+
+	s.Trigger()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Trigger didn't cause a refresh")
+	}
+
+	s.Stop()
+	// stopping twice is harmless
+	s.Stop()
+
+	s.Trigger()
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("got %d refreshes, expected 1", got)
+	}
+}
+
+func TestIntervalSchedulerZeroValue(t *testing.T) {
+	// stopping one which was never started doesn't block
+	var s IntervalScheduler
+	s.Trigger()
+	s.Stop()
+
+	// and nor does starting it afterwards
+	var calls int32
+	s.Start(func() error {
+		atomic.AddInt32(&calls, 1)
+		return nil
+	})
+	s.Trigger()
+	time.Sleep(10 * time.Millisecond)
+	if got := atomic.LoadInt32(&calls); got != 0 {
+		t.Errorf("got %d refreshes, expected none once stopped", got)
+	}
+
+	s = IntervalScheduler{Interval: time.Hour}
+	called := make(chan struct{}, 1)
+	s.Start(func() error {
+		called <- struct{}{}
+		return nil
+	})
+	s.Trigger()
+	select {
+	case <-called:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Trigger didn't cause a refresh")
+	}
+	s.Stop()
+}
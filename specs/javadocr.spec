@@ -10,6 +10,7 @@ License:	BSD
 URL:		https://github.com/lukegb/javadocr
 Source0:	https://github.com/lukegb/javadocr/archive/master.tar.gz
 Source1:        %{name}.service
+Source2:        %{name}.socket
 
 ExclusiveArch:  %{?go_arches:%{go_arches}}%{!?go_arches:%{ix86} x86_64 %{arm}}
 BuildRequires:  %{?go_compiler:compiler(go-compiler)}%{!?go_compiler:golang}
@@ -39,6 +40,7 @@ export GOPATH=$(pwd):%{gopath}
 %install
 install -D -p -m 0755 bin/%{name} %{buildroot}%{_bindir}/%{name}
 install -D -p -m 0644 %{SOURCE1} %{buildroot}%{_unitdir}/%{name}.service
+install -D -p -m 0644 %{SOURCE2} %{buildroot}%{_unitdir}/%{name}.socket
 
 %pre
 getent group %{name} >/dev/null || groupadd -r %{name}
@@ -46,18 +48,19 @@ getent passwd %{name} >/dev/null || useradd -r -g %{name} -d %{_sharedstatedir}/
 	-s /sbin/nologin -c "%{name} user" %{name}
 
 %post
-%systemd_post %{name}.service
+%systemd_post %{name}.socket %{name}.service
 
 %preun
-%systemd_preun %{name}.service
+%systemd_preun %{name}.socket %{name}.service
 
 %postun
-%systemd_postun %{name}.service
+%systemd_postun_with_restart %{name}.service
 
 
 %files
 %{_bindir}/%{name}
 %{_unitdir}/%{name}.service
+%{_unitdir}/%{name}.socket
 
 
 %changelog
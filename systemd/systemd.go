@@ -0,0 +1,124 @@
+// Package systemd implements the parts of systemd's service protocol that
+// javadocr uses: readiness and watchdog notifications, and socket
+// activation. Everything here does nothing when not run under systemd.
+package systemd
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// These are the states passed to Notify.
+const (
+	Ready    = "READY=1"
+	Stopping = "STOPPING=1"
+	Watchdog = "WATCHDOG=1"
+)
+
+// Notify sends state to the service manager, as sd_notify(3) does. It
+// reports whether there was a service manager to tell.
+func Notify(state string) (bool, error) {
+	addr := os.Getenv("NOTIFY_SOCKET")
+	if addr == "" {
+		return false, nil
+	}
+	if strings.HasPrefix(addr, "@") {
+		// abstract namespace
+		addr = "\x00" + addr[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: addr, Net: "unixgram"})
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// WatchdogInterval returns how often the service manager expects to hear
+// WATCHDOG=1 from us, or zero if it doesn't. As sd_watchdog_enabled(3)
+// recommends, the interval returned is half of the configured timeout.
+func WatchdogInterval() (time.Duration, error) {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0, nil
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		// it's meant for someone else
+		return 0, nil
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, errors.New("systemd: WATCHDOG_USEC must be positive")
+	}
+	return time.Duration(n) * time.Microsecond / 2, nil
+}
+
+// listenFdsStart is the first file descriptor passed by socket activation.
+const listenFdsStart = 3
+
+// A Listener is a socket passed to us by socket activation. Name is its
+// FileDescriptorName= from the socket unit.
+type Listener struct {
+	net.Listener
+	Name string
+}
+
+// Listeners returns the sockets passed to us by socket activation, as
+// sd_listen_fds_with_names(3) does, in the order they were passed. It returns
+// nothing if we weren't socket activated. The environment variables are
+// unset so that they aren't passed on to any children.
+func Listeners() ([]Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	if os.Getenv("LISTEN_PID") != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return nil, err
+	}
+	var names []string
+	if v := os.Getenv("LISTEN_FDNAMES"); v != "" {
+		names = strings.Split(v, ":")
+	}
+
+	ls := make([]Listener, 0, nfds)
+	for fd := listenFdsStart; fd < listenFdsStart+nfds; fd++ {
+		syscall.CloseOnExec(fd)
+		f := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		l, err := net.FileListener(f)
+		// FileListener dups the descriptor, so we're done with ours
+		f.Close()
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+
+		name := "unknown"
+		if n := fd - listenFdsStart; n < len(names) {
+			name = names[n]
+		}
+		ls = append(ls, Listener{Listener: l, Name: name})
+	}
+	return ls, nil
+}
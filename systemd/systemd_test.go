@@ -0,0 +1,149 @@
+package systemd
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestNotify(t *testing.T) {
+	t.Setenv("NOTIFY_SOCKET", "")
+	if ok, err := Notify(Ready); ok || err != nil {
+		t.Errorf("Got: %v, %v without NOTIFY_SOCKET, expected: false, nil", ok, err)
+	}
+
+	pth := filepath.Join(t.TempDir(), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: pth, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	t.Setenv("NOTIFY_SOCKET", pth)
+
+	for _, state := range []string{Ready, Watchdog, Stopping} {
+		if ok, err := Notify(state); !ok || err != nil {
+			t.Fatalf("Got: %v, %v, expected: true, nil", ok, err)
+		}
+		buf := make([]byte, 64)
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := string(buf[:n]); got != state {
+			t.Errorf("Got: %s, expected: %s", got, state)
+		}
+	}
+}
+
+func TestWatchdogInterval(t *testing.T) {
+	testPlan := []struct {
+		usec, pid string
+		expected  time.Duration
+	}{
+		{"", "", 0},
+		{"30000000", "", 15 * time.Second},
+		{"30000000", strconv.Itoa(os.Getpid()), 15 * time.Second},
+		{"30000000", "1", 0},
+	}
+	for _, tp := range testPlan {
+		t.Setenv("WATCHDOG_USEC", tp.usec)
+		t.Setenv("WATCHDOG_PID", tp.pid)
+		got, err := WatchdogInterval()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tp.expected {
+			t.Errorf("Got: %v, expected: %v for %s/%s", got, tp.expected, tp.usec, tp.pid)
+		}
+	}
+
+	t.Setenv("WATCHDOG_USEC", "bees")
+	t.Setenv("WATCHDOG_PID", "")
+	if _, err := WatchdogInterval(); err == nil {
+		t.Error("Got no error for a bad WATCHDOG_USEC")
+	}
+}
+
+func TestListenersNotForUs(t *testing.T) {
+	t.Setenv("LISTEN_PID", "1")
+	t.Setenv("LISTEN_FDS", "1")
+	ls, err := Listeners()
+	if err != nil || len(ls) != 0 {
+		t.Errorf("Got: %v, %v for another process's sockets", ls, err)
+	}
+	if os.Getenv("LISTEN_FDS") != "" {
+		t.Error("LISTEN_FDS was left set")
+	}
+}
+
+func TestListeners(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	// the descriptors have to be passed in from outside, so run ourselves
+	cmd := exec.Command(os.Args[0], "-test.run=^TestListenersHelper$")
+	cmd.Env = append(os.Environ(), "JAVADOCR_SYSTEMD_HELPER=1", "LISTEN_FDS=1", "LISTEN_FDNAMES=http")
+	cmd.ExtraFiles = []*os.File{f}
+	done := make(chan error, 1)
+	go func() {
+		out, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Logf("%s", out)
+		}
+		done <- err
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	buf := make([]byte, 64)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := string(buf[:n]); got != "http" {
+		t.Errorf("Got: %s, expected: http", got)
+	}
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+}
+
+// TestListenersHelper is run by TestListeners with a socket passed in, and
+// writes the name of the socket to whoever connects to it.
+func TestListenersHelper(t *testing.T) {
+	if os.Getenv("JAVADOCR_SYSTEMD_HELPER") == "" {
+		t.Skip("only run by TestListeners")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+
+	ls, err := Listeners()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ls) != 1 {
+		t.Fatalf("Got %d listeners, expected 1", len(ls))
+	}
+	conn, err := ls[0].Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(ls[0].Name))
+}
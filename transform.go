@@ -0,0 +1,450 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"github.com/lukegb/javadocr/maven"
+	"hash/crc32"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+)
+
+// TransformContext describes the page a Transformer is being asked about.
+type TransformContext struct {
+	Project    string
+	Coordinate maven.Coordinate
+	// Path is the URL path of the page within the version's docs, such as
+	// /org/Foo.html, or /org/ for a folder.
+	Path string
+	// ContentType is the media type of the page, without any parameters.
+	ContentType string
+	// Degraded is set whilst the repository is unreachable.
+	Degraded bool
+
+	// banner is what the version banner's Key saw, so that the banner the
+	// page gets is the one it's kept under
+	banner *bannerState
+}
+
+// A Transformer rewrites pages as they are served. Transformers are given
+// in a Config, and each page is passed through those which want it in turn,
+// so that each sees what the one before it wrote.
+//
+// A page is transformed once for each key it is given, and the result kept
+// alongside the artifact it came from, so Transform need not be cheap. Key,
+// however, is asked on every request.
+type Transformer interface {
+	// ContentTypes are the media types, such as "text/html", of the pages
+	// the Transformer wants to see.
+	ContentTypes() []string
+	// Key returns "" to leave the page described by tc alone. Otherwise
+	// it identifies what Transform would do to the page: it must change
+	// whenever the output would, since it is what the transformed page is
+	// cached by, and forms part of its ETag.
+	Key(tc *TransformContext) (string, error)
+	// Transform copies the page from src to dst, changing it as it goes.
+	// It should write as it reads, where it can, so that large pages
+	// aren't held up.
+	Transform(dst io.Writer, src io.Reader, tc *TransformContext) error
+}
+
+// HTMLInjector is a Transformer which inserts fragments of HTML into pages.
+// Only the start of each page, up to the opening body tag, is held on to;
+// the rest is passed straight through.
+type HTMLInjector struct {
+	// Fragments returns what to insert into the page described by tc:
+	// head just before the closing head tag, if there is one, and body
+	// just after the opening body tag. The page is left alone if both are
+	// empty.
+	Fragments func(tc *TransformContext) (head, body string, err error)
+	// NeedsBody stops body being inserted at the start of pages which
+	// don't have a body, such as framesets.
+	NeedsBody bool
+}
+
+// NewHTMLInjector returns an HTMLInjector which inserts the same fragments
+// into every page, such as an analytics snippet or an extra stylesheet.
+func NewHTMLInjector(head, body string) *HTMLInjector {
+	return &HTMLInjector{
+		Fragments: func(*TransformContext) (string, string, error) {
+			return head, body, nil
+		},
+	}
+}
+
+func (hi *HTMLInjector) ContentTypes() []string {
+	return []string{"text/html"}
+}
+
+func (hi *HTMLInjector) Key(tc *TransformContext) (string, error) {
+	head, body, err := hi.Fragments(tc)
+	if err != nil || head == "" && body == "" {
+		return "", err
+	}
+	return fmt.Sprintf("%08x", crc32.ChecksumIEEE([]byte(head+"\x00"+body))), nil
+}
+
+func (hi *HTMLInjector) Transform(dst io.Writer, src io.Reader, tc *TransformContext) error {
+	head, body, err := hi.Fragments(tc)
+	if err != nil {
+		return err
+	}
+
+	var page []byte
+	chunk := make([]byte, 32*1024)
+	for from := 0; ; {
+		n, rerr := src.Read(chunk)
+		page = append(page, chunk[:n]...)
+		var at int
+		at, from = bodyContentOffset(page, from)
+		if at == 0 && rerr == nil {
+			continue
+		} else if rerr != nil && rerr != io.EOF {
+			return rerr
+		}
+
+		if err := hi.inject(dst, page, at, head, body); err != nil {
+			return err
+		}
+		if rerr == io.EOF {
+			return nil
+		}
+		_, err := io.Copy(dst, src)
+		return err
+	}
+}
+
+// inject writes out the start of a page, which has the content of its body
+// starting at at, or has no body if at is 0, with the fragments inserted.
+func (hi *HTMLInjector) inject(dst io.Writer, page []byte, at int, head, body string) error {
+	if head != "" {
+		before := page
+		if at != 0 {
+			before = page[:at]
+		}
+		if end := headEndOffset(before); end != -1 {
+			page = append(page[:end:end], append([]byte(head), page[end:]...)...)
+			if at != 0 {
+				at += len(head)
+			}
+		}
+	}
+	if at != 0 || !hi.NeedsBody {
+		page = append(page[:at:at], append([]byte(body), page[at:]...)...)
+	}
+	_, err := dst.Write(page)
+	return err
+}
+
+// headEndOffset finds the closing head tag, or returns -1 if there isn't one.
+func headEndOffset(page []byte) int {
+	return bytes.Index(lowerASCII(page), []byte("</head>"))
+}
+
+// bodyContentOffset finds where the content of the body element starts, or
+// returns 0 if there isn't an opening body tag. Only the page from from on
+// is looked at, and next is where to look from once more of it has been
+// read, so that pages without a body aren't searched over and over.
+func bodyContentOffset(page []byte, from int) (at, next int) {
+	lower := lowerASCII(page[from:])
+	start := 0
+	for {
+		n := bytes.Index(lower[start:], []byte("<body"))
+		if n == -1 {
+			// the tag might be split across reads
+			return 0, from + max(start, len(lower)-len("<body")+1)
+		}
+		n += start
+		after := n + len("<body")
+		if after == len(lower) {
+			return 0, from + n
+		}
+		if lower[after] == '>' || lower[after] == ' ' || lower[after] == '\t' || lower[after] == '\r' || lower[after] == '\n' {
+			end := bytes.IndexByte(lower[after:], '>')
+			if end == -1 {
+				return 0, from + n
+			}
+			return from + after + end + 1, from + n
+		}
+		start = after
+	}
+}
+
+// lowerASCII is bytes.ToLower for just the ASCII letters, so that offsets
+// into it are offsets into b, whatever else b has in it.
+func lowerASCII(b []byte) []byte {
+	lower := make([]byte, len(b))
+	for n, c := range b {
+		if 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		lower[n] = c
+	}
+	return lower
+}
+
+// builtinTransformers are the Transformers the handler's own settings call
+// for, to go after the Config's. The degraded banner goes last so that it
+// ends up above the version banner.
+func (h *JavadocHandler) builtinTransformers() []Transformer {
+	var ts []Transformer
+	if h.config.VersionBanner != nil {
+		ts = append(ts, newVersionBannerInjector(h))
+	}
+	if h.config.DegradedBanner != "" {
+		ts = append(ts, &HTMLInjector{
+			Fragments: func(tc *TransformContext) (string, string, error) {
+				if !tc.Degraded {
+					return "", "", nil
+				}
+				return "", h.config.DegradedBanner, nil
+			},
+		})
+	}
+	return ts
+}
+
+// transformersFor picks out the transformers which want the page described
+// by tc, and the key the transformed page is cached by, which is empty if
+// none of them do.
+func (h *JavadocHandler) transformersFor(tc *TransformContext) ([]Transformer, string) {
+	if tc.ContentType == "" {
+		return nil, ""
+	}
+
+	var ts []Transformer
+	var keys []string
+	for n, t := range h.transformers {
+		if !wantsContentType(t, tc.ContentType) {
+			continue
+		}
+		key, err := t.Key(tc)
+		if err != nil {
+			h.logger.Error("Transformer failed", "version", tc.Coordinate.Version, "path", tc.Path, "err", err)
+			continue
+		}
+		if key == "" {
+			continue
+		}
+		ts = append(ts, t)
+		keys = append(keys, fmt.Sprintf("%d:%s", n, key))
+	}
+	return ts, strings.Join(keys, "\x00")
+}
+
+func wantsContentType(t Transformer, contentType string) bool {
+	for _, ct := range t.ContentTypes() {
+		if strings.EqualFold(ct, contentType) {
+			return true
+		}
+	}
+	return false
+}
+
+// mediaType is the media type of the entry at name, going by its extension,
+// or "" if we can't tell without looking inside it.
+func mediaType(name string) string {
+	mt, _, err := mime.ParseMediaType(mime.TypeByExtension(path.Ext(name)))
+	if err != nil {
+		return ""
+	}
+	return mt
+}
+
+// transform passes src through each of ts in turn, running all but the last
+// in their own goroutines.
+func transform(dst io.Writer, src io.Reader, ts []Transformer, tc *TransformContext) error {
+	var wg sync.WaitGroup
+	var pipes []*io.PipeReader
+	defer func() {
+		// stop anything still writing into a transformer which gave up
+		for _, pr := range pipes {
+			pr.Close()
+		}
+		wg.Wait()
+	}()
+
+	for _, t := range ts[:len(ts)-1] {
+		pr, pw := io.Pipe()
+		pipes = append(pipes, pr)
+		wg.Add(1)
+		go func(t Transformer, src io.Reader) {
+			defer wg.Done()
+			pw.CloseWithError(t.Transform(pw, src, tc))
+		}(t, src)
+		src = pr
+	}
+	return ts[len(ts)-1].Transform(dst, src, tc)
+}
+
+// boundedBuffer keeps what is written to it, until there's more than limit,
+// at which point it quietly throws it all away.
+type boundedBuffer struct {
+	bytes.Buffer
+	limit int64
+	over  bool
+}
+
+func (bb *boundedBuffer) Write(b []byte) (int, error) {
+	if bb.over || int64(bb.Len()+len(b)) > bb.limit {
+		bb.over = true
+		bb.Reset()
+		return len(b), nil
+	}
+	return bb.Buffer.Write(b)
+}
+
+// serveTransformed serves file after passing it through ts, from the cache
+// if it has been transformed with key before. Otherwise plain GETs are
+// streamed, and everything else transformed in full first so that
+// http.ServeContent can deal with ranges and the like.
+func (h *JavadocHandler) serveTransformed(w http.ResponseWriter, r *http.Request, zfs *ZipFileSystem, file *ZipFile, ts []Transformer, key string, tc *TransformContext) {
+	w.Header().Set("Content-Type", mime.TypeByExtension(path.Ext(file.Name())))
+	if data, ok := zfs.transformed(file.f, key); ok {
+		http.ServeContent(w, r, "", file.ModTime(), bytes.NewReader(data))
+		return
+	}
+
+	rc, err := file.f.Open()
+	if err != nil {
+		h.serveError(w, r, http.StatusInternalServerError, tc.Coordinate.Version, tc.Path)
+		return
+	}
+	defer rc.Close()
+
+	kept := &boundedBuffer{limit: zfs.VariantBudget - zfs.VariantBytes()}
+	if r.Method != "GET" || r.Header.Get("Range") != "" || r.Header.Get("If-Modified-Since") != "" {
+		var buf bytes.Buffer
+		if err := transform(&buf, rc, ts, tc); err != nil {
+			h.logger.Error("Transforming page failed", "version", tc.Coordinate.Version, "path", tc.Path, "err", err)
+			h.serveError(w, r, http.StatusInternalServerError, tc.Coordinate.Version, tc.Path)
+			return
+		}
+		kept.Write(buf.Bytes())
+		if !kept.over {
+			zfs.keepTransformed(file.f, key, kept.Bytes())
+		}
+		http.ServeContent(w, r, "", file.ModTime(), bytes.NewReader(buf.Bytes()))
+		return
+	}
+
+	if !file.ModTime().IsZero() {
+		w.Header().Set("Last-Modified", file.ModTime().UTC().Format(http.TimeFormat))
+	}
+	w.WriteHeader(http.StatusOK)
+	if err := transform(io.MultiWriter(w, kept), rc, ts, tc); err != nil {
+		// it's too late to say so
+		h.logger.Error("Transforming page failed", "version", tc.Coordinate.Version, "path", tc.Path, "err", err)
+		return
+	}
+	if !kept.over {
+		zfs.keepTransformed(file.f, key, kept.Bytes())
+	}
+}
+
+// transformedPage is an entry as it was last transformed, and the key it was
+// transformed with.
+type transformedPage struct {
+	key  string
+	data []byte
+}
+
+// transformed returns f as it was transformed with key, if that has been
+// kept.
+func (zfs *ZipFileSystem) transformed(f *zip.File, key string) ([]byte, bool) {
+	zfs.variantLock.Lock()
+	defer zfs.variantLock.Unlock()
+	page, ok := zfs.transformedPages[f]
+	if !ok || page.key != key {
+		return nil, false
+	}
+	return page.data, true
+}
+
+// encodedTransformed is like encoded, but for file as it was transformed
+// with key. Only transformed pages which have been kept are compressed, by
+// whichever of the ZipFileSystem's Encoders acceptEncoding allows first.
+func (zfs *ZipFileSystem) encodedTransformed(file *ZipFile, key, acceptEncoding string) (*encodedFile, bool) {
+	contentType := mime.TypeByExtension(path.Ext(file.Name()))
+	if !isText(contentType) {
+		return nil, false
+	}
+	if _, ok := zfs.transformed(file.f, key); !ok {
+		return nil, false
+	}
+	for _, enc := range zfs.encoders() {
+		if !acceptsEncoding(acceptEncoding, enc.Name) {
+			continue
+		}
+		if data, ok := zfs.variant(file.f, key, enc); ok {
+			return &encodedFile{
+				ReadSeeker:  bytes.NewReader(data),
+				encoding:    enc.Name,
+				contentType: contentType,
+				modTime:     file.ModTime(),
+			}, true
+		}
+	}
+	return nil, false
+}
+
+// keepTransformed keeps f as transformed with key, if it fits in what's left
+// of the VariantBudget, which compressed variants share. Only one key is kept
+// for each entry: once the transformers have moved on to another, such as
+// when a new version changes the banner, what was kept for the old one won't
+// be asked for again.
+func (zfs *ZipFileSystem) keepTransformed(f *zip.File, key string, data []byte) {
+	zfs.variantLock.Lock()
+	old, ok := zfs.transformedPages[f]
+	var freed int64
+	if ok && old.key != key {
+		freed = zfs.dropTransformed(f, old)
+	}
+	zfs.variantLock.Unlock()
+	zfs.release(freed)
+	if ok && old.key == key {
+		// someone else got there first
+		return
+	}
+	if !zfs.reserve(int64(len(data))) {
+		return
+	}
+
+	zfs.variantLock.Lock()
+	_, raced := zfs.transformedPages[f]
+	if !raced {
+		if zfs.transformedPages == nil {
+			zfs.transformedPages = make(map[*zip.File]transformedPage)
+		}
+		zfs.transformedPages[f] = transformedPage{key, data}
+	}
+	zfs.variantLock.Unlock()
+	if raced {
+		// someone else got there whilst we were reserving
+		zfs.release(int64(len(data)))
+	}
+}
+
+// dropTransformed forgets page, which was kept for f, along with anything
+// compressed from it, and returns how many bytes that frees. variantLock must
+// be held.
+func (zfs *ZipFileSystem) dropTransformed(f *zip.File, page transformedPage) int64 {
+	delete(zfs.transformedPages, f)
+	freed := int64(len(page.data))
+	for _, enc := range zfs.encoders() {
+		vk := variantKey{f, page.key, enc.Name}
+		if v, ok := zfs.variants[vk]; ok {
+			v.dropped = true
+			if v.ok {
+				freed += int64(len(v.data))
+			}
+			delete(zfs.variants, vk)
+		}
+	}
+	return freed
+}
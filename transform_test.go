@@ -0,0 +1,368 @@
+package javadocr
+
+import (
+	"bytes"
+	"compress/gzip"
+	"html/template"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestHTMLInjector(t *testing.T) {
+	testPlan := map[string]string{
+		`<html><body><p>hi</p></body></html>`:                `<html><body>BANNER<p>hi</p></body></html>`,
+		`<HTML><BODY class="x"><p>hi</p></BODY></HTML>`:      `<HTML><BODY class="x">BANNER<p>hi</p></BODY></HTML>`,
+		`<html><bodyguard></bodyguard><body>x</body></html>`: `<html><bodyguard></bodyguard><body>BANNERx</body></html>`,
+		`<p>no body at all</p>`:                              `BANNER<p>no body at all</p>`,
+	}
+	hi := NewHTMLInjector("", "BANNER")
+	for in, out := range testPlan {
+		// a byte at a time, so that tags are split across reads
+		var buf bytes.Buffer
+		if err := hi.Transform(&buf, iotest.OneByteReader(strings.NewReader(in)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != out {
+			t.Errorf("Got: %s, expected: %s", got, out)
+		}
+	}
+}
+
+func TestBodyContentOffset(t *testing.T) {
+	testPlan := []struct {
+		page         string
+		from         int
+		at, expected int
+	}{
+		{"<html><body>x", 0, 12, 6},
+		{"<html><BODY class=x>x", 0, 20, 6},
+		{"<html><body", 0, 0, 6},
+		{"<html><body class=", 0, 0, 6},
+		{"<html><bo", 0, 0, 5},
+		{"<html><p>no body here", 0, 0, 17},
+		{"<html><body>x", 7, 0, 9},
+		{"<html><body>x<body>", 7, 19, 13},
+	}
+	for _, tp := range testPlan {
+		if at, next := bodyContentOffset([]byte(tp.page), tp.from); at != tp.at || next != tp.expected {
+			t.Errorf("Got: %d, %d for %q from %d, expected: %d, %d", at, next, tp.page, tp.from, tp.at, tp.expected)
+		}
+	}
+}
+
+func TestHTMLInjectorBodylessPage(t *testing.T) {
+	// a byte at a time, which takes forever if the whole page is searched
+	// for a body every time
+	page := "<html><frameset>" + strings.Repeat("<frame src=x>", 1<<15) + "</frameset></html>"
+	hi := NewHTMLInjector("", "BANNER")
+	hi.NeedsBody = true
+	var buf bytes.Buffer
+	if err := hi.Transform(&buf, iotest.OneByteReader(strings.NewReader(page)), nil); err != nil {
+		t.Fatal(err)
+	}
+	if buf.String() != page {
+		t.Error("Got the page changed, expected it to be left alone")
+	}
+}
+
+func TestHTMLInjectorHead(t *testing.T) {
+	testPlan := map[string]string{
+		`<html><head><title>x</title></HEAD><body>hi</body></html>`: `<html><head><title>x</title>HEAD</HEAD><body>BANNERhi</body></html>`,
+		`<html><head></head><frameset></frameset></html>`:           `<html><head>HEAD</head><frameset></frameset></html>`,
+		`<p>no head or body</p>`:                                    `<p>no head or body</p>`,
+		`<html><body><p>&lt;/head&gt;</head></p></body></html>`:     `<html><body>BANNER<p>&lt;/head&gt;</head></p></body></html>`,
+	}
+	hi := NewHTMLInjector("HEAD", "BANNER")
+	hi.NeedsBody = true
+	for in, out := range testPlan {
+		var buf bytes.Buffer
+		if err := hi.Transform(&buf, strings.NewReader(in), nil); err != nil {
+			t.Fatal(err)
+		}
+		if got := buf.String(); got != out {
+			t.Errorf("Got: %s, expected: %s", got, out)
+		}
+	}
+}
+
+func TestHTMLInjectorStreams(t *testing.T) {
+	srcR, srcW := io.Pipe()
+	dstR, dstW := io.Pipe()
+	go func() {
+		dstW.CloseWithError(NewHTMLInjector("", "BANNER").Transform(dstW, srcR, nil))
+	}()
+
+	go srcW.Write([]byte("<html><body>"))
+	got := make([]byte, len("<html><body>BANNER"))
+	if _, err := io.ReadFull(dstR, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "<html><body>BANNER" {
+		t.Errorf("Got: %s, expected: %s", got, "<html><body>BANNER")
+	}
+
+	// the rest comes through as it arrives
+	go srcW.Write([]byte("<p>more</p>"))
+	got = make([]byte, len("<p>more</p>"))
+	if _, err := io.ReadFull(dstR, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "<p>more</p>" {
+		t.Errorf("Got: %s, expected: %s", got, "<p>more</p>")
+	}
+	srcW.Close()
+	if rest, err := io.ReadAll(dstR); err != nil || len(rest) != 0 {
+		t.Errorf("Got: %q, %v, expected the end of the page", rest, err)
+	}
+}
+
+// upperTransformer shouts CSS, and counts how often it's asked to.
+type upperTransformer struct {
+	transforms int32
+}
+
+func (ut *upperTransformer) ContentTypes() []string {
+	return []string{"text/css"}
+}
+
+func (ut *upperTransformer) Key(tc *TransformContext) (string, error) {
+	return "upper", nil
+}
+
+func (ut *upperTransformer) Transform(dst io.Writer, src io.Reader, tc *TransformContext) error {
+	atomic.AddInt32(&ut.transforms, 1)
+	b, err := io.ReadAll(src)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(bytes.ToUpper(b))
+	return err
+}
+
+func TestJavadocHandlerTransformers(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{
+		"org/Foo.html":   "<html><head></head><body>foo</body></html>",
+		"org/Bar.html":   "<html><head></head><body>bar</body></html>",
+		"stylesheet.css": "body { color: red; }",
+		"package-list":   "org",
+	})
+	ut := new(upperTransformer)
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:   time.Hour,
+		Transformers: []Transformer{ut, NewHTMLInjector(`<link rel="stylesheet" href="/dark.css">`, "")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	testPlan := map[string]string{
+		"/1.0/stylesheet.css": "BODY { COLOR: RED; }",
+		"/1.0/org/Foo.html":   `<html><head><link rel="stylesheet" href="/dark.css"></head><body>foo</body></html>`,
+		"/1.0/package-list":   "org",
+	}
+	etags := make(map[string]string)
+	for pth, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Got: %s for %s, expected: %s", got, pth, expected)
+		}
+		etags[pth] = rec.Header().Get("ETag")
+	}
+	if !strings.Contains(etags["/1.0/stylesheet.css"], "-t") || strings.Contains(etags["/1.0/package-list"], "-t") {
+		t.Errorf("Got ETags: %v, expected only the transformed pages to be marked", etags)
+	}
+	lrec := httptest.NewRecorder()
+	h.ServeHTTP(lrec, httptest.NewRequest("GET", "/1.0/org/", nil))
+	if got := lrec.Body.String(); !strings.Contains(got, `<link rel="stylesheet" href="/dark.css"></head>`) {
+		t.Errorf("Got: %s for the listing, expected it to be transformed", got)
+	}
+
+	// the transformed page is kept, and compressed like any other
+	for _, req := range []*http.Request{
+		httptest.NewRequest("GET", "/1.0/stylesheet.css", nil),
+		httptest.NewRequest("HEAD", "/1.0/stylesheet.css", nil),
+		httptest.NewRequest("GET", "/1.0/stylesheet.css", nil),
+	} {
+		req.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != "gzip" {
+			t.Errorf("Got: %d, %q for %s, expected a gzipped 200", rec.Code, rec.Header().Get("Content-Encoding"), req.Method)
+		}
+		if etag := rec.Header().Get("ETag"); etag == etags["/1.0/stylesheet.css"] || !strings.Contains(etag, "-t") {
+			t.Errorf("Got ETag %s, expected one for the transformed page gzipped", etag)
+		}
+		if req.Method == "HEAD" {
+			continue
+		}
+		gr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, _ := io.ReadAll(gr); string(got) != "BODY { COLOR: RED; }" {
+			t.Errorf("Got: %s, expected: %s", got, "BODY { COLOR: RED; }")
+		}
+	}
+	ranged := httptest.NewRequest("GET", "/1.0/stylesheet.css", nil)
+	ranged.Header.Set("Range", "bytes=0-3")
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, ranged)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "BODY" {
+		t.Errorf("Got: %d %s, expected: %d BODY", rr.Code, rr.Body.String(), http.StatusPartialContent)
+	}
+	if n := atomic.LoadInt32(&ut.transforms); n != 1 {
+		t.Errorf("Got: %d transforms, expected: 1", n)
+	}
+
+	// pages which aren't kept are transformed in full for ranges
+	h2, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:   time.Hour,
+		Transformers: []Transformer{NewHTMLInjector("", "BANNER")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h2.Close()
+	ranged = httptest.NewRequest("GET", "/1.0/org/Bar.html", nil)
+	ranged.Header.Set("Range", "bytes=19-27")
+	rr = httptest.NewRecorder()
+	h2.ServeHTTP(rr, ranged)
+	if rr.Code != http.StatusPartialContent || rr.Body.String() != "<body>BAN" {
+		t.Errorf("Got: %d %s, expected: %d <body>BAN", rr.Code, rr.Body.String(), http.StatusPartialContent)
+	}
+}
+
+func TestJavadocHandlerBuiltinTransformers(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:     time.Hour,
+		VersionBanner:  template.Must(template.New("banner").Parse("VERSION")),
+		DegradedBanner: "DEGRADED",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	c, _ := h.coordinateForVersion("1.0")
+	tc := &TransformContext{Coordinate: c, Path: "/org/Foo.html", ContentType: "text/html", Degraded: true}
+	ts, key := h.transformersFor(tc)
+	if len(ts) != 2 || key == "" {
+		t.Fatalf("Got: %d transformers, key %q, expected both banners", len(ts), key)
+	}
+	var buf bytes.Buffer
+	if err := transform(&buf, strings.NewReader("<html><body>foo</body></html>"), ts, tc); err != nil {
+		t.Fatal(err)
+	}
+	if got, expected := buf.String(), "<html><body>DEGRADEDVERSIONfoo</body></html>"; got != expected {
+		t.Errorf("Got: %s, expected: %s", got, expected)
+	}
+
+	tc.Degraded = false
+	if ts, nkey := h.transformersFor(tc); len(ts) != 1 || nkey == key {
+		t.Errorf("Got: %d transformers, key %q, expected just the version banner under a new key", len(ts), nkey)
+	}
+}
+
+func TestHTMLInjectorIgnoresOtherContent(t *testing.T) {
+	tr := newTestRepository(t, "1.0")
+	tr.jars["1.0"] = makeJar(t, map[string]string{
+		"stylesheet.css": "body { color: red; }",
+		"package-list":   "org",
+	})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:   time.Hour,
+		Transformers: []Transformer{NewHTMLInjector("HEAD", "BANNER")},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	testPlan := map[string]string{
+		"/1.0/stylesheet.css": "body { color: red; }",
+		"/1.0/package-list":   "org",
+	}
+	for pth, expected := range testPlan {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", pth, nil))
+		if got := rec.Body.String(); got != expected {
+			t.Errorf("Got: %s for %s, expected: %s", got, pth, expected)
+		}
+		if etag := rec.Header().Get("ETag"); strings.Contains(etag, "-t") {
+			t.Errorf("Got ETag %s for %s, expected it not to be marked as transformed", etag, pth)
+		}
+	}
+}
+
+func TestJavadocHandlerKeepsOnePagePerKey(t *testing.T) {
+	versions := []string{"1.0", "1.1", "1.2", "1.3", "1.4", "1.5", "1.6", "1.7", "1.8", "1.9"}
+	tr := newTestRepository(t, versions...)
+	// the budget for variants is the size of the artifact, so give it
+	// room for a few pages
+	noise := make([]byte, 1<<16)
+	rand.New(rand.NewSource(1)).Read(noise)
+	tr.jars["1.0"] = makeJar(t, map[string]string{
+		"org/Foo.html": "<html><head></head><body>" + strings.Repeat("<p>foo</p>", 100) + "</body></html>",
+		"noise.bin":    string(noise),
+	})
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:    time.Hour,
+		VersionBanner: DefaultVersionBanner,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	var page string
+	get := func() {
+		t.Helper()
+		// once to keep it, and again to compress it
+		for _, accept := range []string{"", "gzip"} {
+			req := httptest.NewRequest("GET", "/1.0/org/Foo.html", nil)
+			req.Header.Set("Accept-Encoding", accept)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != http.StatusOK || rec.Header().Get("Content-Encoding") != accept {
+				t.Fatalf("Got: %d, %q, expected: %d, %q", rec.Code, rec.Header().Get("Content-Encoding"), http.StatusOK, accept)
+			}
+			if accept == "" {
+				page = rec.Body.String()
+			}
+		}
+	}
+	get()
+	c, _ := h.coordinateForVersion("1.0")
+	zfs := h.cachedServer(c)
+	first := zfs.VariantBytes()
+
+	// every exclusion changes what the banner says, and so its key
+	for _, v := range versions[1:9] {
+		h.ExcludeVersion(v)
+		get()
+	}
+	if got := zfs.VariantBytes(); got > first*3/2 {
+		t.Errorf("Got %d variant bytes after the banner changed, expected about %d", got, first)
+	}
+	zfs.variantLock.Lock()
+	defer zfs.variantLock.Unlock()
+	if len(zfs.transformedPages) != 1 || len(zfs.variants) != 1 {
+		t.Errorf("Got: %d transformed pages and %d variants, expected 1 of each", len(zfs.transformedPages), len(zfs.variants))
+	}
+	for _, kept := range zfs.transformedPages {
+		if string(kept.data) != page {
+			t.Error("Got the page as it was first transformed, expected it as it was last")
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package javadocr
+
+import (
+	"github.com/lukegb/javadocr/maven"
+	"sync/atomic"
+)
+
+// WarmStats counts the artifacts fetched ahead of time by cache warming.
+type WarmStats struct {
+	Warmed  uint64
+	Failed  uint64
+	Pending uint64
+}
+
+// WarmStats returns a snapshot of the cache warming counters.
+func (h *JavadocHandler) WarmStats() WarmStats {
+	return WarmStats{
+		Warmed:  atomic.LoadUint64(&h.warmStats.Warmed),
+		Failed:  atomic.LoadUint64(&h.warmStats.Failed),
+		Pending: atomic.LoadUint64(&h.warmStats.Pending),
+	}
+}
+
+// newVersions returns the coordinates in next which weren't in prev. The
+// first list we ever fetch doesn't count as discovering anything.
+func newVersions(prev, next []maven.Coordinate) []maven.Coordinate {
+	if prev == nil {
+		return nil
+	}
+
+	known := make(map[maven.Coordinate]bool, len(prev))
+	for _, c := range prev {
+		known[c] = true
+	}
+
+	var discovered []maven.Coordinate
+	for _, c := range next {
+		if !known[c] {
+			discovered = append(discovered, c)
+		}
+	}
+	return discovered
+}
+
+// latestVersions returns up to n of the newest versions which aren't
+// excluded, newest first.
+func (h *JavadocHandler) latestVersions(n int) []maven.Coordinate {
+	h.versionsLock.RLock()
+	defer h.versionsLock.RUnlock()
+
+	var latest []maven.Coordinate
+	for i := len(h.versions) - 1; i >= 0 && len(latest) < n; i-- {
+		if !h.excludeVersions[h.versions[i].Version] {
+			latest = append(latest, h.versions[i])
+		}
+	}
+	return latest
+}
+
+// warm fetches and indexes each of cs in turn. Only one batch is warmed at a
+// time so that we don't hammer the repository.
+func (h *JavadocHandler) warm(cs []maven.Coordinate) {
+	atomic.AddUint64(&h.warmStats.Pending, uint64(len(cs)))
+
+	h.warmLock.Lock()
+	defer h.warmLock.Unlock()
+
+	for n, c := range cs {
+		if h.isClosed() {
+			h.logger.Info("Abandoning warming: handler closed", "remaining", len(cs)-n)
+			atomic.AddUint64(&h.warmStats.Pending, ^uint64(len(cs)-n-1))
+			return
+		}
+
+		h.versionsLock.RLock()
+		excluded := h.excludeVersions[c.Version]
+		h.versionsLock.RUnlock()
+
+		if excluded {
+			h.logger.Debug("Not warming excluded version", "version", c.Version, "n", n+1, "of", len(cs))
+			atomic.AddUint64(&h.warmStats.Pending, ^uint64(0))
+			continue
+		}
+
+		h.logger.Info("Warming", "version", c.Version, "n", n+1, "of", len(cs))
+		_, _, _, err := h.fetchForCoordinate(c)
+		atomic.AddUint64(&h.warmStats.Pending, ^uint64(0))
+		if err != nil {
+			atomic.AddUint64(&h.warmStats.Failed, 1)
+			h.logger.Warn("Warming failed", "version", c.Version, "err", err)
+			continue
+		}
+		atomic.AddUint64(&h.warmStats.Warmed, 1)
+	}
+	h.logger.Info("Finished warming", "count", len(cs))
+}
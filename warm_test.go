@@ -0,0 +1,148 @@
+package javadocr
+
+import (
+	"github.com/lukegb/javadocr/maven"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestNewVersions(t *testing.T) {
+	v := func(s string) maven.Coordinate {
+		return maven.Coordinate{GroupId: "org.spongepowered", ArtifactId: "spongeapi", Version: s}
+	}
+
+	if got := newVersions(nil, []maven.Coordinate{v("1.0")}); got != nil {
+		t.Errorf("initial population discovered %v", got)
+	}
+
+	got := newVersions([]maven.Coordinate{v("1.0"), v("2.0")}, []maven.Coordinate{v("1.0"), v("2.0"), v("3.0")})
+	if expected := []maven.Coordinate{v("3.0")}; !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %v, expected: %v", got, expected)
+	}
+}
+
+func TestLatestVersions(t *testing.T) {
+	h := &JavadocHandler{
+		excludeVersions: map[string]bool{"3.0.1-indev": true},
+	}
+	for _, s := range []string{"1.0", "2.0", "3.0.0", "3.0.1-indev"} {
+		h.versions = append(h.versions, maven.Coordinate{Version: s})
+	}
+
+	got := h.latestVersions(2)
+	expected := []maven.Coordinate{{Version: "3.0.0"}, {Version: "2.0"}}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("Got: %v, expected: %v", got, expected)
+	}
+}
+
+func TestJavadocHandlerWarms(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0", "4.0")
+	for _, v := range []string{"1.0", "2.0", "3.0", "4.0", "5.0"} {
+		tr.jars[v] = makeJar(t, map[string]string{"index.html": v})
+	}
+	tr.jarDelay = 10 * time.Millisecond
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:      time.Hour,
+		ExcludeVersions: []string{"3.0"},
+		WarmLatest:      2,
+		WarmNewVersions: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	// the two latest versions which aren't excluded are fetched on start
+	h.background.Wait()
+	if metadata, jars := atomic.LoadInt32(&tr.metadataFetch), atomic.LoadInt32(&tr.jarFetch); metadata != 1 || jars != 2 {
+		t.Errorf("Got: %d metadata and %d jar fetches, expected 1 and 2", metadata, jars)
+	}
+	for _, v := range []string{"4.0", "2.0"} {
+		c, _ := h.coordinateForVersion(v)
+		if h.cachedServer(c) == nil {
+			t.Errorf("Got %s uncached, expected it to have been warmed", v)
+		}
+	}
+	if got, expected := h.WarmStats(), (WarmStats{Warmed: 2}); got != expected {
+		t.Errorf("Got: %+v, expected: %+v", got, expected)
+	}
+
+	// new versions are fetched when they turn up, even if they fail
+	tr.versions = append(tr.versions, "5.0", "6.0")
+	if err := h.refresh(); err != nil {
+		t.Fatal(err)
+	}
+	h.background.Wait()
+	if jars := atomic.LoadInt32(&tr.jarFetch); jars != 3 {
+		t.Errorf("Got: %d jar fetches, expected 3", jars)
+	}
+	if got, expected := h.WarmStats(), (WarmStats{Warmed: 3, Failed: 1}); got != expected {
+		t.Errorf("Got: %+v, expected: %+v", got, expected)
+	}
+
+	// those already cached aren't fetched again
+	h.warm(h.latestVersions(3)[1:])
+	if jars := atomic.LoadInt32(&tr.jarFetch); jars != 3 {
+		t.Errorf("Got: %d jar fetches, expected 3", jars)
+	}
+
+	// and only one is fetched at a time, however many batches there are
+	var wg sync.WaitGroup
+	for _, v := range []string{"1.0", "3.0"} {
+		c, _ := h.coordinateForVersion(v)
+		h.IncludeVersion(v)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.warm([]maven.Coordinate{c})
+		}()
+	}
+	wg.Wait()
+	if jars := atomic.LoadInt32(&tr.jarFetch); jars != 5 {
+		t.Errorf("Got: %d jar fetches, expected 5", jars)
+	}
+	if most := atomic.LoadInt32(&tr.mostJarsInFlight); most != 1 {
+		t.Errorf("Got: %d jars fetched at once, expected 1", most)
+	}
+	if got, expected := h.WarmStats(), (WarmStats{Warmed: 7, Failed: 1}); got != expected {
+		t.Errorf("Got: %+v, expected: %+v", got, expected)
+	}
+}
+
+func TestJavadocHandlerWarmsOnceTheRepositoryRecovers(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0", "3.0")
+	for _, v := range tr.versions {
+		tr.jars[v] = makeJar(t, map[string]string{"index.html": v})
+	}
+	atomic.StoreInt32(&tr.down, 1)
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour, WarmLatest: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	h.background.Wait()
+	if got, expected := h.WarmStats(), (WarmStats{}); got != expected {
+		t.Errorf("Got: %+v whilst the repository was down, expected: %+v", got, expected)
+	}
+
+	atomic.StoreInt32(&tr.down, 0)
+	h.refresh()
+	h.background.Wait()
+	if jars := atomic.LoadInt32(&tr.jarFetch); jars != 2 {
+		t.Errorf("Got: %d jar fetches, expected 2", jars)
+	}
+	if got, expected := h.WarmStats(), (WarmStats{Warmed: 2}); got != expected {
+		t.Errorf("Got: %+v, expected: %+v", got, expected)
+	}
+
+	// later refreshes don't warm them again
+	h.refresh()
+	h.background.Wait()
+	if got, expected := h.WarmStats(), (WarmStats{Warmed: 2}); got != expected {
+		t.Errorf("Got: %+v, expected: %+v", got, expected)
+	}
+}
@@ -0,0 +1,218 @@
+package javadocr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/lukegb/javadocr/maven"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// MaxWebhookPayload is the largest webhook body we are willing to read.
+const MaxWebhookPayload = 1024 * 1024
+
+// webhookSignature describes a header in which some repository manager sends
+// the HMAC of a webhook payload.
+type webhookSignature struct {
+	header string
+	prefix string
+	hash   func() hash.Hash
+}
+
+var webhookSignatures = []webhookSignature{
+	// our own generic form
+	{"X-Javadocr-Signature", "sha256=", sha256.New},
+	// GitHub package webhooks
+	{"X-Hub-Signature-256", "sha256=", sha256.New},
+	// Sonatype Nexus
+	{"X-Nexus-Webhook-Signature", "", sha1.New},
+	// JFrog Artifactory
+	{"X-JFrog-Event-Auth", "", sha256.New},
+}
+
+// verifyWebhookSignature checks whether any of the signature headers we know
+// about carries a valid HMAC of body.
+func verifyWebhookSignature(secret string, hdr http.Header, body []byte) bool {
+	for _, ws := range webhookSignatures {
+		v := hdr.Get(ws.header)
+		if v == "" || !strings.HasPrefix(v, ws.prefix) {
+			continue
+		}
+		sig, err := hex.DecodeString(strings.TrimPrefix(v, ws.prefix))
+		if err != nil {
+			continue
+		}
+
+		mac := hmac.New(ws.hash, []byte(secret))
+		mac.Write(body)
+		if hmac.Equal(sig, mac.Sum(nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// webhookPayload covers the fields we care about from each of the payloads we
+// understand.
+type webhookPayload struct {
+	// generic
+	Version string `json:"version"`
+
+	// Nexus component and asset events
+	Component struct {
+		Group   string `json:"group"`
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	} `json:"component"`
+	Asset struct {
+		Name string `json:"name"`
+	} `json:"asset"`
+
+	// GitHub registry_package events
+	Package struct {
+		// Name is the group and artifact IDs joined with a dot
+		Name           string `json:"name"`
+		PackageVersion struct {
+			Version string `json:"version"`
+		} `json:"package_version"`
+	} `json:"package"`
+
+	// Artifactory deployed events
+	Data struct {
+		Path string `json:"path"`
+	} `json:"data"`
+}
+
+// versionFromRepositoryPath picks the version out of a path to a file inside a
+// Maven repository, such as org/spongepowered/spongeapi/3.0.0/spongeapi-3.0.0.jar,
+// and reports whether the file belongs to c's artifact at all.
+func versionFromRepositoryPath(c maven.Coordinate, pth string) (string, bool) {
+	want := append(strings.Split(c.GroupId, "."), c.ArtifactId)
+	pieces := strings.Split(strings.Trim(pth, "/"), "/")
+	if len(pieces) <= len(want) {
+		return "", false
+	}
+	for n, piece := range want {
+		if pieces[n] != piece {
+			return "", false
+		}
+	}
+	if len(pieces) < len(want)+2 {
+		// there needs to be a version and a file after the artifact,
+		// rather than just the artifact's metadata
+		return "", true
+	}
+	return pieces[len(want)], true
+}
+
+// webhookVersion works out which version a webhook is about, if it says, and
+// whether it's about c's artifact at all: repository managers send webhooks
+// for everything in the repository.
+func webhookVersion(c maven.Coordinate, hdr http.Header, body []byte) (string, bool) {
+	if strings.HasPrefix(hdr.Get("Content-Type"), "application/x-www-form-urlencoded") {
+		form, err := url.ParseQuery(string(body))
+		if err != nil {
+			return "", true
+		}
+		return form.Get("version"), true
+	}
+
+	var p webhookPayload
+	if err := json.Unmarshal(body, &p); err != nil {
+		return "", true
+	}
+
+	switch {
+	case p.Version != "":
+		return p.Version, true
+	case p.Component.Version != "":
+		return p.Component.Version, p.Component.Group == c.GroupId && p.Component.Name == c.ArtifactId
+	case p.Package.PackageVersion.Version != "":
+		return p.Package.PackageVersion.Version, p.Package.Name == c.GroupId+"."+c.ArtifactId
+	case p.Asset.Name != "":
+		return versionFromRepositoryPath(c, p.Asset.Name)
+	case p.Data.Path != "":
+		return versionFromRepositoryPath(c, p.Data.Path)
+	}
+	return "", true
+}
+
+// WebhookHandler lets a repository manager or CI tell us that something has
+// been deployed, so that we can pick it up immediately rather than waiting for
+// the next refresh. Payloads are POSTed to /<project name>, and must be signed
+// with that project's WebhookSecret.
+//
+// The version deployed is picked out of Nexus, Artifactory and GitHub package
+// payloads, a JSON object with a "version" field, or a form with a "version"
+// field. If no version is given then every SNAPSHOT is invalidated. Payloads
+// about other artifacts in the repository are accepted, but ignored.
+type WebhookHandler struct {
+	Projects Projects
+}
+
+func (wh WebhookHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	name := strings.Trim(r.URL.Path, "/")
+	h, ok := wh.Projects[name]
+	if !ok {
+		http.Error(w, "unknown project", http.StatusNotFound)
+		return
+	}
+
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, MaxWebhookPayload))
+	if err != nil {
+		http.Error(w, "payload too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+
+	if h.config.WebhookSecret == "" || !verifyWebhookSignature(h.config.WebhookSecret, r.Header, body) {
+		h.logger.Warn("Rejected webhook with bad signature", "remote", r.RemoteAddr)
+		http.Error(w, "bad signature", http.StatusForbidden)
+		return
+	}
+
+	version, ours := webhookVersion(h.coordinate, r.Header, body)
+	if !ours {
+		h.logger.Debug("Ignoring webhook for another artifact", "remote", r.RemoteAddr, "version", version)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		json.NewEncoder(w).Encode(struct {
+			Project string `json:"project"`
+			Ignored bool   `json:"ignored"`
+		}{name, true})
+		return
+	}
+	h.logger.Info("Webhook received", "remote", r.RemoteAddr, "version", version)
+
+	// invalidate first, so nobody picks up the old build after we refresh
+	evicted := false
+	if version != "" {
+		evicted = h.Invalidate(version)
+	} else {
+		h.InvalidateSnapshots()
+	}
+
+	if err := h.populateVersions(); err != nil {
+		h.logger.Warn("Refreshing after webhook failed", "err", err)
+		http.Error(w, "refreshing versions failed", http.StatusBadGateway)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(struct {
+		Project string `json:"project"`
+		Version string `json:"version,omitempty"`
+		Evicted bool   `json:"evicted"`
+	}{name, version, evicted})
+}
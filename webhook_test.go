@@ -0,0 +1,150 @@
+package javadocr
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func sign(h func() hash.Hash, secret, body string) string {
+	mac := hmac.New(h, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifyWebhookSignature(t *testing.T) {
+	body := `{"version":"3.0.0"}`
+	testPlan := []struct {
+		header, value string
+		ok            bool
+	}{
+		{"X-Javadocr-Signature", "sha256=" + sign(sha256.New, "s3cret", body), true},
+		{"X-Hub-Signature-256", "sha256=" + sign(sha256.New, "s3cret", body), true},
+		{"X-Nexus-Webhook-Signature", sign(sha1.New, "s3cret", body), true},
+		{"X-JFrog-Event-Auth", sign(sha256.New, "s3cret", body), true},
+		{"X-Javadocr-Signature", "sha256=" + sign(sha256.New, "wrong", body), false},
+		{"X-Javadocr-Signature", sign(sha256.New, "s3cret", body), false},
+		{"X-Nexus-Webhook-Signature", sign(sha256.New, "s3cret", body), false},
+		{"X-Javadocr-Signature", "sha256=zz", false},
+		{"X-Unknown-Signature", "sha256=" + sign(sha256.New, "s3cret", body), false},
+	}
+	for _, tp := range testPlan {
+		hdr := make(http.Header)
+		hdr.Set(tp.header, tp.value)
+		if got := verifyWebhookSignature("s3cret", hdr, []byte(body)); got != tp.ok {
+			t.Errorf("%s: %s: got %v, expected %v", tp.header, tp.value, got, tp.ok)
+		}
+	}
+}
+
+func TestWebhookVersion(t *testing.T) {
+	testPlan := map[string]struct {
+		version string
+		ours    bool
+	}{
+		`{"version":"3.0.0"}`: {"3.0.0", true},
+		`{"action":"CREATED","component":{"group":"org.spongepowered","name":"spongeapi","version":"4.0.0"}}`:               {"4.0.0", true},
+		`{"action":"CREATED","component":{"group":"org.spongepowered","name":"spongecommon","version":"4.0.0"}}`:            {"4.0.0", false},
+		`{"action":"CREATED","component":{"group":"com.example","name":"spongeapi","version":"4.0.0"}}`:                     {"4.0.0", false},
+		`{"asset":{"name":"org/spongepowered/spongeapi/5.0.0-SNAPSHOT/spongeapi-5.0.0-20160101.061445-1-javadoc.jar"}}`:     {"5.0.0-SNAPSHOT", true},
+		`{"asset":{"name":"org/spongepowered/spongeapi/maven-metadata.xml"}}`:                                               {"", true},
+		`{"asset":{"name":"org/spongepowered/spongecommon/5.0.0/spongecommon-5.0.0.jar"}}`:                                  {"", false},
+		`{"action":"published","package":{"name":"org.spongepowered.spongeapi","package_version":{"version":"6.0.0"}}}`:     {"6.0.0", true},
+		`{"action":"published","package":{"name":"org.spongepowered.spongevanilla","package_version":{"version":"6.0.0"}}}`: {"6.0.0", false},
+		`{"domain":"artifact","data":{"path":"org/spongepowered/spongeapi/7.0.0/spongeapi-7.0.0-javadoc.jar"}}`:             {"7.0.0", true},
+		`{"domain":"artifact","data":{"path":"com/example/thing/7.0.0/thing-7.0.0.jar"}}`:                                   {"", false},
+		`{}`:       {"", true},
+		`not json`: {"", true},
+	}
+	for body, expected := range testPlan {
+		hdr := make(http.Header)
+		hdr.Set("Content-Type", "application/json")
+		if version, ours := webhookVersion(testCoordinate, hdr, []byte(body)); version != expected.version || ours != expected.ours {
+			t.Errorf("%s: got %q, %v, expected %q, %v", body, version, ours, expected.version, expected.ours)
+		}
+	}
+
+	hdr := make(http.Header)
+	hdr.Set("Content-Type", "application/x-www-form-urlencoded")
+	if version, ours := webhookVersion(testCoordinate, hdr, []byte("version=8.0.0")); version != "8.0.0" || !ours {
+		t.Errorf("form: got %q, %v, expected 8.0.0", version, ours)
+	}
+}
+
+func TestWebhookHandler(t *testing.T) {
+	tr := newTestRepository(t, "1.0", "2.0")
+	h, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{
+		GCInterval:    time.Hour,
+		WebhookSecret: "s3cret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+	insecure, err := NewJavadocHandlerWithConfig(tr.repository(t), testCoordinate, Config{GCInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer insecure.Close()
+
+	wh := WebhookHandler{Projects: Projects{"spongeapi": h, "insecure": insecure}}
+	post := func(project, body, signature string) int {
+		req := httptest.NewRequest("POST", "/"+project, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Javadocr-Signature", "sha256="+signature)
+		rec := httptest.NewRecorder()
+		wh.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	if code := post("unknown", "version=2.0", sign(sha256.New, "s3cret", "version=2.0")); code != http.StatusNotFound {
+		t.Errorf("unknown project: got %d", code)
+	}
+	if code := post("spongeapi", "version=2.0", sign(sha256.New, "wrong", "version=2.0")); code != http.StatusForbidden {
+		t.Errorf("bad signature: got %d", code)
+	}
+	if code := post("insecure", "version=2.0", sign(sha256.New, "", "version=2.0")); code != http.StatusForbidden {
+		t.Errorf("project without a secret: got %d", code)
+	}
+
+	fetches := atomic.LoadInt32(&tr.metadataFetch)
+	tr.versions = append(tr.versions, "3.0")
+	if code := post("spongeapi", "version=3.0", sign(sha256.New, "s3cret", "version=3.0")); code != http.StatusOK {
+		t.Fatalf("good webhook: got %d", code)
+	}
+	if got := atomic.LoadInt32(&tr.metadataFetch); got != fetches+1 {
+		t.Errorf("webhook didn't refresh versions")
+	}
+	if latest := h.latestVersions(1); len(latest) != 1 || latest[0].Version != "3.0" {
+		t.Errorf("got latest version %v, expected 3.0", latest)
+	}
+
+	// a deploy of something else with the same version leaves ours alone
+	tr.jars["3.0"] = makeJar(t, map[string]string{"index.html": "3.0"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/3.0/index.html", nil))
+	body := `{"action":"CREATED","component":{"group":"org.spongepowered","name":"spongecommon","version":"3.0"}}`
+	req := httptest.NewRequest("POST", "/spongeapi", strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Nexus-Webhook-Signature", sign(sha1.New, "s3cret", body))
+	rec = httptest.NewRecorder()
+	wh.ServeHTTP(rec, req)
+	if rec.Code != http.StatusAccepted || !strings.Contains(rec.Body.String(), `"ignored":true`) {
+		t.Errorf("other artifact: got %d %s, expected it to be ignored", rec.Code, rec.Body.String())
+	}
+	c, _ := h.coordinateForVersion("3.0")
+	if h.cachedServer(c) == nil {
+		t.Error("other artifact: got 3.0 evicted, expected it to still be cached")
+	}
+	if got := atomic.LoadInt32(&tr.metadataFetch); got != fetches+1 {
+		t.Errorf("other artifact: got %d version refreshes, expected none", got-fetches-1)
+	}
+}
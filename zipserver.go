@@ -2,46 +2,155 @@ package javadocr
 
 import (
 	"archive/zip"
+	"bytes"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
-	"log"
-	"net/http"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// ZipFileSystem is a file system backed by a zip file. It implements fs.FS,
+// fs.ReadDirFS, fs.ReadFileFS and fs.StatFS; use http.FS to serve it.
 type ZipFileSystem struct {
 	r    *zip.Reader
 	root *ZipFolder
-}
 
-func (fs *ZipFileSystem) buildStructure() error {
-	fs.root = NewZipFolder("")
-	for _, n := range fs.r.File {
-		nPath, nName := path.Split(n.Name)
-		if nName == "" {
+	// Logger is where files being opened are logged, at debug level. If
+	// nil, slog.Default is used.
+	Logger *slog.Logger
+	// Checksum identifies the artifact the zip came from, and forms the
+	// first half of every ETag.
+	Checksum string
+
+	// Encoders are used to build compressed variants of text entries, in
+	// order of preference. If nil, BrotliEncoder and GzipEncoder are used.
+	Encoders []Encoder
+	// VariantBudget is the most memory, in bytes, that compressed variants
+	// and transformed pages may take up. Inflate indexes count towards it
+	// too, but are kept regardless, since seeking needs them.
+	VariantBudget int64
+
+	adlers    map[*zip.File]uint32
+	adlerLock sync.Mutex
+
+	// variantBytes is only ever changed atomically, and never whilst
+	// variantLock is held; that just guards the maps
+	variantBytes     int64
+	variants         map[variantKey]*variant
+	transformedPages map[*zip.File]transformedPage
+	variantLock      sync.Mutex
+}
+
+func (zfs *ZipFileSystem) buildStructure(limits Limits) error {
+	if len(zfs.r.File) > limits.MaxEntries {
+		return &ArchiveError{Reason: fmt.Sprintf("has %d entries, more than the limit of %d", len(zfs.r.File), limits.MaxEntries)}
+	}
+
+	zfs.root = NewZipFolder("")
+	var total uint64
+	for _, n := range zfs.r.File {
+		name, err := limits.checkEntry(n)
+		if err != nil {
+			return err
+		}
+		total += n.UncompressedSize64
+		if total > uint64(limits.MaxUncompressedSize) {
+			return &ArchiveError{Reason: fmt.Sprintf("is more than %d bytes uncompressed, the limit", limits.MaxUncompressedSize)}
+		}
+
+		if n.Mode().IsDir() {
+			if _, err := zfs.getDirectoryByPath(name); err != nil {
+				return &ArchiveError{Entry: n.Name, Reason: "clashes with another entry"}
+			}
 			continue
 		}
 
-		dir, err := fs.getDirectoryByPath(nPath)
+		nPath, nName := path.Split(name)
+		dir, err := zfs.getDirectoryByPath(nPath)
 		if err != nil {
-			return err
+			return &ArchiveError{Entry: n.Name, Reason: "clashes with another entry"}
+		}
+		if _, ok := dir.inodesByName[nName]; ok {
+			return &ArchiveError{Entry: n.Name, Reason: "clashes with another entry"}
 		}
 		zf, err := NewZipFile(n)
 		if err != nil {
 			return err
 		}
+		zf.zfs = zfs
 		dir.inodes = append(dir.inodes, zf)
 		dir.inodesByName[nName] = zf
 	}
+	zfs.root.settle()
+	return nil
+}
+
+// fsPath turns a URL path into the fs.FS path it refers to.
+func fsPath(name string) string {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return "."
+	}
+	return name
+}
+
+// served finds what http.FileServer serves for the URL path name: a ZipFile,
+// or a ZipFolder if it has no index. It returns nil for paths which
+// http.FileServer redirects.
+func (zfs *ZipFileSystem) served(name string) ZipInode {
+	if strings.HasSuffix(name, "/index.html") {
+		return nil
+	}
+	f, err := zfs.lookup("open", fsPath(name))
+	if err != nil {
+		return nil
+	}
+
+	isDirPath := strings.HasSuffix(name, "/")
+	switch f := f.(type) {
+	case *ZipFolder:
+		if !isDirPath {
+			return nil
+		}
+		if index, ok := f.inodesByName["index.html"].(*ZipFile); ok {
+			return index
+		}
+		return f
+	case *ZipFile:
+		if isDirPath {
+			return nil
+		}
+		return f
+	}
 	return nil
 }
 
-func (fs *ZipFileSystem) getDirectoryByPath(name string) (*ZipFolder, error) {
+// ETag returns a strong ETag for what http.FileServer serves for the URL path
+// name. Files are identified by the CRC32 from their zip header, and folders
+// by their path, since their listings only change if the artifact does.
+// There is no ETag for paths which http.FileServer redirects.
+func (zfs *ZipFileSystem) ETag(name string) (string, bool) {
+	switch f := zfs.served(name).(type) {
+	case *ZipFolder:
+		return fmt.Sprintf(`"%s-d%08x"`, zfs.Checksum, crc32.ChecksumIEEE([]byte(name))), true
+	case *ZipFile:
+		return fmt.Sprintf(`"%s-%08x"`, zfs.Checksum, f.f.CRC32), true
+	}
+	return "", false
+}
+
+func (zfs *ZipFileSystem) getDirectoryByPath(name string) (*ZipFolder, error) {
 	namePieces := strings.Split(strings.TrimPrefix(name, "/"), "/")
-	curDir := fs.root
+	curDir := zfs.root
 	for _, piece := range namePieces {
 		if piece == "" {
 			continue
@@ -62,40 +171,141 @@ func (fs *ZipFileSystem) getDirectoryByPath(name string) (*ZipFolder, error) {
 	return curDir, nil
 }
 
+// NewZipFileSystem builds a ZipFileSystem from r, rejecting it with an
+// *ArchiveError if it goes over the default Limits.
 func NewZipFileSystem(r *zip.Reader) (*ZipFileSystem, error) {
+	return NewZipFileSystemWithLimits(r, Limits{})
+}
+
+// NewZipFileSystemWithLimits builds a ZipFileSystem from r, rejecting it with
+// an *ArchiveError if it goes over limits.
+func NewZipFileSystemWithLimits(r *zip.Reader, limits Limits) (*ZipFileSystem, error) {
 	zfs := &ZipFileSystem{
 		r: r,
 	}
-	return zfs, zfs.buildStructure()
+	if err := zfs.buildStructure(limits.withDefaults()); err != nil {
+		return nil, err
+	}
+	return zfs, nil
+}
+
+func (zfs *ZipFileSystem) logger() *slog.Logger {
+	if zfs.Logger == nil {
+		return slog.Default()
+	}
+	return zfs.Logger
+}
+
+// lookup finds the file or folder called name, which must be a valid fs.FS
+// path. op is used in any error returned.
+func (zfs *ZipFileSystem) lookup(op, name string) (ZipInode, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrInvalid}
+	}
+	if name == "." {
+		return zfs.root, nil
+	}
+
+	dir := zfs.root
+	pieces := strings.Split(name, "/")
+	for n, piece := range pieces {
+		inode, ok := dir.inodesByName[piece]
+		if !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+		if n == len(pieces)-1 {
+			return inode, nil
+		}
+		if dir, ok = inode.(*ZipFolder); !ok {
+			return nil, &fs.PathError{Op: op, Path: name, Err: fs.ErrNotExist}
+		}
+	}
+	panic("unreachable")
 }
 
-func (fs *ZipFileSystem) Open(name string) (http.File, error) {
-	log.Printf("opening %s", name)
+func (zfs *ZipFileSystem) Open(name string) (fs.File, error) {
+	zfs.logger().Debug("Opening file", "name", name)
+
+	inode, err := zfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return inode.open(), nil
+}
 
-	if name == "/" {
-		return fs.root, nil
+func (zfs *ZipFileSystem) Stat(name string) (fs.FileInfo, error) {
+	inode, err := zfs.lookup("stat", name)
+	if err != nil {
+		return nil, err
 	}
+	return inode, nil
+}
 
-	nPath, nName := path.Split(name)
-	nDir, err := fs.getDirectoryByPath(nPath)
+// ReadDir returns the entries in the folder called name, sorted by name.
+func (zfs *ZipFileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	inode, err := zfs.lookup("readdir", name)
 	if err != nil {
 		return nil, err
 	}
+	zfolder, ok := inode.(*ZipFolder)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: errors.New("not a directory")}
+	}
+	return zfolder.entries(), nil
+}
 
-	if f, ok := nDir.inodesByName[nName]; !ok {
-		return nil, os.ErrNotExist
-	} else if ffolder, ok := f.(*ZipFolder); ok {
-		return ffolder, nil
-	} else if ffile, ok := f.(*ZipFile); ok {
-		return ffile, nil
-	} else {
-		panic(fmt.Sprintf("found a thing of weird type: %#v", f))
+func (zfs *ZipFileSystem) ReadFile(name string) ([]byte, error) {
+	inode, err := zfs.lookup("read", name)
+	if err != nil {
+		return nil, err
+	}
+	zf, ok := inode.(*ZipFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: errors.New("is a directory")}
+	}
 
+	rc, err := zf.f.Open()
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
 	}
+	defer rc.Close()
+	data := make([]byte, 0, zf.f.UncompressedSize64)
+	buf := bytes.NewBuffer(data)
+	if _, err := buf.ReadFrom(rc); err != nil {
+		return nil, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return buf.Bytes(), nil
 }
 
+// inflateCheckpointSpacing is roughly how far apart, in decompressed bytes,
+// reading a deflated entry can be resumed from. Entries smaller than this are
+// just inflated from the start again.
+const inflateCheckpointSpacing = 256 * 1024
+
+// ZipFile is a file in a ZipFileSystem. It is shared by every request for
+// the file, so it holds nothing that changes once it is built, apart from the
+// checkpoints through it which are found the first time they're needed; Open
+// returns a zipFileHandle to read it with.
 type ZipFile struct {
-	f  *zip.File
+	f *zip.File
+	// zfs is the ZipFileSystem the file is in, if it's in one, which its
+	// inflate index is accounted to
+	zfs *ZipFileSystem
+
+	indexOnce sync.Once
+	index     []inflateCheckpoint
+	indexErr  error
+}
+
+func (zf *ZipFile) open() fs.File {
+	return &zipFileHandle{ZipFile: zf}
+}
+
+// zipFileHandle is a ZipFile opened for reading. Unlike the ZipFile, it
+// isn't safe for concurrent use.
+type zipFileHandle struct {
+	*ZipFile
+
 	fc io.ReadCloser
 
 	curoffset  int64
@@ -103,79 +313,146 @@ type ZipFile struct {
 	mustseek   bool
 }
 
-func (zf *ZipFile) Close() error {
-	return zf.closeFC()
+func (fh *zipFileHandle) Close() error {
+	return fh.closeFC()
 }
 
-func (zf *ZipFile) Read(b []byte) (int, error) {
-	log.Println("reading from", zf.Name())
-	if zf.fc == nil {
-		if err := zf.openFC(); err != nil {
+func (fh *zipFileHandle) Read(b []byte) (int, error) {
+	if fh.mustseek {
+		if err := fh.seekTo(fh.nextoffset); err != nil {
 			return 0, err
 		}
+		fh.mustseek = false
 	}
-
-	if zf.mustseek {
-		if zf.nextoffset < zf.curoffset {
-			// we need to reopen the file
-			err := zf.reopenFC()
-			if err != nil {
-				return -1, err
-			}
-		}
-		for zf.nextoffset > zf.curoffset {
-			// we can just read until we get there
-			tmpB := make([]byte, zf.nextoffset-zf.curoffset)
-			b, err := zf.fc.Read(tmpB)
-			zf.curoffset += int64(b)
-			if err != nil {
-				return 0, err
-			}
+	if fh.fc == nil {
+		if err := fh.openAt(0); err != nil {
+			return 0, err
 		}
-		zf.mustseek = false
 	}
 
-	n, err := zf.fc.Read(b)
-	zf.curoffset += int64(n)
+	n, err := fh.fc.Read(b)
+	fh.curoffset += int64(n)
 	return n, err
 }
 
-func (zf *ZipFile) Readdir(n int) ([]os.FileInfo, error) {
-	return []os.FileInfo{}, io.EOF
+// seekTo gets fc ready to read from offset, by reading forward if that's
+// not too far, and otherwise starting again from as close as we can get.
+func (fh *zipFileHandle) seekTo(offset int64) error {
+	if fh.fc != nil && offset == fh.curoffset {
+		return nil
+	}
+	if fh.fc != nil && fh.f.Method != zip.Store && offset > fh.curoffset && offset-fh.curoffset < inflateCheckpointSpacing {
+		return fh.discard(offset - fh.curoffset)
+	}
+	return fh.openAt(offset)
 }
 
-func (zf *ZipFile) openFC() error {
-	if zf.fc != nil {
-		zf.fc.Close()
-		zf.fc = nil
+// discard reads and throws away n bytes.
+func (fh *zipFileHandle) discard(n int64) error {
+	copied, err := io.CopyN(io.Discard, fh.fc, n)
+	fh.curoffset += copied
+	if err == io.EOF {
+		// seeking past the end is fine, reading from there isn't
+		return nil
 	}
-	var err error
-	zf.fc, err = zf.f.Open()
-	zf.curoffset = 0
-	zf.mustseek = false
 	return err
 }
 
-func (zf *ZipFile) closeFC() error {
-	if zf.fc == nil {
-		return nil
+// rawSection returns the entry's data, as it's stored in the zip.
+func (zf *ZipFile) rawSection() (*io.SectionReader, bool) {
+	raw, err := zf.f.OpenRaw()
+	if err != nil {
+		return nil, false
 	}
+	sr, ok := raw.(*io.SectionReader)
+	return sr, ok
+}
+
+// inflateIndex returns the checkpoints through a deflated entry, finding them
+// the first time they are asked for.
+func (zf *ZipFile) inflateIndex() ([]inflateCheckpoint, error) {
+	zf.indexOnce.Do(func() {
+		raw, ok := zf.rawSection()
+		if !ok {
+			zf.indexErr = errors.New("javadocr: can't read raw entry data")
+			return
+		}
+		zf.index, zf.indexErr = buildInflateIndex(raw, inflateCheckpointSpacing)
+		if zf.zfs != nil {
+			// this is kept even if it goes over the budget
+			atomic.AddInt64(&zf.zfs.variantBytes, inflateIndexSize(zf.index))
+		}
+	})
+	return zf.index, zf.indexErr
+}
 
-	err := zf.fc.Close()
-	zf.fc = nil
-	return err
+func (zf *ZipFile) logger() *slog.Logger {
+	if zf.zfs == nil {
+		return slog.Default()
+	}
+	return zf.zfs.logger()
 }
 
-func (zf *ZipFile) reopenFC() error {
-	err := zf.closeFC()
+// openAt opens fc ready to read from offset. Stored entries are read from
+// directly; deflated entries are inflated from the nearest checkpoint
+// before offset.
+func (fh *zipFileHandle) openAt(offset int64) error {
+	if err := fh.closeFC(); err != nil {
+		return err
+	}
+
+	if raw, ok := fh.rawSection(); ok && fh.f.Method == zip.Store {
+		if offset > raw.Size() {
+			offset = raw.Size()
+		}
+		fh.fc = io.NopCloser(io.NewSectionReader(raw, offset, raw.Size()-offset))
+		fh.curoffset = offset
+		return nil
+	}
+
+	if fh.f.Method == zip.Deflate && offset >= inflateCheckpointSpacing {
+		if cps, err := fh.inflateIndex(); err != nil {
+			fh.logger().Warn("Indexing entry failed, inflating from the start", "name", fh.f.Name, "err", err)
+		} else if n := sort.Search(len(cps), func(n int) bool {
+			return cps[n].out > offset
+		}); n > 0 && cps[n-1].out > 0 {
+			cp := cps[n-1]
+			if raw, ok := fh.rawSection(); ok {
+				fc, err := resumeInflate(raw, cp)
+				if err != nil {
+					return err
+				}
+				fh.fc = fc
+				fh.curoffset = cp.out
+				return fh.discard(offset - cp.out)
+			}
+		}
+	}
+
+	var err error
+	fh.fc, err = fh.f.Open()
 	if err != nil {
 		return err
 	}
-	return zf.openFC()
+	fh.curoffset = 0
+	return fh.discard(offset)
+}
+
+func (fh *zipFileHandle) closeFC() error {
+	if fh.fc == nil {
+		return nil
+	}
+
+	err := fh.fc.Close()
+	fh.fc = nil
+	return err
 }
 
-func (zf *ZipFile) Seek(offset int64, whence int) (int64, error) {
-	oldOffset := zf.curoffset
+func (fh *zipFileHandle) Seek(offset int64, whence int) (int64, error) {
+	oldOffset := fh.curoffset
+	if fh.mustseek {
+		oldOffset = fh.nextoffset
+	}
 
 	var newOffset int64
 	if whence == 0 {
@@ -183,21 +460,21 @@ func (zf *ZipFile) Seek(offset int64, whence int) (int64, error) {
 	} else if whence == 1 {
 		newOffset = oldOffset + offset
 	} else if whence == 2 {
-		newOffset = int64(zf.f.UncompressedSize64) + offset
+		newOffset = int64(fh.f.UncompressedSize64) + offset
 	}
 
 	if newOffset < 0 || whence < 0 || whence > 2 {
 		return -1, os.ErrInvalid
 	}
 
-	zf.nextoffset = newOffset
-	zf.mustseek = true
+	fh.nextoffset = newOffset
+	fh.mustseek = true
 
 	return newOffset, nil
 }
 
-func (zf *ZipFile) Stat() (os.FileInfo, error) {
-	return zf, nil
+func (fh *zipFileHandle) Stat() (os.FileInfo, error) {
+	return fh.ZipFile, nil
 }
 
 func (zf *ZipFile) Name() string {
@@ -227,70 +504,80 @@ func (zf *ZipFile) Sys() interface{} {
 
 func NewZipFile(f *zip.File) (*ZipFile, error) {
 	return &ZipFile{
-		f:          f,
-		curoffset:  0,
-		nextoffset: 0,
-		mustseek:   false,
+		f: f,
 	}, nil
 }
 
-type ZipInode interface{}
+// ZipInode is a *ZipFile or a *ZipFolder. Inodes are shared, so they can't be
+// read from; open returns a new handle which can.
+type ZipInode interface {
+	fs.FileInfo
+	open() fs.File
+}
 
+// ZipFolder is a folder in a ZipFileSystem. Like ZipFile, it doesn't change
+// once the ZipFileSystem is built; Open returns a zipFolderHandle to list it
+// with.
 type ZipFolder struct {
 	name         string
 	inodes       []ZipInode
 	inodesByName map[string]ZipInode
+	modTime      time.Time
+}
+
+func (zf *ZipFolder) open() fs.File {
+	return &zipFolderHandle{ZipFolder: zf}
+}
+
+// entries returns a DirEntry for everything in the folder.
+func (zf *ZipFolder) entries() []fs.DirEntry {
+	des := make([]fs.DirEntry, len(zf.inodes))
+	for n, inode := range zf.inodes {
+		des[n] = fs.FileInfoToDirEntry(inode)
+	}
+	return des
+}
+
+// zipFolderHandle is a ZipFolder opened for listing. Unlike the ZipFolder,
+// it isn't safe for concurrent use.
+type zipFolderHandle struct {
+	*ZipFolder
 
 	fileinfoPos int
 }
 
-func (zf *ZipFolder) Close() error {
+func (dh *zipFolderHandle) Close() error {
 	return nil
 }
 
-func (zf *ZipFolder) Read(b []byte) (int, error) {
+func (dh *zipFolderHandle) Read(b []byte) (int, error) {
 	return 0, io.EOF
 }
 
-func (zf *ZipFolder) Readdir(n int) (fi []os.FileInfo, err error) {
+// ReadDir implements fs.ReadDirFile.
+func (dh *zipFolderHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	des := dh.entries()[dh.fileinfoPos:]
 	if n <= 0 {
-		fi = make([]os.FileInfo, len(zf.inodes))
-		for ipos, inode := range zf.inodes {
-			fi[ipos], err = inode.(http.File).Stat()
-			if err != nil {
-				return fi, err
-			}
-		}
-		return fi, err
+		dh.fileinfoPos += len(des)
+		return des, nil
 	}
 
-	if zf.fileinfoPos == len(zf.inodes) {
-		zf.fileinfoPos = 0
-		return make([]os.FileInfo, 0), io.EOF
+	if len(des) == 0 {
+		return des, io.EOF
 	}
-
-	if n > len(zf.inodes)-zf.fileinfoPos {
-		n = len(zf.inodes) - zf.fileinfoPos
-	}
-
-	fi = make([]os.FileInfo, n)
-	for ipos := zf.fileinfoPos; ipos < len(zf.inodes) && ipos < zf.fileinfoPos+n; ipos++ {
-		fi[ipos-zf.fileinfoPos], err = zf.inodes[ipos].(http.File).Stat()
-		if err != nil {
-			zf.fileinfoPos += ipos
-			return fi, err
-		}
+	if n > len(des) {
+		n = len(des)
 	}
-	zf.fileinfoPos += n
-	return fi, err
+	dh.fileinfoPos += n
+	return des[:n], nil
 }
 
-func (zf *ZipFolder) Seek(n int64, whence int) (int64, error) {
+func (dh *zipFolderHandle) Seek(n int64, whence int) (int64, error) {
 	return 0, io.EOF
 }
 
-func (zf *ZipFolder) Stat() (os.FileInfo, error) {
-	return zf, nil
+func (dh *zipFolderHandle) Stat() (os.FileInfo, error) {
+	return dh.ZipFolder, nil
 }
 
 func (zf *ZipFolder) IsDir() bool {
@@ -310,7 +597,29 @@ func (zf *ZipFolder) Sys() interface{} {
 }
 
 func (zf *ZipFolder) ModTime() time.Time {
-	return time.Now()
+	return zf.modTime
+}
+
+// settle sorts the contents of the folder, and every folder inside it, by
+// name, and sets their modification times to that of the newest file inside
+// them.
+func (zf *ZipFolder) settle() time.Time {
+	sort.Slice(zf.inodes, func(i, j int) bool {
+		return zf.inodes[i].Name() < zf.inodes[j].Name()
+	})
+	for _, inode := range zf.inodes {
+		var t time.Time
+		switch inode := inode.(type) {
+		case *ZipFolder:
+			t = inode.settle()
+		case *ZipFile:
+			t = inode.ModTime()
+		}
+		if t.After(zf.modTime) {
+			zf.modTime = t
+		}
+	}
+	return zf.modTime
 }
 
 func (zf *ZipFolder) Mode() os.FileMode {
@@ -322,6 +631,18 @@ func NewZipFolder(name string) *ZipFolder {
 		name:         name,
 		inodes:       make([]ZipInode, 0),
 		inodesByName: make(map[string]ZipInode),
-		fileinfoPos:  0,
 	}
 }
+
+// etagMatches reports whether an If-None-Match header matches etag, using the
+// weak comparison that If-None-Match calls for.
+func etagMatches(header, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" || strings.TrimPrefix(candidate, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,220 @@
+package javadocr
+
+import (
+	"archive/zip"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func newTestZipFileSystem(t testing.TB, method uint16, files map[string]string) *ZipFileSystem {
+	zfs, err := NewZipFileSystem(newZipReader(t, makeJarWithMethod(t, method, files)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	zfs.Checksum = "abcd"
+	return zfs
+}
+
+func TestZipFileSystemETag(t *testing.T) {
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{
+		"index.html":         "index",
+		"org/Foo.html":       "foo",
+		"org/Bar.html":       "bar",
+		"org/sub/index.html": "sub",
+	})
+
+	testPlan := map[string]bool{
+		"/":                   true,
+		"/org/":               true,
+		"/org/Foo.html":       true,
+		"/org/Bar.html":       true,
+		"/index.html":         false, // redirected to /
+		"/org":                false, // redirected to /org/
+		"/org/Foo.html/":      false, // redirected to /org/Foo.html
+		"/org/sub/index.html": false,
+		"/missing.html":       false,
+	}
+	seen := make(map[string]string)
+	for name, expected := range testPlan {
+		etag, ok := zfs.ETag(name)
+		if ok != expected {
+			t.Errorf("Got: %v for %s, expected: %v", ok, name, expected)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		if !strings.HasPrefix(etag, `"abcd-`) || !strings.HasSuffix(etag, `"`) {
+			t.Errorf("Got: %s for %s, expected a strong ETag including the checksum", etag, name)
+		}
+		if other, ok := seen[etag]; ok {
+			t.Errorf("%s and %s have the same ETag %s", name, other, etag)
+		}
+		seen[etag] = name
+	}
+}
+
+func TestZipFolderModTime(t *testing.T) {
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{"org/Foo.html": "foo"})
+	expected := time.Date(2016, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, name := range []string{".", "org"} {
+		f, err := zfs.Open(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !fi.ModTime().Equal(expected) {
+			t.Errorf("Got: %v for %s, expected: %v", fi.ModTime(), name, expected)
+		}
+	}
+}
+
+func TestETagMatches(t *testing.T) {
+	testPlan := map[string]bool{
+		`"abc"`:          true,
+		`W/"abc"`:        true,
+		`"xyz", "abc"`:   true,
+		`*`:              true,
+		`"xyz"`:          false,
+		`"abc-degraded"`: false,
+		`"ab", W/"abcd"`: false,
+	}
+	for header, expected := range testPlan {
+		if got := etagMatches(header, `"abc"`); got != expected {
+			t.Errorf("Got: %v for %s, expected: %v", got, header, expected)
+		}
+	}
+}
+
+func TestZipFileSystemFS(t *testing.T) {
+	zfs := newTestZipFileSystem(t, zip.Deflate, map[string]string{
+		"index.html":         "index",
+		"org/Foo.html":       "foo",
+		"org/Bar.html":       "bar",
+		"org/sub/index.html": "sub",
+	})
+	if err := fstest.TestFS(zfs, "index.html", "org/Foo.html", "org/Bar.html", "org/sub/index.html"); err != nil {
+		t.Fatal(err)
+	}
+
+	var walked []string
+	err := fs.WalkDir(zfs, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() != (name == "." || name == "org" || name == "org/sub") {
+			t.Errorf("Got: IsDir %v for %s", d.IsDir(), name)
+		}
+		walked = append(walked, name)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(walked, ",") != ".,index.html,org,org/Bar.html,org/Foo.html,org/sub,org/sub/index.html" {
+		t.Errorf("Got: %v walking", walked)
+	}
+
+	matches, err := fs.Glob(zfs, "org/*.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(matches, ",") != "org/Bar.html,org/Foo.html" {
+		t.Errorf("Got: %v, expected: [org/Bar.html org/Foo.html]", matches)
+	}
+
+	b, err := fs.ReadFile(zfs, "org/sub/index.html")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "sub" {
+		t.Errorf("Got: %s, expected: sub", b)
+	}
+
+	testPlan := map[string]error{
+		"missing.html":     fs.ErrNotExist,
+		"org/missing.html": fs.ErrNotExist,
+		"index.html/foo":   fs.ErrNotExist,
+		"/index.html":      fs.ErrInvalid,
+		"../index.html":    fs.ErrInvalid,
+		"org/":             fs.ErrInvalid,
+	}
+	for name, expected := range testPlan {
+		if _, err := zfs.Open(name); !errors.Is(err, expected) {
+			t.Errorf("Got: %v opening %s, expected: %v", err, name, expected)
+		}
+		if _, err := fs.Stat(zfs, name); !errors.Is(err, expected) {
+			t.Errorf("Got: %v statting %s, expected: %v", err, name, expected)
+		}
+	}
+}
+
+func TestZipFileSystemConcurrentHandles(t *testing.T) {
+	page := string(testDeflateInputs()["javadoc"])
+	files := map[string]string{
+		"index-all.html": page,
+		"org/Foo.html":   "foo",
+		"org/Bar.html":   "bar",
+	}
+	for name, zfs := range map[string]*ZipFileSystem{"deflated": newTestZipFileSystem(t, zip.Deflate, files), "stored": newTestZipFileSystem(t, zip.Store, files)} {
+		var wg sync.WaitGroup
+		for g := 0; g < 8; g++ {
+			wg.Add(1)
+			go func(seed int64) {
+				defer wg.Done()
+				rnd := rand.New(rand.NewSource(seed))
+				for n := 0; n < 10; n++ {
+					file, err := zfs.Open("index-all.html")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					f := file.(io.ReadSeeker)
+					offset := rnd.Int63n(int64(len(page)) - 100)
+					if _, err := f.Seek(offset, io.SeekStart); err != nil {
+						t.Error(err)
+					}
+					buf := make([]byte, 100)
+					if _, err := io.ReadFull(f, buf); err != nil {
+						t.Errorf("%s: reading at %d: %v", name, offset, err)
+					} else if string(buf) != page[offset:offset+100] {
+						t.Errorf("%s: Got: %q at %d, expected: %q", name, buf, offset, page[offset:offset+100])
+					}
+					file.Close()
+
+					dir, err := zfs.Open("org")
+					if err != nil {
+						t.Error(err)
+						return
+					}
+					var listed []string
+					for {
+						des, err := dir.(fs.ReadDirFile).ReadDir(1)
+						if err == io.EOF {
+							break
+						} else if err != nil {
+							t.Error(err)
+							break
+						}
+						listed = append(listed, des[0].Name())
+					}
+					dir.Close()
+					if strings.Join(listed, ",") != "Bar.html,Foo.html" {
+						t.Errorf("%s: Got: %v listing org, expected: [Bar.html Foo.html]", name, listed)
+					}
+				}
+			}(int64(g))
+		}
+		wg.Wait()
+	}
+}